@@ -0,0 +1,99 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "regexp"
+    "strings"
+)
+
+// accountName is what useradd accepts for user and group names by default.
+var accountName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// cryptHash matches the "$id$..." hashes of crypt(3) that chpasswd -e takes.
+var cryptHash = regexp.MustCompile(`^\$[0-9a-z]+\$[./0-9A-Za-z$=,]+$`)
+
+// validateUsers checks the accounts to create. Names end up in command
+// lines and in a sudoers file name, so only plain names are accepted.
+func validateUsers(users []UserConfig) error {
+    seen := make(map[string]bool)
+    for i, u := range users {
+        if u.Name == "" {
+            return fmt.Errorf("users[%d].name is required", i)
+        }
+        if !accountName.MatchString(u.Name) || u.Name == "root" {
+            return fmt.Errorf("users[%d].name: %q is not a valid user name", i, u.Name)
+        }
+        if seen[u.Name] {
+            return fmt.Errorf("users[%d]: %s is listed twice", i, u.Name)
+        }
+        seen[u.Name] = true
+        if u.PasswordHash != "" {
+            if u.Password != "" {
+                return fmt.Errorf("users[%d]: password and password_hash cannot both be set", i)
+            }
+            if !cryptHash.MatchString(u.PasswordHash) {
+                return fmt.Errorf("users[%d].password_hash is not a crypt(3) hash", i)
+            }
+        }
+        for _, g := range u.Groups {
+            if !accountName.MatchString(g) {
+                return fmt.Errorf("users[%d].groups: %q is not a valid group name", i, g)
+            }
+        }
+    }
+    return nil
+}
+
+// userOps creates the accounts of cfg in the target mounted at root: the
+// user with a home directory and its groups, its password and, for sudo
+// users, a sudoers drop-in.
+func userOps(cfg *InstallConfig, root string) []Operation {
+    var ops []Operation
+    for _, u := range cfg.Users {
+        opts := shellArgs("")
+        if len(u.Groups) > 0 {
+            opts = shellArgs(" -G " + shellWord(strings.Join(u.Groups, ",")))
+        }
+        ops = append(ops, newCmdOp("userAdd", root, opts, u.Name))
+        if u.Password != "" || u.PasswordHash != "" {
+            ops = append(ops, passwordOp{root, u.Name, u.Password, u.PasswordHash})
+        }
+        if u.Sudo {
+            dir := path.Join(root, "etc", "sudoers.d")
+            file := path.Join(dir, "10-"+u.Name)
+            rule := u.Name + " ALL=(ALL:ALL) ALL\n"
+            ops = append(ops,
+                newCmdOp("mkdirTarget", dir),
+                newFileOp(file, func(Runner) string { return rule }),
+                newCmdOp("chmodFile", "0440", file),
+            )
+        }
+    }
+    return ops
+}
+
+// passwordOp sets the password of a user of the target. The password is
+// hashed when the operation runs, unless the hash was given, and only the
+// hash reaches chpasswd, on its standard input.
+type passwordOp struct {
+    root     string
+    user     string
+    password Secret
+    hash     string
+}
+
+func (o passwordOp) Describe() string {
+    return "set the password of " + o.user
+}
+
+func (o passwordOp) Apply(r Runner) error {
+    hash := o.hash
+    if hash == "" {
+        var err error
+        if hash, err = hashPassword(o.password); err != nil {
+            return err
+        }
+    }
+    return runSecret(r, "chpasswdHashed", Secret(o.user+":"+hash), o.root)
+}
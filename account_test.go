@@ -0,0 +1,31 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestSudoersOps(t *testing.T) {
+    root := testRoot(t)
+    cfg := &InstallConfig{Users: []UserConfig{
+        {Name: "alice", Password: "secret", Groups: []string{"wheel"}, Sudo: true},
+        {Name: "bob"},
+    }}
+    applyInRoot(t, userOps(cfg, root))
+
+    file := filepath.Join(root, "etc/sudoers.d/10-alice")
+    if got, want := readTarget(t, root, "etc/sudoers.d/10-alice"), "alice ALL=(ALL:ALL) ALL\n"; got != want {
+        t.Errorf("sudoers drop-in is %q, want %q", got, want)
+    }
+    st, err := os.Stat(file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if st.Mode().Perm() != 0440 {
+        t.Errorf("sudoers drop-in mode is %v, want 0440", st.Mode().Perm())
+    }
+    if _, err := os.Stat(filepath.Join(root, "etc/sudoers.d/10-bob")); !os.IsNotExist(err) {
+        t.Errorf("sudoers drop-in written for a user without sudo: %v", err)
+    }
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// lsblkNum decodes the numeric columns of lsblk, which are printed as
+// numbers, as strings by util-linux older than 2.33, or as null when unknown.
+type lsblkNum int64
+
+func (n *lsblkNum) UnmarshalJSON(data []byte) error {
+    s := strings.Trim(string(data), `"`)
+    if s == "null" || s == "" {
+        *n = 0
+        return nil
+    }
+    v, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return fmt.Errorf("[lsblkNum] %q is not a number", s)
+    }
+    *n = lsblkNum(v)
+    return nil
+}
+
+// lsblkFlag decodes the boolean columns of lsblk, which older versions print
+// as "0" and "1".
+type lsblkFlag bool
+
+func (f *lsblkFlag) UnmarshalJSON(data []byte) error {
+    switch strings.Trim(string(data), `"`) {
+    case "true", "1":
+        *f = true
+    case "false", "0", "null", "":
+        *f = false
+    default:
+        return fmt.Errorf("[lsblkFlag] %s is not a boolean", data)
+    }
+    return nil
+}
+
+// BlockDevice is one node of the device tree: a disk, a partition on it, a
+// LUKS mapping on the partition, an LVM volume in the mapping and so on. All
+// sizes are in bytes; the filesystem sizes are zero when lsblk does not know
+// them, which is the case for filesystems that are not mounted. Start is the
+// offset of a partition in 512-byte sectors, whatever the disk's sector size.
+type BlockDevice struct {
+    Name       string    `json:"name"`
+    Path       string    `json:"path"`
+    Type       string    `json:"type"`
+    Size       lsblkNum  `json:"size"`
+    Start      lsblkNum  `json:"start"`
+    FSSize     lsblkNum  `json:"fssize"`
+    FSAvail    lsblkNum  `json:"fsavail"`
+    FSUsed     lsblkNum  `json:"fsused"`
+    FSType     string    `json:"fstype"`
+    Label      string    `json:"label"`
+    UUID       string    `json:"uuid"`
+    PartLabel  string    `json:"partlabel"`
+    PartUUID   string    `json:"partuuid"`
+    PartType   string    `json:"parttype"`
+    PTType     string    `json:"pttype"`
+    Model      string    `json:"model"`
+    Serial     string    `json:"serial"`
+    Tran       string    `json:"tran"`
+    Rota       lsblkFlag `json:"rota"`
+    Removable  lsblkFlag `json:"rm"`
+    ReadOnly   lsblkFlag `json:"ro"`
+    LogSec     lsblkNum  `json:"log-sec"`
+    Mountpoint string    `json:"mountpoint"`
+    // FSExtent is how much of the device the filesystem spans, read from
+    // its superblock by MakePartitionTable. Zero when it is not known.
+    FSExtent lsblkNum `json:"-"`
+
+    Children []*BlockDevice `json:"children"`
+    Parent   *BlockDevice   `json:"-"`
+}
+
+// ParseLsblk decodes the output of the lsblkTree command and links every
+// child to its parent. Devices with several parents, like an LV spanning two
+// PVs, are linked to the first one.
+func ParseLsblk(data []byte) ([]*BlockDevice, error) {
+    var out struct {
+        Blockdevices []*BlockDevice `json:"blockdevices"`
+    }
+    if err := json.NewDecoder(bytes.NewReader(data)).Decode(&out); err != nil {
+        return nil, fmt.Errorf("[ParseLsblk] %w", err)
+    }
+    linkParents(nil, out.Blockdevices)
+    return out.Blockdevices, nil
+}
+
+func linkParents(parent *BlockDevice, devs []*BlockDevice) {
+    for _, d := range devs {
+        if d.Parent == nil {
+            d.Parent = parent
+        }
+        linkParents(d, d.Children)
+    }
+}
+
+// ListBlockDevices runs lsblk and returns the top level devices of the tree.
+func ListBlockDevices(r Runner) ([]*BlockDevice, error) {
+    out, err := r.Output(commands["lsblkTree"])
+    if err != nil {
+        return nil, fmt.Errorf("[ListBlockDevices] %w", err)
+    }
+    return ParseLsblk(out)
+}
+
+// WalkDevices calls fn for every device of the tree, parents before
+// children. A device shown under several parents is visited once.
+func WalkDevices(devs []*BlockDevice, fn func(*BlockDevice)) {
+    seen := make(map[string]bool)
+    var walk func([]*BlockDevice)
+    walk = func(devs []*BlockDevice) {
+        for _, d := range devs {
+            if seen[d.Path] {
+                continue
+            }
+            seen[d.Path] = true
+            fn(d)
+            walk(d.Children)
+        }
+    }
+    walk(devs)
+}
+
+// FindDevice returns the device with the given path, or nil.
+func FindDevice(devs []*BlockDevice, path string) *BlockDevice {
+    var found *BlockDevice
+    WalkDevices(devs, func(d *BlockDevice) {
+        if found == nil && d.Path == path {
+            found = d
+        }
+    })
+    return found
+}
+
+// Disk returns the top level device d lives on.
+func (d *BlockDevice) Disk() *BlockDevice {
+    for d.Parent != nil {
+        d = d.Parent
+    }
+    return d
+}
+
+// InUse reports whether d or anything stacked on it is mounted.
+func (d *BlockDevice) InUse() bool {
+    if d.Mountpoint != "" {
+        return true
+    }
+    for _, c := range d.Children {
+        if c.InUse() {
+            return true
+        }
+    }
+    return false
+}
+
+// checkTarget makes sure the target of cfg exists, or is created by a
+// queued operation, and is safe to overwrite. Partitions to be created are
+// looked up in the disk layouts the queue leaves, which includes the ones
+// of new tables.
+func checkTarget(devs []*BlockDevice, cfg *InstallConfig, q *OpQueue) error {
+    d := FindDevice(devs, cfg.Disk.Target)
+    if d == nil && q != nil {
+        if l, p := findLayoutPart(devs, q, cfg.Disk.Target); p != nil {
+            if l.Disk.ReadOnly {
+                return fmt.Errorf("[checkTarget] %s is read-only", l.Disk.Path)
+            }
+            return nil
+        }
+    }
+    if d == nil {
+        return fmt.Errorf("[checkTarget] %s is not a block device", cfg.Disk.Target)
+    }
+    if d.ReadOnly {
+        return fmt.Errorf("[checkTarget] %s is read-only", d.Path)
+    }
+    if d.InUse() {
+        return fmt.Errorf("[checkTarget] %s or a device on it is mounted", d.Path)
+    }
+    return nil
+}
+
+func bytesToGB(n lsblkNum) float64 {
+    return float64(n) / math.Pow(2, 30)
+}
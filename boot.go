@@ -0,0 +1,402 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// bootDefaults are used for the bootloader settings an answers file leaves
+// out. main replaces Firmware with what DetectFirmware finds.
+var bootDefaults = BootloaderConfig{
+    Type:      "systemd-boot",
+    Firmware:  "uefi",
+    Kernel:    "linux",
+    Initramfs: "udev",
+}
+
+// bootloaders are the choices the Pending tab cycles through.
+var bootloaders = []string{"systemd-boot", "grub", "none"}
+
+// espMountpoints are where an EFI system partition may be mounted.
+var espMountpoints = []string{"/boot", "/efi", "/boot/efi"}
+
+// kernelName matches the package names of kernels, such as linux-lts.
+var kernelName = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+
+// espMinSize is the smallest EFI system partition accepted. Below it FAT32
+// cannot be used on disks with 4K sectors.
+const espMinSize = 300 * mib
+
+// DetectFirmware reports how the machine was booted: uefi when the kernel
+// exposes the EFI runtime under sysfsRoot, bios otherwise.
+func DetectFirmware(sysfsRoot string) string {
+    if fi, err := os.Stat(filepath.Join(sysfsRoot, "firmware", "efi")); err == nil && fi.IsDir() {
+        return "uefi"
+    }
+    return "bios"
+}
+
+// withDefaults fills in the empty settings of b. systemd-boot needs UEFI,
+// so GRUB is the default on BIOS machines.
+func (b BootloaderConfig) withDefaults() BootloaderConfig {
+    if b.Firmware == "" {
+        b.Firmware = bootDefaults.Firmware
+    }
+    if b.Type == "" {
+        b.Type = bootDefaults.Type
+        if b.Firmware == "bios" {
+            b.Type = "grub"
+        }
+    }
+    if b.Kernel == "" {
+        b.Kernel = bootDefaults.Kernel
+    }
+    if b.Initramfs == "" {
+        b.Initramfs = bootDefaults.Initramfs
+    }
+    return b
+}
+
+// validate checks b against the layout of cfg: the kernel has to be
+// readable by the bootloader and GRUB has to be able to unlock /boot.
+func (b BootloaderConfig) validate(cfg *InstallConfig) error {
+    if b.Firmware != "uefi" && b.Firmware != "bios" {
+        return fmt.Errorf("firmware must be uefi or bios, not %q", b.Firmware)
+    }
+    if b.Initramfs != "udev" && b.Initramfs != "systemd" {
+        return fmt.Errorf("initramfs must be udev or systemd, not %q", b.Initramfs)
+    }
+    if !kernelName.MatchString(b.Kernel) {
+        return fmt.Errorf("%q is not a kernel name", b.Kernel)
+    }
+    // The parameters end up in /etc/default/grub, which is shell.
+    if strings.ContainsAny(b.KernelParams, "\"'`$\\\n") {
+        return fmt.Errorf("kernel_params cannot contain quotes, backslashes, $ or newlines")
+    }
+    if b.Device != "" {
+        if err := checkDevicePath(b.Device); err != nil {
+            return fmt.Errorf("device: %w", err)
+        }
+    }
+    esp := espEntry(cfg)
+    switch b.Type {
+    case "none":
+    case "systemd-boot":
+        if b.Firmware != "uefi" {
+            return fmt.Errorf("systemd-boot needs UEFI firmware")
+        }
+        if esp == nil || esp.Mountpoint != "/boot" {
+            return fmt.Errorf("systemd-boot needs the EFI system partition mounted at /boot")
+        }
+    case "grub":
+        if b.Firmware == "uefi" && esp == nil {
+            return fmt.Errorf("grub needs an EFI system partition mounted at one of %s", strings.Join(espMountpoints, ", "))
+        }
+        if b.Firmware == "bios" && bootDisk(cfg, b) == "" {
+            return fmt.Errorf("device is required for grub on BIOS")
+        }
+        if e := cfg.Disk.Encryption.withDefaults(); bootEncrypted(cfg) && e.PBKDF != "pbkdf2" {
+            return fmt.Errorf("grub cannot unlock a /boot encrypted with %s, use pbkdf2 or a separate /boot", e.PBKDF)
+        }
+    default:
+        return fmt.Errorf("type must be one of %s, not %q", strings.Join(bootloaders, ", "), b.Type)
+    }
+    return nil
+}
+
+// espEntry returns the mount of the EFI system partition, or nil when cfg
+// mounts none.
+func espEntry(cfg *InstallConfig) *MountEntry {
+    for _, e := range mountEntries(cfg) {
+        if e.Filesystem != "vfat" {
+            continue
+        }
+        for _, mp := range espMountpoints {
+            if e.Mountpoint == mp {
+                return &e
+            }
+        }
+    }
+    return nil
+}
+
+// isESP reports whether d has the partition type of an EFI system
+// partition.
+func isESP(d *BlockDevice) bool {
+    esp := partTypeByName("EFI System")
+    return strings.EqualFold(d.PartType, esp.GUID) || strings.EqualFold(d.PartType, "0x"+esp.MBR)
+}
+
+// bootEncrypted reports whether /boot ends up inside the LUKS container,
+// which is the case unless something unencrypted is mounted there.
+func bootEncrypted(cfg *InstallConfig) bool {
+    dev := ""
+    for _, e := range plainMountEntries(cfg) {
+        if e.Mountpoint == "/boot" || e.Mountpoint == "/" && dev == "" {
+            dev = e.Device
+        }
+    }
+    return inLUKS(cfg.Disk, dev)
+}
+
+// checkFirmware checks the partitions the bootloader of cfg relies on, as
+// they will be once the edits in q are applied. UEFI needs a large enough
+// ESP and GRUB on a BIOS machine needs a BIOS boot partition on a GPT
+// disk. The returned warnings do not stop the install.
+func checkFirmware(devs []*BlockDevice, cfg *InstallConfig, q *OpQueue) ([]string, error) {
+    b := cfg.Bootloader.withDefaults()
+    if b.Type == "none" {
+        return nil, nil
+    }
+    var warnings []string
+    if b.Firmware == "uefi" {
+        esp := espEntry(cfg)
+        if esp == nil {
+            return nil, fmt.Errorf("UEFI needs an EFI system partition")
+        }
+        l, p := findLayoutPart(devs, q, esp.Device)
+        if p == nil {
+            return nil, fmt.Errorf("the EFI system partition %s is not a partition", esp.Device)
+        }
+        if p.Size < espMinSize {
+            return nil, fmt.Errorf("the EFI system partition %s is %s, at least %s are needed", esp.Device, humanSize(p.Size), humanSize(espMinSize))
+        }
+        if partTypeName(p.Type) != "EFI System" {
+            warnings = append(warnings, fmt.Sprintf("%s is not marked as an EFI system partition, the firmware may not find it", esp.Device))
+        }
+        if l.Table == "dos" {
+            warnings = append(warnings, fmt.Sprintf("%s has an MBR partition table, GPT is recommended on UEFI machines", l.Disk.Path))
+        }
+        return warnings, nil
+    }
+    if b.Type != "grub" {
+        return nil, nil
+    }
+    disk := FindDevice(devs, bootDisk(cfg, b))
+    if disk == nil {
+        return nil, fmt.Errorf("%s is not a disk", bootDisk(cfg, b))
+    }
+    l, err := layoutFor(disk, q.partOps())
+    if err != nil {
+        return nil, err
+    }
+    if l.Table == "gpt" {
+        for _, p := range l.Parts {
+            if partTypeName(p.Type) == "BIOS boot" {
+                return nil, nil
+            }
+        }
+        return nil, fmt.Errorf("%s has a GPT partition table and needs a BIOS boot partition for GRUB", disk.Path)
+    }
+    return nil, nil
+}
+
+// findLayoutPart finds the partition dev among the disks of devs as laid
+// out after the edits in q.
+func findLayoutPart(devs []*BlockDevice, q *OpQueue, dev string) (*diskLayout, *layoutPart) {
+    for _, d := range devs {
+        if d.Parent != nil {
+            continue
+        }
+        l, err := layoutFor(d, q.partOps())
+        if err != nil {
+            continue
+        }
+        for _, p := range l.Parts {
+            if p.Path == dev {
+                return l, p
+            }
+        }
+    }
+    return nil, nil
+}
+
+// bootDisk is the disk GRUB is installed to on BIOS machines.
+func bootDisk(cfg *InstallConfig, b BootloaderConfig) string {
+    if b.Device != "" {
+        return b.Device
+    }
+    if g := cfg.Disk.Guided; g != nil {
+        return g.Disk
+    }
+    dev := cfg.Disk.Target
+    if e := rootDevice(cfg); dev == "" && e != nil {
+        dev = e.Device
+    }
+    if d := findVolume(dev); d != nil {
+        return d.Disk().Path
+    }
+    return ""
+}
+
+// kernelParams builds the kernel command line: how the initramfs unlocks
+// the LUKS container holding /, where / is and the extra parameters of the
+// answers file. The systemd initramfs finds the container by UUID only, so
+// it fails when tags does not know it.
+func kernelParams(cfg *InstallConfig, tags tagFunc) (string, error) {
+    b := cfg.Bootloader.withDefaults()
+    d := cfg.Disk
+    var params []string
+    for _, v := range luksVolumes(cfg) {
+        if !v.Root {
+            continue
+        }
+        if b.Initramfs == "systemd" {
+            uuid := tags("UUID", v.Device)
+            if uuid == "" {
+                return "", fmt.Errorf("[kernelParams] blkid found no UUID on %s, the initramfs cannot unlock it", v.Device)
+            }
+            params = append(params, "rd.luks.name="+uuid+"="+v.Mapper)
+        } else {
+            params = append(params, "cryptdevice="+deviceSpec(tags, "UUID", v.Device)+":"+v.Mapper)
+        }
+    }
+    if root := rootDevice(cfg); root != nil {
+        // Mapper and LVM paths are stable, and the initramfs only creates
+        // them for the device it was asked to unlock or activate.
+        spec := root.Device
+        lv := d.LVM.Enabled && strings.HasPrefix(spec, "/dev/"+d.LVM.VolumeGroup+"/")
+        if !lv && !strings.HasPrefix(spec, "/dev/mapper/") {
+            spec = deviceSpec(tags, "UUID", spec)
+        }
+        params = append(params, "root="+spec, "rw")
+        if root.Filesystem == "btrfs" {
+            for _, sv := range btrfsLayout(d).Subvolumes {
+                if sv.Mountpoint == "/" {
+                    params = append(params, "rootflags=subvol="+sv.Name)
+                }
+            }
+        }
+    }
+    params = append(params, strings.Fields(b.KernelParams)...)
+    return strings.Join(params, " "), nil
+}
+
+// mkinitcpioHooks are the HOOKS of the initramfs for the layout of cfg: the
+// udev or systemd set, with the hooks that unlock the LUKS container and
+// activate the volume group holding / before it is mounted.
+func mkinitcpioHooks(cfg *InstallConfig) string {
+    b := cfg.Bootloader.withDefaults()
+    hooks := []string{"base", "udev", "autodetect", "microcode", "modconf", "kms", "keyboard", "keymap", "consolefont", "block"}
+    encrypt := "encrypt"
+    if b.Initramfs == "systemd" {
+        hooks = []string{"base", "systemd", "autodetect", "microcode", "modconf", "kms", "keyboard", "sd-vconsole", "block"}
+        encrypt = "sd-encrypt"
+    }
+    for _, v := range luksVolumes(cfg) {
+        if v.Root {
+            hooks = append(hooks, encrypt)
+        }
+    }
+    if root := rootDevice(cfg); root != nil && cfg.Disk.LVM.Enabled && strings.HasPrefix(root.Device, "/dev/"+cfg.Disk.LVM.VolumeGroup+"/") {
+        hooks = append(hooks, "lvm2")
+    }
+    hooks = append(hooks, "filesystems", "fsck")
+    return "\n# Added by the phyOS installer\nHOOKS=(" + strings.Join(hooks, " ") + ")\n"
+}
+
+// initramfsOps sets the HOOKS of mkinitcpio in the target mounted at root
+// and rebuilds the initramfs of every installed kernel with them. The file
+// is sourced, so the appended HOOKS win.
+func initramfsOps(cfg *InstallConfig, root string) []Operation {
+    return []Operation{
+        newCmdOp("mkdirTarget", path.Join(root, "etc")),
+        newAppendOp(path.Join(root, "etc", "mkinitcpio.conf"), func(Runner) string { return mkinitcpioHooks(cfg) }),
+        newCmdOp("mkinitcpio", root),
+    }
+}
+
+// loaderEntry is the systemd-boot entry for the installed kernel. Its paths
+// are relative to the ESP, which holds /boot.
+func loaderEntry(b BootloaderConfig, params string) string {
+    return fmt.Sprintf("title   phyOS\nlinux   /vmlinuz-%s\ninitrd  /initramfs-%s.img\noptions %s\n", b.Kernel, b.Kernel, params)
+}
+
+// grubDefaults is appended to /etc/default/grub. The file is sourced, so
+// the later assignments win.
+func grubDefaults(cfg *InstallConfig, params string) string {
+    s := "\n# Added by the phyOS installer\nGRUB_CMDLINE_LINUX=\"" + params + "\"\n"
+    if bootEncrypted(cfg) {
+        s += "GRUB_ENABLE_CRYPTODISK=y\n"
+    }
+    return s
+}
+
+// efiFallbackOps copies loader, relative to the ESP mounted at esp, to
+// \EFI\BOOT\BOOTX64.EFI, which firmware boots when its NVRAM entries are
+// lost.
+func efiFallbackOps(esp, loader string) []Operation {
+    dir := path.Join(esp, "EFI", "BOOT")
+    return []Operation{
+        newCmdOp("mkdirTarget", dir),
+        newCmdOp("copyFile", path.Join(esp, loader), path.Join(dir, "BOOTX64.EFI")),
+    }
+}
+
+// bootOps installs and configures the bootloader of cfg in the target
+// mounted at root. The kernel command line is built when the operations
+// run, once the UUIDs exist; a dry run shows where they go.
+func bootOps(cfg *InstallConfig, root string) []Operation {
+    b := cfg.Bootloader.withDefaults()
+    params := func(r Runner) (string, error) {
+        tags := blkidTags(r)
+        if _, ok := r.(planRecorder); ok {
+            tags = planTags(tags)
+        }
+        return kernelParams(cfg, tags)
+    }
+    switch b.Type {
+    case "systemd-boot":
+        esp := path.Join(root, "boot")
+        ops := []Operation{
+            newCmdOp("bootctlInstall", root),
+            newCmdOp("mkdirTarget", path.Join(esp, "loader", "entries")),
+            newFileOp(path.Join(esp, "loader", "loader.conf"), func(Runner) string { return "default phyos.conf\ntimeout 3\neditor no\n" }),
+            fileOp{"writeFile", path.Join(esp, "loader", "entries", "phyos.conf"), func(r Runner) (string, error) {
+                p, err := params(r)
+                return loaderEntry(b, p), err
+            }},
+        }
+        return append(ops, efiFallbackOps(esp, "EFI/systemd/systemd-bootx64.efi")...)
+    case "grub":
+        ops := []Operation{
+            newCmdOp("mkdirTarget", path.Join(root, "etc", "default")),
+            fileOp{"appendFile", path.Join(root, "etc", "default", "grub"), func(r Runner) (string, error) {
+                p, err := params(r)
+                return grubDefaults(cfg, p), err
+            }},
+        }
+        if b.Firmware == "bios" {
+            ops = append(ops, newCmdOp("grubInstallBios", root, bootDisk(cfg, b)))
+        } else {
+            esp := espEntry(cfg).Mountpoint
+            ops = append(ops, newCmdOp("grubInstallEfi", root, esp))
+            ops = append(ops, efiFallbackOps(path.Join(root, esp), "EFI/phyOS/grubx64.efi")...)
+        }
+        return append(ops, newCmdOp("grubMkconfig", root))
+    }
+    return nil
+}
+
+// bootSummary describes the bootloader choice for the Pending tab.
+func bootSummary(b BootloaderConfig) string {
+    b = b.withDefaults()
+    if b.Type == "none" {
+        return "none"
+    }
+    return fmt.Sprintf("%s (%s)", b.Type, strings.ToUpper(b.Firmware))
+}
+
+// nextBootloader is the bootloader after name in bootloaders.
+func nextBootloader(name string) string {
+    for i, b := range bootloaders {
+        if b == name {
+            return bootloaders[(i+1)%len(bootloaders)]
+        }
+    }
+    return bootloaders[0]
+}
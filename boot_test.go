@@ -0,0 +1,105 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// writeTarget creates the file at name under root, with its directories.
+func writeTarget(t *testing.T, root, name, content string) {
+    t.Helper()
+    file := filepath.Join(root, name)
+    if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestBootOpsSystemdBoot(t *testing.T) {
+    blockDevices = nil
+    root := testRoot(t)
+    // bootctl install, which is skipped, would have put the loader here.
+    writeTarget(t, root, "boot/EFI/systemd/systemd-bootx64.efi", "systemd-boot")
+    cfg := testConfig()
+    cfg.Bootloader = BootloaderConfig{Type: "systemd-boot", Firmware: "uefi", Kernel: "linux-lts", KernelParams: "quiet"}
+    applyInRoot(t, bootOps(cfg, root))
+
+    for name, want := range map[string]string{
+        "boot/loader/loader.conf":        "default phyos.conf\ntimeout 3\neditor no\n",
+        "boot/loader/entries/phyos.conf": "title   phyOS\nlinux   /vmlinuz-linux-lts\ninitrd  /initramfs-linux-lts.img\noptions cryptdevice=/dev/phyos-test2:phyos root=/dev/phyos/root rw quiet\n",
+        "boot/EFI/BOOT/BOOTX64.EFI":      "systemd-boot",
+    } {
+        if got := readTarget(t, root, name); got != want {
+            t.Errorf("%s is %q, want %q", name, got, want)
+        }
+    }
+}
+
+func TestBootOpsGrub(t *testing.T) {
+    blockDevices = nil
+    root := testRoot(t)
+    writeTarget(t, root, "etc/default/grub", "GRUB_TIMEOUT=5\n")
+    writeTarget(t, root, "boot/EFI/phyOS/grubx64.efi", "grub")
+    cfg := testConfig()
+    cfg.Bootloader = BootloaderConfig{Type: "grub", Firmware: "uefi"}
+    applyInRoot(t, bootOps(cfg, root))
+
+    want := "GRUB_TIMEOUT=5\n\n# Added by the phyOS installer\n" +
+        "GRUB_CMDLINE_LINUX=\"cryptdevice=/dev/phyos-test2:phyos root=/dev/phyos/root rw\"\n"
+    if got := readTarget(t, root, "etc/default/grub"); got != want {
+        t.Errorf("/etc/default/grub is\n%s\nwant\n%s", got, want)
+    }
+    if got := readTarget(t, root, "boot/EFI/BOOT/BOOTX64.EFI"); got != "grub" {
+        t.Errorf("fallback loader is %q, want the copy of grubx64.efi", got)
+    }
+}
+
+func TestKernelParamsSystemdNeedsUUID(t *testing.T) {
+    blockDevices = nil
+    cfg := testConfig()
+    cfg.Bootloader = BootloaderConfig{Type: "grub", Firmware: "uefi", Initramfs: "systemd"}
+    uuid := func(tag, dev string) string {
+        if tag == "UUID" && dev == "/dev/phyos-test2" {
+            return "0b2f3c4d-5e6f-4a1b-8c9d-0e1f2a3b4c5d"
+        }
+        return ""
+    }
+    got, err := kernelParams(cfg, uuid)
+    if want := "rd.luks.name=0b2f3c4d-5e6f-4a1b-8c9d-0e1f2a3b4c5d=phyos root=/dev/phyos/root rw"; err != nil || got != want {
+        t.Errorf("kernel parameters are %q, %v, want %q", got, err, want)
+    }
+    if got, err := kernelParams(cfg, func(string, string) string { return "" }); err == nil {
+        t.Errorf("kernel parameters %q without the UUID of the LUKS container", got)
+    }
+}
+
+func TestInitramfsOps(t *testing.T) {
+    blockDevices = nil
+    for _, c := range []struct {
+        initramfs string
+        encrypt   bool
+        lvm       bool
+        hooks     string
+    }{
+        {"udev", true, true, "base udev autodetect microcode modconf kms keyboard keymap consolefont block encrypt lvm2 filesystems fsck"},
+        {"systemd", true, true, "base systemd autodetect microcode modconf kms keyboard sd-vconsole block sd-encrypt lvm2 filesystems fsck"},
+        {"systemd", false, true, "base systemd autodetect microcode modconf kms keyboard sd-vconsole block lvm2 filesystems fsck"},
+        {"udev", true, false, "base udev autodetect microcode modconf kms keyboard keymap consolefont block encrypt filesystems fsck"},
+    } {
+        root := testRoot(t)
+        writeTarget(t, root, "etc/mkinitcpio.conf", "MODULES=()\n")
+        cfg := testConfig()
+        cfg.Bootloader.Initramfs = c.initramfs
+        cfg.Disk.Encryption.Enabled = c.encrypt
+        cfg.Disk.LVM.Enabled = c.lvm
+        applyInRoot(t, initramfsOps(cfg, root))
+
+        want := "MODULES=()\n\n# Added by the phyOS installer\nHOOKS=(" + c.hooks + ")\n"
+        if got := readTarget(t, root, "etc/mkinitcpio.conf"); got != want {
+            t.Errorf("mkinitcpio.conf is\n%s\nwant\n%s", got, want)
+        }
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "strconv"
+    "strings"
+)
+
+// BtrfsConfig describes how a btrfs root filesystem is laid out and
+// mounted. Compress is empty for no compression or an algorithm such as
+// "zstd:3"; it and NoAtime apply to every btrfs mount.
+type BtrfsConfig struct {
+    Subvolumes []SubvolumeConfig `json:"subvolumes,omitempty" yaml:"subvolumes,omitempty"`
+    Compress   string            `json:"compress,omitempty" yaml:"compress,omitempty"`
+    NoAtime    bool              `json:"noatime,omitempty" yaml:"noatime,omitempty"`
+}
+
+// SubvolumeConfig is a subvolume of the btrfs root. Subvolumes without a
+// Mountpoint are created but not mounted.
+type SubvolumeConfig struct {
+    Name       string `json:"name" yaml:"name"`
+    Mountpoint string `json:"mountpoint,omitempty" yaml:"mountpoint,omitempty"`
+}
+
+// defaultBtrfs is the layout used when the root filesystem is btrfs and the
+// answers file says nothing else. The names follow the convention snapper
+// and timeshift expect.
+func defaultBtrfs() *BtrfsConfig {
+    return &BtrfsConfig{
+        Subvolumes: []SubvolumeConfig{
+            {"@", "/"},
+            {"@home", "/home"},
+            {"@log", "/var/log"},
+            {"@cache", "/var/cache"},
+            {"@snapshots", "/.snapshots"},
+        },
+        Compress: "zstd:3",
+        NoAtime:  true,
+    }
+}
+
+// btrfsCompressions are the choices the subvolume editor cycles through.
+var btrfsCompressions = []string{"", "zstd:1", "zstd:3", "zstd:9", "lzo"}
+
+// options returns the mount options of a btrfs mount of subvolume subvol,
+// which may be empty for the top of the filesystem.
+func (b *BtrfsConfig) options(subvol string) string {
+    var opts []string
+    if b.NoAtime {
+        opts = append(opts, "noatime")
+    }
+    if b.Compress != "" {
+        opts = append(opts, "compress="+b.Compress)
+    }
+    if subvol != "" {
+        opts = append(opts, "subvol="+subvol)
+    }
+    return strings.Join(opts, ",")
+}
+
+func (b *BtrfsConfig) validate() error {
+    seen := make(map[string]bool)
+    for i, sv := range b.Subvolumes {
+        if sv.Name == "" || strings.ContainsAny(sv.Name, " ,\t\n") || path.IsAbs(sv.Name) || path.Clean(sv.Name) != sv.Name {
+            return fmt.Errorf("disk.btrfs.subvolumes[%d]: %q is not a valid subvolume name", i, sv.Name)
+        }
+        if seen[sv.Name] {
+            return fmt.Errorf("disk.btrfs.subvolumes[%d]: %s is listed twice", i, sv.Name)
+        }
+        seen[sv.Name] = true
+    }
+    if b.Compress == "" {
+        return nil
+    }
+    algo, level, hasLevel := strings.Cut(b.Compress, ":")
+    max := map[string]int{"zstd": 15, "zlib": 9, "lzo": 0}
+    top, ok := max[algo]
+    if !ok {
+        return fmt.Errorf("disk.btrfs.compress: unknown algorithm %q, expected zstd, zlib or lzo", algo)
+    }
+    if hasLevel {
+        n, err := strconv.Atoi(level)
+        if err != nil || n < 1 || n > top {
+            return fmt.Errorf("disk.btrfs.compress: %q is not a valid level for %s", level, algo)
+        }
+    }
+    return nil
+}
+
+// btrfsLayout returns the btrfs settings of d, falling back to the defaults.
+func btrfsLayout(d DiskConfig) *BtrfsConfig {
+    if d.Btrfs != nil {
+        return d.Btrfs
+    }
+    return defaultBtrfs()
+}
+
+// expandBtrfs replaces the root entry of a btrfs root filesystem with one
+// entry per subvolume and adds the btrfs mount options to every btrfs
+// entry.
+func expandBtrfs(d DiskConfig, entries []MountEntry) []MountEntry {
+    b := btrfsLayout(d)
+    var out []MountEntry
+    for _, e := range entries {
+        if e.Filesystem != "btrfs" {
+            out = append(out, e)
+            continue
+        }
+        if e.Mountpoint != "/" || len(b.Subvolumes) == 0 {
+            e.Options = b.options("")
+            out = append(out, e)
+            continue
+        }
+        for _, sv := range b.Subvolumes {
+            if sv.Mountpoint != "" {
+                out = append(out, MountEntry{e.Device, sv.Mountpoint, "btrfs", b.options(sv.Name)})
+            }
+        }
+    }
+    return out
+}
+
+// btrfsSubvolumeOps creates the subvolumes on the freshly formatted btrfs
+// root. They are created with the top of the filesystem mounted at root,
+// which is unmounted again before the real mounts happen.
+func btrfsSubvolumeOps(cfg *InstallConfig, root string) []Operation {
+    b := btrfsLayout(cfg.Disk)
+    dev := rootDevice(cfg)
+    if dev == nil || dev.Filesystem != "btrfs" || len(b.Subvolumes) == 0 {
+        return nil
+    }
+    for _, p := range cfg.Disk.Partitions {
+        if p.Device == dev.Device && !p.Format {
+            // Kept filesystems already have their subvolumes.
+            return nil
+        }
+    }
+    ops := []Operation{newCmdOp("mkdirTarget", root), newCmdOp("mountDev", dev.Device, root)}
+    for _, sv := range b.Subvolumes {
+        ops = append(ops, newCmdOp("btrfsSubvolCreate", path.Join(root, sv.Name)))
+    }
+    return append(ops, newCmdOp("umountDev", root))
+}
+
+// rootDevice returns the entry mounted at / before any subvolumes are laid
+// out, or nil when there is none.
+func rootDevice(cfg *InstallConfig) *MountEntry {
+    for _, e := range plainMountEntries(cfg) {
+        if e.Mountpoint == "/" {
+            return &e
+        }
+    }
+    return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+// btrfsConfig is testConfig with a btrfs root laid out in subvolumes, one
+// of them not mounted, and a btrfs data partition next to it.
+func btrfsConfig() *InstallConfig {
+    cfg := testConfig()
+    cfg.Disk.Filesystem = "btrfs"
+    cfg.Disk.Btrfs = &BtrfsConfig{
+        Subvolumes: []SubvolumeConfig{{"@", "/"}, {"@home", "/home"}, {"@swap", ""}},
+        Compress:   "zstd:1",
+        NoAtime:    true,
+    }
+    cfg.Disk.Partitions = append(cfg.Disk.Partitions, PartitionConfig{Device: "/dev/phyos-test4", Filesystem: "btrfs", Format: true, Mountpoint: "/srv"})
+    return cfg
+}
+
+func TestExpandBtrfs(t *testing.T) {
+    blockDevices = nil
+    want := []MountEntry{
+        {"/dev/phyos/root", "/", "btrfs", "noatime,compress=zstd:1,subvol=@"},
+        {"/dev/phyos/root", "/home", "btrfs", "noatime,compress=zstd:1,subvol=@home"},
+        {"/dev/phyos-test1", "/boot", "vfat", "umask=0077"},
+        {"/dev/phyos-test4", "/srv", "btrfs", "noatime,compress=zstd:1"},
+    }
+    if got := mountEntries(btrfsConfig()); !reflect.DeepEqual(got, want) {
+        t.Errorf("mounts are\n%+v\nwant\n%+v", got, want)
+    }
+}
+
+func TestFstabBtrfsSubvolumes(t *testing.T) {
+    blockDevices = nil
+    want := "# /etc/fstab, generated by the phyOS installer\n\n" +
+        "# <file system>        <mount point>  <type>  <options>                             <dump>  <pass>\n" +
+        "/dev/phyos/root        /              btrfs   noatime,compress=zstd:1,subvol=@      0       0\n" +
+        "/dev/phyos/root        /home          btrfs   noatime,compress=zstd:1,subvol=@home  0       0\n" +
+        "/dev/phyos-test1       /boot          vfat    umask=0077                            0       2\n" +
+        "/dev/phyos-test4       /srv           btrfs   noatime,compress=zstd:1               0       0\n" +
+        "/dev/mapper/cryptswap  none           swap    defaults                              0       0\n"
+    if got := fstabText(btrfsConfig(), func(string, string) string { return "" }); got != want {
+        t.Errorf("fstab is\n%s\nwant\n%s", got, want)
+    }
+}
+
+func TestBtrfsSubvolumeOps(t *testing.T) {
+    makeCmdMap()
+    blockDevices = nil
+    var got []string
+    for _, op := range btrfsSubvolumeOps(btrfsConfig(), "/mnt") {
+        got = append(got, op.Describe())
+    }
+    // Unmounted subvolumes are created too.
+    want := []string{
+        "mkdir -p /mnt",
+        "mount /dev/phyos/root /mnt",
+        "btrfs subvolume create /mnt/@",
+        "btrfs subvolume create /mnt/@home",
+        "btrfs subvolume create /mnt/@swap",
+        "umount /mnt",
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("ops are %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "strings"
+
+    "github.com/charmbracelet/bubbles/textinput"
+    tea "github.com/charmbracelet/bubbletea"
+)
+
+// btrfsEditor edits the subvolume layout and mount options of a btrfs root
+// in place in the configuration. Nothing is queued: the layout only takes
+// effect through the installation steps.
+type btrfsEditor struct {
+    cfg    *InstallConfig
+    cursor int
+    form   *subvolumeForm
+    err    error
+    closed bool
+}
+
+// subvolumeForm edits the subvolume at index, or adds one when index is -1.
+type subvolumeForm struct {
+    index      int
+    name       textinput.Model
+    mountpoint textinput.Model
+    field      int
+}
+
+func newBtrfsEditor(cfg *InstallConfig) *btrfsEditor {
+    if cfg.Disk.Btrfs == nil {
+        cfg.Disk.Btrfs = defaultBtrfs()
+    }
+    return &btrfsEditor{cfg: cfg}
+}
+
+func (e *btrfsEditor) layout() *BtrfsConfig {
+    return e.cfg.Disk.Btrfs
+}
+
+func (e *btrfsEditor) openForm(index int) tea.Cmd {
+    f := &subvolumeForm{index: index, name: textinput.New(), mountpoint: textinput.New()}
+    for _, in := range []*textinput.Model{&f.name, &f.mountpoint} {
+        in.Prompt = ""
+        in.Width = 36
+        in.CharLimit = 255
+    }
+    if index >= 0 {
+        sv := e.layout().Subvolumes[index]
+        f.name.SetValue(sv.Name)
+        f.mountpoint.SetValue(sv.Mountpoint)
+    }
+    e.form = f
+    e.err = nil
+    return f.name.Focus()
+}
+
+func (e *btrfsEditor) update(msg tea.Msg) tea.Cmd {
+    key, ok := msg.(tea.KeyMsg)
+    if !ok {
+        return nil
+    }
+    if e.form != nil {
+        return e.updateForm(key)
+    }
+    b := e.layout()
+    switch key.String() {
+    case "esc":
+        e.closed = true
+    case "up", "ctrl+k":
+        if e.cursor > 0 {
+            e.cursor--
+        }
+    case "down", "ctrl+j":
+        if e.cursor < len(b.Subvolumes)-1 {
+            e.cursor++
+        }
+    case "n":
+        return e.openForm(-1)
+    case "enter", "e":
+        if e.cursor < len(b.Subvolumes) {
+            return e.openForm(e.cursor)
+        }
+    case "d":
+        if e.cursor < len(b.Subvolumes) {
+            b.Subvolumes = append(b.Subvolumes[:e.cursor:e.cursor], b.Subvolumes[e.cursor+1:]...)
+            if e.cursor > 0 && e.cursor >= len(b.Subvolumes) {
+                e.cursor--
+            }
+        }
+    case "c":
+        next := 0
+        for i, c := range btrfsCompressions {
+            if c == b.Compress {
+                next = (i + 1) % len(btrfsCompressions)
+            }
+        }
+        b.Compress = btrfsCompressions[next]
+    case "a":
+        b.NoAtime = !b.NoAtime
+    case "t":
+        e.cfg.Disk.Filesystem = nextFilesystem(e.cfg.Disk.Filesystem, true)
+    }
+    return nil
+}
+
+func (e *btrfsEditor) updateForm(key tea.KeyMsg) tea.Cmd {
+    f := e.form
+    switch key.String() {
+    case "esc":
+        e.form, e.err = nil, nil
+        return nil
+    case "tab", "shift+tab", "up", "down", "ctrl+k", "ctrl+j":
+        f.field = 1 - f.field
+        f.name.Blur()
+        f.mountpoint.Blur()
+        if f.field == 0 {
+            return f.name.Focus()
+        }
+        return f.mountpoint.Focus()
+    case "enter":
+        e.submit()
+        return nil
+    }
+    var cmd tea.Cmd
+    if f.field == 0 {
+        f.name, cmd = f.name.Update(key)
+    } else {
+        f.mountpoint, cmd = f.mountpoint.Update(key)
+    }
+    return cmd
+}
+
+func (e *btrfsEditor) submit() {
+    f := e.form
+    sv := SubvolumeConfig{Name: strings.TrimSpace(f.name.Value()), Mountpoint: strings.TrimSpace(f.mountpoint.Value())}
+    if sv.Mountpoint != "" && (!path.IsAbs(sv.Mountpoint) || path.Clean(sv.Mountpoint) != sv.Mountpoint) {
+        e.err = fmt.Errorf("Mount point %q must be a clean absolute path", sv.Mountpoint)
+        return
+    }
+    next := *e.layout()
+    next.Subvolumes = append([]SubvolumeConfig(nil), next.Subvolumes...)
+    if f.index < 0 {
+        next.Subvolumes = append(next.Subvolumes, sv)
+    } else {
+        next.Subvolumes[f.index] = sv
+    }
+    if err := next.validate(); err != nil {
+        e.err = err
+        return
+    }
+    *e.layout() = next
+    e.form, e.err = nil, nil
+}
+
+func (e *btrfsEditor) View() string {
+    b := e.layout()
+    var s strings.Builder
+    s.WriteString("\n" + inputStyle.Render("Btrfs subvolumes") + "\n\n")
+    if e.form != nil {
+        marker := func(field int) string {
+            if e.form.field == field {
+                return "> "
+            }
+            return "  "
+        }
+        fmt.Fprintf(&s, "%sName:\n   %s\n\n", marker(0), e.form.name.View())
+        fmt.Fprintf(&s, "%sMount point (empty to leave it unmounted):\n   %s\n\n", marker(1), e.form.mountpoint.View())
+        s.WriteString(continueStyle.Render("enter: save  tab: next field  esc: cancel") + "\n")
+    } else {
+        fmt.Fprintf(&s, "  %-20s %s\n", "Subvolume", "Mount point")
+        for i, sv := range b.Subvolumes {
+            line := fmt.Sprintf("%-20s %s", sv.Name, sv.Mountpoint)
+            if i == e.cursor {
+                s.WriteString(editorCursorStyle.Render("> "+line) + "\n")
+            } else {
+                s.WriteString("  " + line + "\n")
+            }
+        }
+        compress := b.Compress
+        if compress == "" {
+            compress = "none"
+        }
+        fs := e.cfg.Disk.Filesystem
+        if fs == "" {
+            fs = "ext4"
+        }
+        fmt.Fprintf(&s, "\n  Root filesystem: %s\n  Compression: %s\n  noatime: %t\n", fs, compress, b.NoAtime)
+        if fs != "btrfs" {
+            s.WriteString("  " + continueStyle.Render("The layout is only used when the root filesystem is btrfs.") + "\n")
+        }
+        s.WriteString("\n" + continueStyle.Render("n: new  enter/e: edit  d: delete  c: compression  a: noatime  t: root filesystem  esc: back") + "\n")
+    }
+    if e.err != nil {
+        s.WriteString("\n" + inputStyle.Render(e.err.Error()) + "\n")
+    }
+    return s.String()
+}
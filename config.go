@@ -0,0 +1,323 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+
+    "gopkg.in/yaml.v3"
+)
+
+// InstallConfig describes a whole installation. It is what an answers file
+// decodes into and what the TUI fills in before Install runs.
+type InstallConfig struct {
+    Hostname string       `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+    Timezone string       `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+    Keymap   string       `json:"keymap,omitempty" yaml:"keymap,omitempty"`
+    Locale   string       `json:"locale,omitempty" yaml:"locale,omitempty"`
+    // ExtraLocales are generated next to Locale without being the default.
+    ExtraLocales []string `json:"extra_locales,omitempty" yaml:"extra_locales,omitempty"`
+    // HardwareClock is utc, the default, or local for machines that share
+    // the clock with Windows.
+    HardwareClock string `json:"hardware_clock,omitempty" yaml:"hardware_clock,omitempty"`
+    Users    []UserConfig `json:"users,omitempty" yaml:"users,omitempty"`
+    Disk     DiskConfig   `json:"disk" yaml:"disk"`
+
+    // Bootloader makes the installed system bootable.
+    Bootloader BootloaderConfig `json:"bootloader" yaml:"bootloader,omitempty"`
+
+    // MountRoot is where the target system is mounted while installing.
+    MountRoot string `json:"mount_root,omitempty" yaml:"mount_root,omitempty"`
+}
+
+// UserConfig is an account to create. The password is given either in the
+// clear or, as in saved answers files, as the crypt(3) hash of PasswordHash.
+type UserConfig struct {
+    Name         string   `json:"name" yaml:"name"`
+    Password     Secret   `json:"password,omitempty" yaml:"password,omitempty"`
+    PasswordHash string   `json:"password_hash,omitempty" yaml:"password_hash,omitempty"`
+    Groups       []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+    Sudo         bool     `json:"sudo,omitempty" yaml:"sudo,omitempty"`
+}
+
+// BootloaderConfig picks the bootloader and the kernel command line. Empty
+// fields get the defaults of withDefaults.
+type BootloaderConfig struct {
+    // Type is systemd-boot, grub or none.
+    Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+    Firmware string `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+    // Device is the disk GRUB is installed to on BIOS machines. Left out,
+    // it is the disk holding the target.
+    Device string `json:"device,omitempty" yaml:"device,omitempty"`
+    // Kernel names the kernel whose vmlinuz and initramfs are booted.
+    Kernel string `json:"kernel,omitempty" yaml:"kernel,omitempty"`
+    // Initramfs is udev for the busybox-based mkinitcpio hooks, which
+    // unlock LUKS from cryptdevice=, or systemd, which reads rd.luks.name=.
+    Initramfs    string `json:"initramfs,omitempty" yaml:"initramfs,omitempty"`
+    KernelParams string `json:"kernel_params,omitempty" yaml:"kernel_params,omitempty"`
+}
+
+// DiskConfig describes the storage stack built on Target: an optional LUKS
+// container, an optional LVM volume group inside it and the filesystems on
+// top. Without LVM the filesystem on Target is mounted at /. Partitions lists
+// further partitions to format and mount; Target can be left empty when one
+// of them is mounted at /.
+type DiskConfig struct {
+    Target     string            `json:"target" yaml:"target"`
+    Filesystem string            `json:"filesystem,omitempty" yaml:"filesystem,omitempty"`
+    Encryption EncryptionConfig  `json:"encryption" yaml:"encryption,omitempty"`
+    LVM        LVMConfig         `json:"lvm" yaml:"lvm,omitempty"`
+    Partitions []PartitionConfig `json:"partitions,omitempty" yaml:"partitions,omitempty"`
+
+    // Btrfs lays out the root filesystem when it is btrfs. Left out, the
+    // layout of defaultBtrfs is used.
+    Btrfs *BtrfsConfig `json:"btrfs,omitempty" yaml:"btrfs,omitempty"`
+
+    // Guided, when set, replaces the fields above with an automatic layout
+    // of a whole disk once the disks have been discovered.
+    Guided *GuidedConfig `json:"guided,omitempty" yaml:"guided,omitempty"`
+}
+
+// EncryptionConfig puts Target in a LUKS container opened as
+// /dev/mapper/<Mapper>. Empty fields take the defaults of luksDefaults.
+type EncryptionConfig struct {
+    Enabled    bool   `json:"enabled" yaml:"enabled"`
+    Passphrase Secret `json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+    Mapper     string `json:"mapper,omitempty" yaml:"mapper,omitempty"`
+
+    // Type is luks1 or luks2. GRUB can only unlock luks1 with pbkdf2.
+    Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+    Cipher   string `json:"cipher,omitempty" yaml:"cipher,omitempty"`
+    KeySize  int    `json:"key_size,omitempty" yaml:"key_size,omitempty"`
+    PBKDF    string `json:"pbkdf,omitempty" yaml:"pbkdf,omitempty"`
+    IterTime int    `json:"iter_time_ms,omitempty" yaml:"iter_time_ms,omitempty"`
+}
+
+type LVMConfig struct {
+    Enabled     bool                  `json:"enabled" yaml:"enabled"`
+    VolumeGroup string                `json:"volume_group,omitempty" yaml:"volume_group,omitempty"`
+    Volumes     []LogicalVolumeConfig `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+
+    // Snapshot, when set, snapshots the root LV once everything else has
+    // been installed, as a rollback point.
+    Snapshot *SnapshotConfig `json:"snapshot,omitempty" yaml:"snapshot,omitempty"`
+}
+
+// LogicalVolumeConfig is one LV; a Size of "rest" takes all remaining space.
+// ThinPool makes the LV a thin pool, which holds thin volumes and is never
+// formatted or mounted. Pool puts the LV in the named thin pool, in which
+// case Size is its virtual size and may exceed the pool. Label and UUID are
+// set on the filesystem when it is created.
+type LogicalVolumeConfig struct {
+    Name       string `json:"name" yaml:"name"`
+    Size       string `json:"size" yaml:"size"`
+    Filesystem string `json:"filesystem,omitempty" yaml:"filesystem,omitempty"`
+    Mountpoint string `json:"mountpoint,omitempty" yaml:"mountpoint,omitempty"`
+    Label      string `json:"label,omitempty" yaml:"label,omitempty"`
+    UUID       string `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+    ThinPool   bool   `json:"thin_pool,omitempty" yaml:"thin_pool,omitempty"`
+    Pool       string `json:"pool,omitempty" yaml:"pool,omitempty"`
+}
+
+// SnapshotConfig names the snapshot of the root LV. Size is only needed
+// when root is not a thin volume: it is how much may change before the
+// snapshot becomes invalid.
+type SnapshotConfig struct {
+    Name string `json:"name" yaml:"name"`
+    Size string `json:"size,omitempty" yaml:"size,omitempty"`
+}
+
+// PartitionConfig is an existing or planned partition. Format false keeps
+// the data already on it. A Mountpoint of "swap" enables it as swap space.
+// Label and UUID are the filesystem label and UUID set when formatting; a
+// vfat UUID is its volume ID, like "1A2B-3C4D". Encrypt, for swap,
+// leaves the partition to the installed system, which sets it up with a new
+// random key on every boot.
+type PartitionConfig struct {
+    Device     string `json:"device" yaml:"device"`
+    Filesystem string `json:"filesystem,omitempty" yaml:"filesystem,omitempty"`
+    Format     bool   `json:"format,omitempty" yaml:"format,omitempty"`
+    Mountpoint string `json:"mountpoint,omitempty" yaml:"mountpoint,omitempty"`
+    Label      string `json:"label,omitempty" yaml:"label,omitempty"`
+    UUID       string `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+    Encrypt    bool   `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+}
+
+// defaultConfig is the phyOS layout: LVM on LUKS with a single root LV.
+func defaultConfig() *InstallConfig {
+    return &InstallConfig{
+        Disk: DiskConfig{
+            Filesystem: "ext4",
+            Encryption: EncryptionConfig{Enabled: true, Mapper: phyosName},
+            LVM: LVMConfig{
+                Enabled:     true,
+                VolumeGroup: phyosName,
+                Volumes:     []LogicalVolumeConfig{{Name: "root", Size: "rest", Mountpoint: "/"}},
+            },
+        },
+        MountRoot: defaultMountRoot,
+    }
+}
+
+// LoadConfig reads an answers file on top of defaultConfig. Files ending in
+// .yaml or .yml are decoded as YAML, everything else as JSON.
+func LoadConfig(path string) (*InstallConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("[LoadConfig] %w", err)
+    }
+    cfg := defaultConfig()
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        err = dec.Decode(cfg)
+    default:
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        err = dec.Decode(cfg)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("[LoadConfig] %s: %w", path, err)
+    }
+    return cfg, nil
+}
+
+// Validate reports the first problem that would stop Install from running.
+func (c *InstallConfig) Validate() error {
+    d := c.Disk
+    if d.Target == "" && len(d.Partitions) == 0 {
+        return fmt.Errorf("disk.target or disk.partitions is required")
+    }
+    if d.Target != "" {
+        if err := checkDevicePath(d.Target); err != nil {
+            return fmt.Errorf("disk.target: %w", err)
+        }
+    }
+    if c.MountRoot != "" && (!path.IsAbs(c.MountRoot) || path.Clean(c.MountRoot) != c.MountRoot) {
+        return fmt.Errorf("mount_root: %q must be a clean absolute path", c.MountRoot)
+    }
+    if d.Encryption.Enabled {
+        if d.Encryption.Passphrase == "" {
+            return fmt.Errorf("disk.encryption.passphrase is required when encryption is enabled")
+        }
+        if d.Encryption.Mapper == "" {
+            return fmt.Errorf("disk.encryption.mapper is required when encryption is enabled")
+        }
+        if err := checkLVMName(d.Encryption.Mapper); err != nil {
+            return fmt.Errorf("disk.encryption.mapper: %w", err)
+        }
+        if err := d.Encryption.withDefaults().validate(); err != nil {
+            return fmt.Errorf("disk.encryption: %w", err)
+        }
+    }
+    if d.LVM.Enabled {
+        if d.LVM.VolumeGroup == "" {
+            return fmt.Errorf("disk.lvm.volume_group is required when LVM is enabled")
+        }
+        if err := checkLVMName(d.LVM.VolumeGroup); err != nil {
+            return fmt.Errorf("disk.lvm.volume_group: %w", err)
+        }
+        if len(d.LVM.Volumes) == 0 {
+            return fmt.Errorf("disk.lvm.volumes must list at least one volume")
+        }
+        if err := validateVolumes(d.LVM); err != nil {
+            return err
+        }
+    }
+    if err := validateUsers(c.Users); err != nil {
+        return err
+    }
+    if err := validateSystem(c); err != nil {
+        return err
+    }
+    if err := validateLocales(c); err != nil {
+        return err
+    }
+    for i, p := range d.Partitions {
+        if p.Device == "" {
+            return fmt.Errorf("disk.partitions[%d].device is required", i)
+        }
+        if err := checkDevicePath(p.Device); err != nil {
+            return fmt.Errorf("disk.partitions[%d].device: %w", i, err)
+        }
+        if p.Encrypt && p.Mountpoint != "swap" {
+            return fmt.Errorf("disk.partitions[%d].encrypt is only supported for swap", i)
+        }
+    }
+    if d.Btrfs != nil {
+        if err := d.Btrfs.validate(); err != nil {
+            return err
+        }
+    }
+    if err := validateFilesystems(d); err != nil {
+        return err
+    }
+    if err := validateMounts(mountEntries(c)); err != nil {
+        return err
+    }
+    if err := c.Bootloader.withDefaults().validate(c); err != nil {
+        return fmt.Errorf("bootloader: %w", err)
+    }
+    return nil
+}
+
+// devicePath matches the block device paths an answers file may name.
+var devicePath = regexp.MustCompile(`^/dev/[A-Za-z0-9_+.:@-]+(/[A-Za-z0-9_+.:@-]+)*$`)
+
+// checkDevicePath makes sure p is a clean path below /dev.
+func checkDevicePath(p string) error {
+    if !devicePath.MatchString(p) || path.Clean(p) != p {
+        return fmt.Errorf("%q is not a device path under /dev", p)
+    }
+    return nil
+}
+
+// withoutSecrets returns a copy of c that is safe to write to disk. User
+// passwords are replaced by their hashes; the disk passphrase is left out.
+func (c *InstallConfig) withoutSecrets() (*InstallConfig, error) {
+    out := *c
+    out.Users = make([]UserConfig, len(c.Users))
+    for i, u := range c.Users {
+        if u.Password != "" {
+            hash, err := hashPassword(u.Password)
+            if err != nil {
+                return nil, err
+            }
+            u.Password, u.PasswordHash = "", hash
+        }
+        out.Users[i] = u
+    }
+    out.Disk.Encryption.Passphrase = ""
+    return &out, nil
+}
+
+// SaveConfig writes c as an answers file that LoadConfig can read back,
+// with the user passwords hashed and without the disk passphrase, which
+// has to be added again before installing from the file.
+func SaveConfig(path string, c *InstallConfig) error {
+    out, err := c.withoutSecrets()
+    if err != nil {
+        return fmt.Errorf("[SaveConfig] %w", err)
+    }
+    var data []byte
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        data, err = yaml.Marshal(out)
+    default:
+        data, err = json.MarshalIndent(out, "", "    ")
+        data = append(data, '\n')
+    }
+    if err != nil {
+        return fmt.Errorf("[SaveConfig] %w", err)
+    }
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        return fmt.Errorf("[SaveConfig] %w", err)
+    }
+    return nil
+}
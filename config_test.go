@@ -0,0 +1,81 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSaveConfigHashesPasswords(t *testing.T) {
+    for _, name := range []string{"answers.json", "answers.yaml"} {
+        cfg := testConfig()
+        cfg.Hostname = "phyos"
+        cfg.Disk.Encryption.Passphrase = "disk secret"
+        cfg.Users = []UserConfig{{Name: "alice", Password: "login secret", Sudo: true}}
+        file := filepath.Join(t.TempDir(), name)
+        if err := SaveConfig(file, cfg); err != nil {
+            t.Fatal(err)
+        }
+        data, err := os.ReadFile(file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if s := string(data); strings.Contains(s, "secret") || strings.Contains(s, "redacted") {
+            t.Errorf("%s keeps a secret:\n%s", name, s)
+        }
+
+        got, err := LoadConfig(file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        u := got.Users[0]
+        if u.Password != "" || !strings.HasPrefix(u.PasswordHash, "$6$") {
+            t.Fatalf("%s: user loaded as %+v, want only a SHA-512 crypt hash", name, u)
+        }
+        salt := strings.Split(u.PasswordHash, "$")[2]
+        if sha512Crypt([]byte("login secret"), []byte(salt), sha512CryptRounds) != u.PasswordHash {
+            t.Errorf("%s: %s is not the hash of the password", name, u.PasswordHash)
+        }
+        if err := got.Validate(); err == nil || !strings.Contains(err.Error(), "disk.encryption.passphrase") {
+            t.Errorf("%s: validated %v without the disk passphrase", name, err)
+        }
+        got.Disk.Encryption.Passphrase = "disk secret"
+        if err := got.Validate(); err != nil {
+            t.Errorf("%s: %v", name, err)
+        }
+
+        // The saved hash reaches chpasswd as it is.
+        makeCmdMap()
+        f := NewFakeRunner()
+        for _, op := range userOps(got, "/mnt") {
+            if p, ok := op.(passwordOp); ok {
+                if err := p.Apply(f); err != nil {
+                    t.Fatal(err)
+                }
+                if p.hash != u.PasswordHash {
+                    t.Errorf("%s: chpasswd gets %q, want the saved hash", name, p.hash)
+                }
+            }
+        }
+        checkCalls(t, f, "arch-chroot /mnt chpasswd -e")
+    }
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+    for _, c := range []struct {
+        user UserConfig
+        want string
+    }{
+        {UserConfig{Name: "alice", PasswordHash: "$6$salt$abc./XYZ"}, ""},
+        {UserConfig{Name: "alice", PasswordHash: "plain"}, "not a crypt(3) hash"},
+        {UserConfig{Name: "alice", PasswordHash: "$6$salt$abc\nroot::0:0"}, "not a crypt(3) hash"},
+        {UserConfig{Name: "alice", PasswordHash: "$6$salt$abc:x"}, "not a crypt(3) hash"},
+        {UserConfig{Name: "alice", Password: "pw", PasswordHash: "$6$salt$abc"}, "cannot both be set"},
+    } {
+        err := validateUsers([]UserConfig{c.user})
+        if c.want == "" && err != nil || c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+            t.Errorf("%+v: got %v, want %q", c.user, err, c.want)
+        }
+    }
+}
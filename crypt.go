@@ -0,0 +1,134 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha512"
+    "fmt"
+    "strings"
+)
+
+// cryptAlphabet is the base64 variant crypt(3) encodes salts and hashes in.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptRounds is the default of glibc, which leaves the rounds out of
+// the hash.
+const sha512CryptRounds = 5000
+
+// hashPassword hashes password for /etc/shadow with SHA-512 crypt and a
+// random salt, so only the hash is ever handed to a command.
+func hashPassword(password Secret) (string, error) {
+    raw := make([]byte, 16)
+    if _, err := rand.Read(raw); err != nil {
+        return "", fmt.Errorf("[hashPassword] %w", err)
+    }
+    salt := make([]byte, len(raw))
+    for i, b := range raw {
+        salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+    }
+    return sha512Crypt([]byte(password), salt, sha512CryptRounds), nil
+}
+
+// sha512Crypt implements the "$6$" scheme of glibc crypt(3) as specified by
+// Ulrich Drepper in "Unix crypt using SHA-256 and SHA-512".
+func sha512Crypt(password, salt []byte, rounds int) string {
+    if len(salt) > 16 {
+        salt = salt[:16]
+    }
+    // Digest B: password, salt, password.
+    h := sha512.New()
+    h.Write(password)
+    h.Write(salt)
+    h.Write(password)
+    b := h.Sum(nil)
+
+    // Digest A: password, salt, then B stretched to the password length
+    // and mixed in along the bits of that length.
+    h.Reset()
+    h.Write(password)
+    h.Write(salt)
+    n := len(password)
+    for ; n > 64; n -= 64 {
+        h.Write(b)
+    }
+    h.Write(b[:n])
+    for n = len(password); n > 0; n >>= 1 {
+        if n&1 != 0 {
+            h.Write(b)
+        } else {
+            h.Write(password)
+        }
+    }
+    a := h.Sum(nil)
+
+    // P and S sequences.
+    h.Reset()
+    for i := 0; i < len(password); i++ {
+        h.Write(password)
+    }
+    p := repeatTo(h.Sum(nil), len(password))
+    h.Reset()
+    for i := 0; i < 16+int(a[0]); i++ {
+        h.Write(salt)
+    }
+    s := repeatTo(h.Sum(nil), len(salt))
+
+    c := a
+    for i := 0; i < rounds; i++ {
+        h.Reset()
+        if i%2 != 0 {
+            h.Write(p)
+        } else {
+            h.Write(c)
+        }
+        if i%3 != 0 {
+            h.Write(s)
+        }
+        if i%7 != 0 {
+            h.Write(p)
+        }
+        if i%2 != 0 {
+            h.Write(c)
+        } else {
+            h.Write(p)
+        }
+        c = h.Sum(nil)
+    }
+
+    var out strings.Builder
+    out.WriteString("$6$")
+    if rounds != sha512CryptRounds {
+        fmt.Fprintf(&out, "rounds=%d$", rounds)
+    }
+    out.Write(salt)
+    out.WriteString("$")
+    // The bytes of the final digest are encoded in this order, three at a
+    // time, then the last one on its own.
+    for i := 0; i < 21; i++ {
+        cryptBase64(&out, c[i], c[i+21], c[i+42], 4, i%3)
+    }
+    cryptBase64(&out, 0, 0, c[63], 2, 0)
+    return out.String()
+}
+
+// cryptBase64 writes n characters of the 24 bits b2 b1 b0, least
+// significant first. rot rotates which byte is the most significant,
+// following the order the crypt specification lists them in.
+func cryptBase64(out *strings.Builder, b2, b1, b0 byte, n, rot int) {
+    for ; rot > 0; rot-- {
+        b2, b1, b0 = b1, b0, b2
+    }
+    w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+    for ; n > 0; n-- {
+        out.WriteByte(cryptAlphabet[w&0x3f])
+        w >>= 6
+    }
+}
+
+// repeatTo repeats digest until it is n bytes long.
+func repeatTo(digest []byte, n int) []byte {
+    out := make([]byte, 0, n)
+    for len(out) < n {
+        out = append(out, digest[:IntMin(len(digest), n-len(out))]...)
+    }
+    return out
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// TestSha512Crypt checks the reference vectors of "Unix crypt using
+// SHA-256 and SHA-512", which glibc tests crypt(3) with.
+func TestSha512Crypt(t *testing.T) {
+    for _, c := range []struct {
+        password, salt string
+        rounds         int
+        want           string
+    }{
+        {"Hello world!", "saltstring", 5000,
+            "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+        // Salts are cut to 16 characters.
+        {"Hello world!", "saltstringsaltstring", 10000,
+            "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+        {"This is just a test", "toolongsaltstring", 5000,
+            "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+    } {
+        if got := sha512Crypt([]byte(c.password), []byte(c.salt), c.rounds); got != c.want {
+            t.Errorf("sha512Crypt(%q, %q, %d) = %s, want %s", c.password, c.salt, c.rounds, got, c.want)
+        }
+    }
+}
+
+func TestHashPassword(t *testing.T) {
+    a, err := hashPassword("secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, _ := hashPassword("secret")
+    if a == b || !cryptHash.MatchString(a) || !strings.HasPrefix(a, "$6$") {
+        t.Errorf("hashes %s and %s, want two different SHA-512 crypt hashes", a, b)
+    }
+    salt := strings.Split(a, "$")[2]
+    if len(salt) != 16 || sha512Crypt([]byte("secret"), []byte(salt), sha512CryptRounds) != a {
+        t.Errorf("%s is not the hash of the password with its 16 character salt", a)
+    }
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Filesystem is what the installer knows about one filesystem type. Format
+// is the commands key of its mkfs template, which takes extra options and
+// the device. LabelFlag and UUIDFlag are the mkfs options that set the
+// label and a fixed UUID; a UUIDFlag ending in "=" takes the UUID without a
+// space. VolumeID filesystems have no UUID but a 32-bit volume ID, written
+// as blkid shows it, like "1A2B-3C4D".
+//
+// Grow and Shrink are the commands keys that grow the filesystem to fill its
+// device and shrink it to a size in KiB, run on the device or, with
+// ResizeMounted, on where it is mounted. CanGrow and CanShrink say which of
+// the two is possible.
+//
+// MountOptions are the options recommended for the installed system; empty
+// means the defaults, and btrfs mounts take theirs from BtrfsConfig. Fsck is
+// set when boot should check the filesystem.
+type Filesystem struct {
+    Name          string
+    Format        string
+    LabelFlag     string
+    MaxLabel      int
+    UUIDFlag      string
+    VolumeID      bool
+    CanGrow       bool
+    CanShrink     bool
+    Grow          string
+    Shrink        string
+    ResizeMounted bool
+    MountOptions  string
+    Fsck          bool
+    // Root is false for filesystems the system cannot boot from.
+    Root bool
+}
+
+// filesystems is the registry of every filesystem the installer can create.
+// The first entry is the default.
+var filesystems = []Filesystem{
+    {Name: "ext4", Format: "fsFormatExt4", LabelFlag: "-L", MaxLabel: 16, UUIDFlag: "-U", CanGrow: true, CanShrink: true, Grow: "fsGrowExt4", Shrink: "fsShrinkExt4", Fsck: true, Root: true},
+    {Name: "xfs", Format: "fsFormatXfs", LabelFlag: "-L", MaxLabel: 12, UUIDFlag: "-m uuid=", CanGrow: true, Grow: "fsGrowXfs", ResizeMounted: true, Root: true},
+    {Name: "btrfs", Format: "fsFormatBtrfs", LabelFlag: "-L", MaxLabel: 255, UUIDFlag: "-U", CanGrow: true, CanShrink: true, Grow: "fsGrowBtrfs", Shrink: "fsShrinkBtrfs", ResizeMounted: true, Root: true},
+    {Name: "f2fs", Format: "fsFormatF2fs", LabelFlag: "-l", MaxLabel: 512, UUIDFlag: "-U", CanGrow: true, Grow: "fsGrowF2fs", MountOptions: "noatime", Fsck: true, Root: true},
+    {Name: "vfat", Format: "fsFormatVfat", LabelFlag: "-n", MaxLabel: 11, UUIDFlag: "-i", VolumeID: true, MountOptions: "umask=0077", Fsck: true},
+    {Name: "swap", Format: "fsFormatSwap", LabelFlag: "-L", MaxLabel: 16, UUIDFlag: "-U"},
+}
+
+// lookupFilesystem finds name in the registry; an empty name is the
+// default.
+func lookupFilesystem(name string) (Filesystem, error) {
+    if name == "" {
+        return filesystems[0], nil
+    }
+    var names []string
+    for _, fs := range filesystems {
+        if fs.Name == name {
+            return fs, nil
+        }
+        names = append(names, fs.Name)
+    }
+    return Filesystem{}, fmt.Errorf("unsupported filesystem %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+var (
+    fsUUID     = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+    fsVolumeID = regexp.MustCompile(`^[0-9A-Fa-f]{4}-?[0-9A-Fa-f]{4}$`)
+)
+
+// formatOptions builds the extra mkfs options that set label and uuid;
+// either may be empty.
+func (f Filesystem) formatOptions(label, uuid string) (string, error) {
+    var opts string
+    if label != "" {
+        if len(label) > f.MaxLabel {
+            return "", fmt.Errorf("label %q is longer than the %d characters %s allows", label, f.MaxLabel, f.Name)
+        }
+        opts += " " + f.LabelFlag + " " + shellQuote(label)
+    }
+    if uuid == "" {
+        return opts, nil
+    }
+    if f.VolumeID {
+        if !fsVolumeID.MatchString(uuid) {
+            return "", fmt.Errorf("%s takes a volume ID like 1A2B-3C4D, not %q", f.Name, uuid)
+        }
+        uuid = strings.ReplaceAll(uuid, "-", "")
+    } else if !fsUUID.MatchString(uuid) {
+        return "", fmt.Errorf("%q is not a UUID", uuid)
+    }
+    if strings.HasSuffix(f.UUIDFlag, "=") {
+        return opts + " " + f.UUIDFlag + uuid, nil
+    }
+    return opts + " " + f.UUIDFlag + " " + uuid, nil
+}
+
+// canResize reports whether a filesystem of type name can be resized from
+// old to size bytes in place.
+func canResize(name string, old, size int64) bool {
+    f, err := lookupFilesystem(name)
+    if err != nil {
+        return false
+    }
+    if size < old {
+        return f.CanShrink
+    }
+    return size == old || f.CanGrow
+}
+
+// nextFilesystem is the registry entry after name, for the TUI to cycle
+// through. root skips the filesystems that cannot hold /.
+func nextFilesystem(name string, root bool) string {
+    if name == "" {
+        name = filesystems[0].Name
+    }
+    start := 0
+    for i, f := range filesystems {
+        if f.Name == name {
+            start = i + 1
+        }
+    }
+    for i := 0; i < len(filesystems); i++ {
+        f := filesystems[(start+i)%len(filesystems)]
+        if !root || f.Root {
+            return f.Name
+        }
+    }
+    return filesystems[0].Name
+}
+
+// validateFilesystems checks every filesystem d creates against the
+// registry, and that / is on one the system can boot from.
+func validateFilesystems(d DiskConfig) error {
+    check := func(field, fs, label, uuid string) error {
+        f, err := lookupFilesystem(fs)
+        if err == nil {
+            _, err = f.formatOptions(label, uuid)
+        }
+        if err != nil {
+            return fmt.Errorf("%s: %w", field, err)
+        }
+        return nil
+    }
+    if d.Target != "" {
+        if err := check("disk.filesystem", d.Filesystem, "", ""); err != nil {
+            return err
+        }
+    }
+    if d.LVM.Enabled {
+        for i, lv := range d.LVM.Volumes {
+            if lv.ThinPool {
+                continue
+            }
+            fs := lv.Filesystem
+            if fs == "" {
+                fs = d.Filesystem
+            }
+            if err := check(fmt.Sprintf("disk.lvm.volumes[%d]", i), fs, lv.Label, lv.UUID); err != nil {
+                return err
+            }
+            if lv.Mountpoint == "/" {
+                if f, _ := lookupFilesystem(fs); !f.Root {
+                    return fmt.Errorf("disk.lvm.volumes[%d]: / cannot be on %s", i, f.Name)
+                }
+            }
+        }
+    } else if d.Target != "" {
+        if f, _ := lookupFilesystem(d.Filesystem); !f.Root {
+            return fmt.Errorf("disk.filesystem: / cannot be on %s", f.Name)
+        }
+    }
+    for i, p := range d.Partitions {
+        if !p.Format {
+            continue
+        }
+        fs := p.Filesystem
+        if fs == "" {
+            fs = defaultFilesystem(p.Mountpoint)
+        }
+        if err := check(fmt.Sprintf("disk.partitions[%d]", i), fs, p.Label, p.UUID); err != nil {
+            return err
+        }
+        if p.Mountpoint == "/" {
+            if f, _ := lookupFilesystem(fs); !f.Root {
+                return fmt.Errorf("disk.partitions[%d]: / cannot be on %s", i, f.Name)
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestFormatOptionsUUID(t *testing.T) {
+    const uuid = "0b2f3c4d-5e6f-4a1b-8c9d-0e1f2a3b4c5d"
+    for _, c := range []struct {
+        fs, label, uuid, want string
+    }{
+        {"ext4", "root", uuid, " -L 'root' -U " + uuid},
+        {"xfs", "", uuid, " -m uuid=" + uuid},
+        {"btrfs", "", uuid, " -U " + uuid},
+        {"f2fs", "", uuid, " -U " + uuid},
+        {"swap", "", uuid, " -U " + uuid},
+        {"vfat", "ESP", "1A2B-3C4D", " -n 'ESP' -i 1A2B3C4D"},
+    } {
+        f, _ := lookupFilesystem(c.fs)
+        got, err := f.formatOptions(c.label, c.uuid)
+        if err != nil || got != c.want {
+            t.Errorf("%s options are %q, %v, want %q", c.fs, got, err, c.want)
+        }
+    }
+    for _, c := range []struct{ fs, uuid string }{
+        {"ext4", "1A2B-3C4D"},
+        {"vfat", uuid},
+        {"xfs", "not-a-uuid"},
+    } {
+        f, _ := lookupFilesystem(c.fs)
+        if _, err := f.formatOptions("", c.uuid); err == nil {
+            t.Errorf("%s accepted UUID %q", c.fs, c.uuid)
+        }
+    }
+}
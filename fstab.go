@@ -0,0 +1,326 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "strings"
+    "text/tabwriter"
+)
+
+// fileOp writes or appends to a file of the installed system. content is
+// called when the operation runs, so it can ask about devices earlier steps
+// created, and nothing is written when it fails.
+type fileOp struct {
+    key     string
+    path    string
+    content func(r Runner) (string, error)
+}
+
+func newFileOp(path string, content func(r Runner) string) fileOp {
+    return fileOp{"writeFile", path, func(r Runner) (string, error) { return content(r), nil }}
+}
+
+func newAppendOp(path string, content func(r Runner) string) fileOp {
+    return fileOp{"appendFile", path, func(r Runner) (string, error) { return content(r), nil }}
+}
+
+func (o fileOp) Describe() string {
+    if o.key == "appendFile" {
+        return "append to " + o.path
+    }
+    return "write " + o.path
+}
+
+func (o fileOp) Apply(r Runner) error {
+    content, err := o.content(r)
+    if err != nil {
+        return err
+    }
+    return runCommand(r, o.key, content, o.path)
+}
+
+// tagFunc returns the UUID or PARTUUID of dev, or "" when it is not known.
+type tagFunc func(tag, dev string) string
+
+// blkidTags asks blkid, for devices that exist by the time it is called.
+func blkidTags(r Runner) tagFunc {
+    return func(tag, dev string) string {
+        out, err := r.Output(shellCommand("blkidTag", tag, dev))
+        if err != nil {
+            return ""
+        }
+        return strings.TrimSpace(string(out))
+    }
+}
+
+// planTags stands in for the tags tags does not know with a placeholder,
+// for dry runs, where the devices that will carry them are not created.
+func planTags(tags tagFunc) tagFunc {
+    return func(tag, dev string) string {
+        if v := tags(tag, dev); v != "" {
+            return v
+        }
+        return "<" + tag + " of " + dev + ">"
+    }
+}
+
+// knownTags answers from blockDevices, for the preview. Devices cfg formats
+// get a new UUID and partitions on disks with queued changes may get a new
+// PARTUUID, so neither is known before the install.
+func knownTags(cfg *InstallConfig, q *OpQueue) tagFunc {
+    formatted := formattedDevices(cfg)
+    return func(tag, dev string) string {
+        d := findVolume(dev)
+        if d == nil {
+            return ""
+        }
+        switch tag {
+        case "UUID":
+            if !formatted[dev] {
+                return d.UUID
+            }
+        case "PARTUUID":
+            for _, op := range q.partOps() {
+                if op.Disk == d.Disk().Path {
+                    return ""
+                }
+            }
+            return d.PartUUID
+        }
+        return ""
+    }
+}
+
+// formattedDevices lists every device cfg puts a new filesystem or LUKS
+// header on.
+func formattedDevices(cfg *InstallConfig) map[string]bool {
+    d := cfg.Disk
+    out := make(map[string]bool)
+    if d.Target != "" {
+        out[d.Target] = true
+        if d.Encryption.Enabled {
+            out["/dev/mapper/"+d.Encryption.Mapper] = true
+        }
+        if d.LVM.Enabled {
+            for _, lv := range d.LVM.Volumes {
+                out["/dev/"+d.LVM.VolumeGroup+"/"+lv.Name] = true
+            }
+        }
+    }
+    for _, p := range d.Partitions {
+        if p.Format {
+            out[p.Device] = true
+        }
+    }
+    return out
+}
+
+// deviceSpec names dev in fstab or crypttab by tag, falling back to its
+// path when the tag is unknown.
+func deviceSpec(tags tagFunc, tag, dev string) string {
+    if v := tags(tag, dev); v != "" {
+        return tag + "=" + v
+    }
+    return dev
+}
+
+// fstabText renders the fstab of the installed system: every mount of cfg
+// with the options from the filesystem registry, then the encrypted swap.
+func fstabText(cfg *InstallConfig, tags tagFunc) string {
+    var b strings.Builder
+    b.WriteString("# /etc/fstab, generated by the phyOS installer\n\n")
+    w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "# <file system>\t<mount point>\t<type>\t<options>\t<dump>\t<pass>")
+    for _, e := range mountEntries(cfg) {
+        spec := deviceSpec(tags, "UUID", e.Device)
+        if e.Mountpoint == "swap" {
+            fmt.Fprintf(w, "%s\tnone\tswap\tdefaults\t0\t0\n", spec)
+            continue
+        }
+        opts := e.Options
+        if opts == "" {
+            opts = "defaults"
+        }
+        pass := 0
+        if f, err := lookupFilesystem(e.Filesystem); err == nil && f.Fsck {
+            pass = 2
+            if e.Mountpoint == "/" {
+                pass = 1
+            }
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t0\t%d\n", spec, e.Mountpoint, e.Filesystem, opts, pass)
+    }
+    for _, v := range luksVolumes(cfg) {
+        if v.Swap {
+            fmt.Fprintf(w, "/dev/mapper/%s\tnone\tswap\tdefaults\t0\t0\n", v.Mapper)
+        }
+    }
+    w.Flush()
+    return b.String()
+}
+
+// crypttabText renders the crypttab of the installed system, or "" when it
+// needs none. The container holding / is left to the initramfs.
+func crypttabText(cfg *InstallConfig, tags tagFunc) string {
+    var b strings.Builder
+    w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+    n := 0
+    for _, v := range luksVolumes(cfg) {
+        switch {
+        case v.Root:
+            continue
+        case v.Swap:
+            fmt.Fprintf(w, "%s\t%s\t/dev/urandom\tswap,cipher=aes-xts-plain64,size=512\n", v.Mapper, deviceSpec(tags, "PARTUUID", v.Device))
+        default:
+            fmt.Fprintf(w, "%s\t%s\tnone\tluks\n", v.Mapper, deviceSpec(tags, "UUID", v.Device))
+        }
+        n++
+    }
+    if n == 0 {
+        return ""
+    }
+    w.Flush()
+    return "# /etc/crypttab, generated by the phyOS installer\n\n" + b.String()
+}
+
+// fstabOps writes fstab and, when it is needed, crypttab into the target
+// mounted at root. The UUIDs are read once the filesystems exist.
+func fstabOps(cfg *InstallConfig, root string) []Operation {
+    etc := path.Join(root, "etc")
+    ops := []Operation{
+        newCmdOp("mkdirTarget", etc),
+        newFileOp(path.Join(etc, "fstab"), func(r Runner) string { return fstabText(cfg, blkidTags(r)) }),
+    }
+    if crypttabText(cfg, func(string, string) string { return "" }) != "" {
+        ops = append(ops, newFileOp(path.Join(etc, "crypttab"), func(r Runner) string { return crypttabText(cfg, blkidTags(r)) }))
+    }
+    return ops
+}
+
+// readFstab returns the lines of the fstab on dev, the root of a system
+// about to be reinstalled, or nil when there is none. A btrfs root may
+// keep it in the @ subvolume.
+func readFstab(r Runner, dev string) []string {
+    d := findVolume(dev)
+    if d == nil || unprobeable[d.FSType] {
+        return nil
+    }
+    var lines []string
+    read := func(dir string) {
+        for _, p := range []string{"etc/fstab", "@/etc/fstab"} {
+            if data, err := os.ReadFile(path.Join(dir, p)); err == nil {
+                lines = strings.Split(string(data), "\n")
+                return
+            }
+        }
+    }
+    if d.Mountpoint != "" {
+        read(d.Mountpoint)
+    } else {
+        withProbeMount(r, d, read)
+    }
+    return lines
+}
+
+// fstabEntries drops the comments and blank lines of an fstab and collapses
+// the spacing between columns.
+func fstabEntries(lines []string) []string {
+    var out []string
+    for _, l := range lines {
+        if f := strings.Fields(l); len(f) > 0 && !strings.HasPrefix(f[0], "#") {
+            out = append(out, strings.Join(f, " "))
+        }
+    }
+    return out
+}
+
+// fstabDiff compares the entries of two fstab files. Entries only in old
+// are prefixed with "-", entries only in new with "+" and shared ones with
+// a space.
+func fstabDiff(old, new []string) []string {
+    a, b := fstabEntries(old), fstabEntries(new)
+    // lcs[i][j] is the longest common subsequence of a[i:] and b[j:].
+    lcs := make([][]int, len(a)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(b)+1)
+    }
+    for i := len(a) - 1; i >= 0; i-- {
+        for j := len(b) - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else {
+                lcs[i][j] = IntMax(lcs[i+1][j], lcs[i][j+1])
+            }
+        }
+    }
+    var out []string
+    i, j := 0, 0
+    for i < len(a) && j < len(b) {
+        switch {
+        case a[i] == b[j]:
+            out = append(out, "  "+a[i])
+            i++
+            j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            out = append(out, "- "+a[i])
+            i++
+        default:
+            out = append(out, "+ "+b[j])
+            j++
+        }
+    }
+    for ; i < len(a); i++ {
+        out = append(out, "- "+a[i])
+    }
+    for ; j < len(b); j++ {
+        out = append(out, "+ "+b[j])
+    }
+    return out
+}
+
+// fstabModel is the fstab tab: the fstab and crypttab the installed system
+// gets and, when reinstalling, how the fstab differs from the one on the
+// old root.
+type fstabModel struct {
+    r        Runner
+    fstab    string
+    crypttab string
+    oldDev   string
+    old      []string
+}
+
+// refresh regenerates the files for cfg. The old fstab is only read again
+// when the root device changes.
+func (m fstabModel) refresh(cfg *InstallConfig, q *OpQueue) fstabModel {
+    m.fstab = fstabText(cfg, knownTags(cfg, q))
+    m.crypttab = crypttabText(cfg, knownTags(cfg, q))
+    dev := ""
+    if e := rootDevice(cfg); e != nil {
+        dev = e.Device
+    }
+    if dev != m.oldDev {
+        m.oldDev, m.old = dev, nil
+        if dev != "" {
+            m.old = readFstab(m.r, dev)
+        }
+    }
+    return m
+}
+
+func (m fstabModel) View() string {
+    var b strings.Builder
+    b.WriteString("\n" + inputStyle.Render("/etc/fstab:") + "\n\n" + m.fstab)
+    b.WriteString("\n" + inputStyle.Render("/etc/crypttab:") + "\n\n")
+    if m.crypttab == "" {
+        b.WriteString("  not needed\n")
+    } else {
+        b.WriteString(m.crypttab)
+    }
+    b.WriteString("\n" + continueStyle.Render("Filesystems that are about to be created are listed by path until they have a UUID.") + "\n")
+    if m.old != nil {
+        b.WriteString("\n" + inputStyle.Render("Changes to the fstab on "+m.oldDev+":") + "\n\n")
+        b.WriteString(strings.Join(fstabDiff(m.old, strings.Split(m.fstab, "\n")), "\n") + "\n")
+    }
+    return b.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// testConfig is LVM on LUKS on a device that does not exist, so blkid knows
+// no UUIDs and the files name devices by path, with an ESP and an
+// encrypted swap partition next to it.
+func testConfig() *InstallConfig {
+    cfg := defaultConfig()
+    cfg.Disk.Target = "/dev/phyos-test2"
+    cfg.Disk.Partitions = []PartitionConfig{
+        {Device: "/dev/phyos-test1", Filesystem: "vfat", Mountpoint: "/boot"},
+        {Device: "/dev/phyos-test3", Mountpoint: "swap", Encrypt: true},
+    }
+    return cfg
+}
+
+func TestFstabOps(t *testing.T) {
+    blockDevices = nil
+    root := testRoot(t)
+    applyInRoot(t, fstabOps(testConfig(), root))
+
+    want := "# /etc/fstab, generated by the phyOS installer\n\n" +
+        "# <file system>        <mount point>  <type>  <options>   <dump>  <pass>\n" +
+        "/dev/phyos/root        /              ext4    defaults    0       1\n" +
+        "/dev/phyos-test1       /boot          vfat    umask=0077  0       2\n" +
+        "/dev/mapper/cryptswap  none           swap    defaults    0       0\n"
+    if got := readTarget(t, root, "etc/fstab"); got != want {
+        t.Errorf("fstab is\n%s\nwant\n%s", got, want)
+    }
+
+    want = "# /etc/crypttab, generated by the phyOS installer\n\n" +
+        "cryptswap  /dev/phyos-test3  /dev/urandom  swap,cipher=aes-xts-plain64,size=512\n"
+    if got := readTarget(t, root, "etc/crypttab"); got != want {
+        t.Errorf("crypttab is\n%s\nwant\n%s", got, want)
+    }
+}
+
+func TestFstabOpsWithoutCrypttab(t *testing.T) {
+    blockDevices = nil
+    root := testRoot(t)
+    cfg := testConfig()
+    cfg.Disk.Encryption.Enabled = false
+    cfg.Disk.Partitions = cfg.Disk.Partitions[:1]
+    applyInRoot(t, fstabOps(cfg, root))
+
+    if _, err := os.Stat(filepath.Join(root, "etc/crypttab")); !os.IsNotExist(err) {
+        t.Errorf("crypttab written without encrypted volumes: %v", err)
+    }
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+const gib = 1 << 30
+
+// GuidedConfig asks for an automatic layout that erases Disk. Whether the
+// layout is wrapped in LUKS and LVM follows disk.encryption and disk.lvm.
+// Home is "auto", "yes" or "no"; auto gives /home its own volume on disks of
+// 128 GiB and more.
+type GuidedConfig struct {
+    Disk string `json:"disk" yaml:"disk"`
+    Swap bool   `json:"swap" yaml:"swap"`
+    Home string `json:"home,omitempty" yaml:"home,omitempty"`
+}
+
+// guidedPlan is the result of GuidedLayout: the partition table changes and
+// the storage stack to build on top.
+type guidedPlan struct {
+    Ops  []PartOp
+    Disk DiskConfig
+}
+
+// GuidedLayout replaces the partition table of disk with a new GPT holding
+// an ESP followed by root, swap and /home, sized from the disk and from
+// ram. With LVM everything but the ESP goes into one volume group on the
+// partition after it, optionally inside LUKS. Encryption without LVM only
+// covers root, so swap and /home are left out. On bios firmware a BIOS boot
+// partition for GRUB comes first.
+func GuidedLayout(disk *BlockDevice, ram int64, base DiskConfig, g GuidedConfig, firmware string) (guidedPlan, error) {
+    size := int64(disk.Size)
+    if disk.ReadOnly {
+        return guidedPlan{}, fmt.Errorf("[GuidedLayout] %s is read-only", disk.Path)
+    }
+    if disk.InUse() {
+        return guidedPlan{}, fmt.Errorf("[GuidedLayout] %s is in use", disk.Path)
+    }
+    if size < 16*gib {
+        return guidedPlan{}, fmt.Errorf("[GuidedLayout] %s is %s, at least 16 GiB are needed", disk.Path, humanSize(size))
+    }
+
+    esp := int64(512 * mib)
+    if size >= 64*gib {
+        esp = gib
+    }
+    swap := int64(0)
+    if g.Swap {
+        swap = clampInt64(ram, gib, 8*gib)
+        swap = clampInt64(swap, gib, size/10) / mib * mib
+    }
+    home := g.Home == "yes" || (g.Home != "no" && size >= 128*gib)
+    root := int64(0) // the rest of the disk
+    if home {
+        root = clampInt64(size/4, 32*gib, 100*gib) / mib * mib
+    }
+    plain := base.Encryption.Enabled && !base.LVM.Enabled
+    if plain {
+        swap, home, root = 0, false, 0
+    }
+
+    table := PartOp{Kind: opNewTable, Disk: disk.Path, Table: "gpt", SectorSize: int64(disk.LogSec)}
+    pos := int64(mib)
+    end := size - mib
+    add := func(n int, size int64, pt PartType, label string) {
+        if size == 0 {
+            size = end - pos
+        }
+        table.Parts = append(table.Parts, PartOp{Kind: opCreate, Disk: disk.Path, Table: "gpt", SectorSize: table.SectorSize,
+            Number: n, Start: pos, Size: size, Type: pt, Label: label})
+        pos += size
+    }
+
+    d := base
+    d.Guided = &g
+    d.LVM.Volumes = nil
+    n := 1
+    if firmware == "bios" {
+        add(n, mib, partTypeByName("BIOS boot"), "BIOS")
+        n++
+    }
+    d.Partitions = []PartitionConfig{{Device: partPath(disk.Path, n), Filesystem: "vfat", Format: true, Mountpoint: "/boot"}}
+    add(n, esp, partTypeByName("EFI System"), "ESP")
+    n++
+
+    switch {
+    case base.LVM.Enabled:
+        pt := partTypeByName("Linux LVM")
+        if base.Encryption.Enabled {
+            pt = partTypeByName("Linux LUKS")
+        }
+        add(n, 0, pt, "phyos")
+        d.Target = partPath(disk.Path, n)
+        if swap > 0 {
+            d.LVM.Volumes = append(d.LVM.Volumes, LogicalVolumeConfig{Name: "swap", Size: sizeArg(swap), Filesystem: "swap", Mountpoint: "swap"})
+        }
+        rootLV := LogicalVolumeConfig{Name: "root", Size: "rest", Mountpoint: "/"}
+        if home {
+            rootLV.Size = sizeArg(root)
+        }
+        d.LVM.Volumes = append(d.LVM.Volumes, rootLV)
+        if home {
+            d.LVM.Volumes = append(d.LVM.Volumes, LogicalVolumeConfig{Name: "home", Size: "rest", Mountpoint: "/home"})
+        }
+    case plain:
+        add(n, 0, partTypeByName("Linux LUKS"), "root")
+        d.Target = partPath(disk.Path, n)
+    default:
+        if swap > 0 {
+            add(n, swap, partTypeByName("Linux swap"), "swap")
+            d.Partitions = append(d.Partitions, PartitionConfig{Device: partPath(disk.Path, n), Filesystem: "swap", Format: true, Mountpoint: "swap"})
+            n++
+        }
+        add(n, root, partTypeByName("Linux root (x86-64)"), "root")
+        d.Partitions = append(d.Partitions, PartitionConfig{Device: partPath(disk.Path, n), Filesystem: base.Filesystem, Format: true, Mountpoint: "/"})
+        n++
+        if home {
+            add(n, 0, partTypeByName("Linux filesystem"), "home")
+            d.Partitions = append(d.Partitions, PartitionConfig{Device: partPath(disk.Path, n), Filesystem: base.Filesystem, Format: true, Mountpoint: "/home"})
+        }
+        d.Target = ""
+    }
+    return guidedPlan{[]PartOp{table}, d}, nil
+}
+
+func partTypeByName(name string) PartType {
+    for _, pt := range partTypes {
+        if pt.Name == name {
+            return pt
+        }
+    }
+    return partTypes[0]
+}
+
+// sizeArg renders a size for lvcreate -L.
+func sizeArg(n int64) string {
+    return strconv.FormatInt(n/mib, 10) + "M"
+}
+
+func clampInt64(v, lo, hi int64) int64 {
+    if v < lo {
+        return lo
+    }
+    if v > hi {
+        return hi
+    }
+    return v
+}
+
+// readMemTotal returns the installed RAM in bytes from /proc/meminfo, or 0.
+func readMemTotal(meminfo string) int64 {
+    f, err := os.Open(meminfo)
+    if err != nil {
+        return 0
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        fields := strings.Fields(sc.Text())
+        if len(fields) >= 2 && fields[0] == "MemTotal:" {
+            kb, _ := strconv.ParseInt(fields[1], 10, 64)
+            return kb << 10
+        }
+    }
+    return 0
+}
+
+// applyGuided resolves cfg.Disk.Guided against the discovered devices,
+// replacing the disk layout of cfg and returning the partition changes.
+func applyGuided(cfg *InstallConfig, devs []*BlockDevice) (guidedOp, error) {
+    g := cfg.Disk.Guided
+    disk := FindDevice(devs, g.Disk)
+    if disk == nil || disk.Parent != nil {
+        return guidedOp{}, fmt.Errorf("[applyGuided] %s is not a disk", g.Disk)
+    }
+    plan, err := GuidedLayout(disk, readMemTotal("/proc/meminfo"), cfg.Disk, *g, cfg.Bootloader.withDefaults().Firmware)
+    if err != nil {
+        return guidedOp{}, err
+    }
+    return guidedOp{plan.Ops[0], plan.Disk}, nil
+}
+
+// guidedOp is the new partition table of a guided layout together with the
+// storage stack the layout puts on it. The stack only reaches the config
+// through withLayouts while the operation is queued, so undoing the table
+// also forgets what was going to be formatted on it.
+type guidedOp struct {
+    PartOp
+    Disk DiskConfig
+}
+
+// applyTo puts the layout into d. Partitions on other disks are kept; the
+// ones on the erased disk are replaced.
+func (o guidedOp) applyTo(d DiskConfig) DiskConfig {
+    d.Target = o.Disk.Target
+    d.Guided = o.Disk.Guided
+    d.LVM.Volumes = o.Disk.LVM.Volumes
+    parts := append([]PartitionConfig(nil), o.Disk.Partitions...)
+    for _, p := range d.Partitions {
+        if !onDisk(p.Device, o.PartOp.Disk) {
+            parts = append(parts, p)
+        }
+    }
+    d.Partitions = parts
+    return d
+}
+
+// onDisk reports whether dev is, or will be, a partition of disk.
+func onDisk(dev, disk string) bool {
+    if d := FindDevice(blockDevices, dev); d != nil {
+        return d.Disk().Path == disk
+    }
+    return dev == partPath(disk, partNumber(dev))
+}
+
+// withLayouts returns cfg with the guided layouts queued in q applied to
+// its disk config.
+func withLayouts(cfg *InstallConfig, q *OpQueue) *InstallConfig {
+    c := *cfg
+    for _, op := range q.Ops() {
+        if g, ok := op.(guidedOp); ok {
+            c.Disk = g.applyTo(c.Disk)
+        }
+    }
+    return &c
+}
+
+// guidedDisk returns the disk of dev when a queued guided layout erases it,
+// or "".
+func guidedDisk(q *OpQueue, dev string) string {
+    for _, op := range q.Ops() {
+        if g, ok := op.(guidedOp); ok && onDisk(dev, g.PartOp.Disk) {
+            return g.PartOp.Disk
+        }
+    }
+    return ""
+}
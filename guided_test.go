@@ -0,0 +1,67 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// blankDisk is lsblk describing a 64 GiB disk without a partition table.
+const blankDisk = `{"blockdevices": [
+  {"name": "/dev/sda", "path": "/dev/sda", "type": "disk", "size": 68719476736, "log-sec": 512, "ro": %s}
+]}`
+
+// guidedOnBlankDisk queues the guided layout of a blank disk the way main
+// does and returns the config it leaves.
+func guidedOnBlankDisk(t *testing.T, ro string) (*InstallConfig, *OpQueue, error) {
+    t.Helper()
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Outputs["lsblk "] = strings.Replace(blankDisk, "%s", ro, 1)
+    devs, err := ListBlockDevices(f)
+    if err != nil {
+        t.Fatal(err)
+    }
+    blockDevices = devs
+    cfg := defaultConfig()
+    cfg.Disk.Encryption.Passphrase = "secret"
+    cfg.Disk.Guided = &GuidedConfig{Disk: "/dev/sda", Swap: true, Home: "auto"}
+    cfg.Bootloader.Firmware = "uefi"
+    q := &OpQueue{}
+    op, err := applyGuided(cfg, devs)
+    if err != nil {
+        return nil, nil, err
+    }
+    q.Add(op)
+    cfg.Disk.Guided = nil
+    return withLayouts(cfg, q), q, nil
+}
+
+func TestGuidedCheckTarget(t *testing.T) {
+    cfg, q, err := guidedOnBlankDisk(t, "false")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Disk.Target != "/dev/sda2" {
+        t.Fatalf("target is %q, want the partition after the ESP", cfg.Disk.Target)
+    }
+    if err := cfg.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkTarget(blockDevices, cfg, q); err != nil {
+        t.Errorf("checkTarget: %v", err)
+    }
+    if _, err := checkFirmware(blockDevices, cfg, q); err != nil {
+        t.Errorf("checkFirmware: %v", err)
+    }
+
+    // Without the queued table the partition does not exist.
+    if err := checkTarget(blockDevices, cfg, &OpQueue{}); err == nil || !strings.Contains(err.Error(), "not a block device") {
+        t.Errorf("got %v for a target nothing creates", err)
+    }
+}
+
+func TestGuidedReadOnlyDisk(t *testing.T) {
+    if _, _, err := guidedOnBlankDisk(t, "true"); err == nil || !strings.Contains(err.Error(), "read-only") {
+        t.Errorf("got %v, want the read-only disk refused", err)
+    }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "fmt"
+)
+
+// phyosName names the LUKS mapping and the volume group of the default layout.
+const phyosName = "phyos"
+
+// installOps turns cfg into the operations that build its storage stack
+// and mount it under cfg.MountRoot.
+func installOps(cfg *InstallConfig) ([]Operation, error) {
+    if err := cfg.Validate(); err != nil {
+        return nil, fmt.Errorf("[Install] %w", err)
+    }
+    stack, err := stackOps(cfg.Disk)
+    if err != nil {
+        return nil, err
+    }
+    root := cfg.MountRoot
+    if root == "" {
+        root = defaultMountRoot
+    }
+    ops := append(stack, btrfsSubvolumeOps(cfg, root)...)
+    ops = append(ops, mountOps(root, mountEntries(cfg))...)
+    ops = append(ops, fstabOps(cfg, root)...)
+    ops = append(ops, systemOps(cfg, root)...)
+    ops = append(ops, localeOps(cfg, root)...)
+    ops = append(ops, initramfsOps(cfg, root)...)
+    ops = append(ops, bootOps(cfg, root)...)
+    ops = append(ops, userOps(cfg, root)...)
+    // The snapshot is the rollback point, so it is taken last.
+    return append(ops, snapshotOps(cfg.Disk)...), nil
+}
+
+// stackOps builds the LUKS, LVM and filesystem layers on the target and
+// formats the extra partitions that ask for it.
+func stackOps(d DiskConfig) ([]Operation, error) {
+    var ops []Operation
+    for _, p := range d.Partitions {
+        if p.Format && !p.Encrypt {
+            fs := p.Filesystem
+            if fs == "" {
+                fs = defaultFilesystem(p.Mountpoint)
+            }
+            op, err := formatOp(p.Device, fs, p.Label, p.UUID)
+            if err != nil {
+                return nil, err
+            }
+            ops = append(ops, op)
+        }
+    }
+    if d.Target == "" {
+        return ops, nil
+    }
+    dev := d.Target
+    if d.Encryption.Enabled {
+        ops = append(ops, luksOps(dev, d.Encryption)...)
+        dev = "/dev/mapper/" + d.Encryption.Mapper
+    }
+    if d.LVM.Enabled {
+        lvm, err := lvmOps(dev, d)
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, lvm...)
+    } else {
+        op, err := formatOp(dev, d.Filesystem, "", "")
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, op)
+    }
+    return ops, nil
+}
+
+func lvmOps(pv string, d DiskConfig) ([]Operation, error) {
+    vg := d.LVM.VolumeGroup
+    ops := []Operation{
+        newCmdOp("lvmCreatePv", pv),
+        newCmdOp("lvmCreateVg", vg, pv),
+    }
+    for _, lv := range d.LVM.Volumes {
+        switch {
+        case lv.ThinPool && lv.Size == "rest":
+            ops = append(ops, newCmdOp("lvmCreateThinPoolRest", lv.Name, vg))
+            continue
+        case lv.ThinPool:
+            ops = append(ops, newCmdOp("lvmCreateThinPool", lv.Size, lv.Name, vg))
+            continue
+        case lv.Pool != "":
+            ops = append(ops, newCmdOp("lvmCreateThinLv", lv.Size, lv.Name, vg+"/"+lv.Pool))
+        case lv.Size == "rest":
+            ops = append(ops, newCmdOp("lvmCreateLvRest", lv.Name, vg))
+        default:
+            ops = append(ops, newCmdOp("lvmCreateLv", lv.Size, lv.Name, vg))
+        }
+        fs := lv.Filesystem
+        if fs == "" {
+            fs = d.Filesystem
+        }
+        op, err := formatOp("/dev/"+vg+"/"+lv.Name, fs, lv.Label, lv.UUID)
+        if err != nil {
+            return nil, err
+        }
+        ops = append(ops, op)
+    }
+    return ops, nil
+}
+
+// snapshotOps snapshots the root LV when d asks for it.
+func snapshotOps(d DiskConfig) []Operation {
+    snap := d.LVM.Snapshot
+    if !d.LVM.Enabled || d.Target == "" || snap == nil {
+        return nil
+    }
+    root := rootVolume(d.LVM)
+    if root == nil {
+        return nil
+    }
+    origin := d.LVM.VolumeGroup + "/" + root.Name
+    if root.Pool != "" {
+        return []Operation{newCmdOp("lvmSnapshotThin", snap.Name, origin)}
+    }
+    return []Operation{newCmdOp("lvmSnapshot", snap.Size, snap.Name, origin)}
+}
+
+// formatOp creates a filesystem of type fs on dev with the mkfs command the
+// registry names for it, labelled label and with a fixed uuid when they are
+// set.
+func formatOp(dev, fs, label, uuid string) (Operation, error) {
+    f, err := lookupFilesystem(fs)
+    if err != nil {
+        return nil, fmt.Errorf("[formatOp] %s: %w", dev, err)
+    }
+    opts, err := f.formatOptions(label, uuid)
+    if err != nil {
+        return nil, fmt.Errorf("[formatOp] %s: %w", dev, err)
+    }
+    return newCmdOp(f.Format, shellArgs(opts), dev), nil
+}
+
+// installQueue returns a queue holding the edits in q followed by the
+// installation steps for cfg. When cfg has nothing to install only the
+// edits are kept.
+func installQueue(cfg *InstallConfig, q *OpQueue) (*OpQueue, error) {
+    out := &OpQueue{}
+    if q != nil {
+        for _, op := range q.Ops() {
+            out.Add(op)
+        }
+    }
+    if cfg.Disk.Target == "" && len(cfg.Disk.Partitions) == 0 {
+        return out, nil
+    }
+    ops, err := installOps(cfg)
+    if err != nil {
+        return nil, err
+    }
+    for _, op := range ops {
+        out.Add(op)
+    }
+    return out, nil
+}
+
+// Install applies the edits in q, which may be nil, and then builds the
+// storage stack described by cfg.
+func Install(r Runner, cfg *InstallConfig, q *OpQueue, progress func(i, n int, op Operation)) error {
+    full, err := installQueue(cfg, q)
+    if err != nil {
+        return err
+    }
+    return full.Apply(r, progress)
+}
+
+// previewInstall returns the commands Install would run without touching
+// anything, or why it would not run.
+func previewInstall(cfg *InstallConfig, q *OpQueue) ([]PlanStep, error) {
+    d := &DryRunner{Inner: NewFakeRunner()}
+    if err := Install(d, cfg, q, nil); err != nil {
+        return nil, err
+    }
+    return d.Steps, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestPreviewInstallReturnsError(t *testing.T) {
+    makeCmdMap()
+    blockDevices = nil
+    cfg := testConfig()
+    steps, err := previewInstall(cfg, nil)
+    if err == nil || !strings.Contains(err.Error(), "disk.encryption.passphrase") || steps != nil {
+        t.Errorf("previewed %d steps, %v, want the missing passphrase", len(steps), err)
+    }
+
+    cfg.Disk.Encryption.Passphrase = "secret"
+    if steps, err = previewInstall(cfg, nil); err != nil || len(steps) == 0 {
+        t.Errorf("previewed %d steps, %v", len(steps), err)
+    }
+}
@@ -0,0 +1,424 @@
+// Package gpt reads and writes GPT and legacy MBR partition tables on any
+// io.ReaderAt or io.WriterAt, so tables on disk images and loop devices can
+// be handled without sfdisk.
+package gpt
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf16"
+)
+
+const (
+    entryCount = 128
+    entrySize  = 128
+    headerSize = 92
+    revision   = 0x00010000
+    mbrPartsAt = 446
+)
+
+// ErrNoTable is returned by Read for a device without an MBR signature.
+var ErrNoTable = errors.New("no partition table")
+
+// Table is a GPT or MBR partition table as stored on a disk or an image.
+// Label is "gpt" or "dos", as sfdisk names them. Offsets and sizes are in
+// bytes. Type holds a GUID on GPT and a hex id like "83" on MBR, the same
+// values lsblk reports as PARTTYPE.
+type Table struct {
+    Label      string
+    SectorSize int64
+    DiskSize   int64
+    // DiskID is the disk GUID on GPT and the 8 digit disk signature on MBR.
+    DiskID string
+    Parts  []Partition
+}
+
+// Partition is one entry of a Table. GUID and Name only exist on GPT,
+// Bootable only on MBR.
+type Partition struct {
+    Number   int
+    Start    int64
+    Size     int64
+    Type     string
+    GUID     string
+    Name     string
+    Bootable bool
+}
+
+// Read reads the table of a device of size bytes. A GPT whose primary
+// header or entries fail their checksum is read from the backup at the end
+// of the device. Only the four primary MBR partitions are listed.
+func Read(r io.ReaderAt, size, sector int64) (*Table, error) {
+    mbr := make([]byte, 512)
+    if _, err := r.ReadAt(mbr, 0); err != nil {
+        return nil, fmt.Errorf("[gpt.Read] %w", err)
+    }
+    if mbr[510] != 0x55 || mbr[511] != 0xAA {
+        return nil, ErrNoTable
+    }
+    t := &Table{SectorSize: sector, DiskSize: size}
+    for i := 0; i < 4; i++ {
+        if mbr[mbrPartsAt+16*i+4] == 0xEE {
+            return t, t.readGPT(r)
+        }
+    }
+    t.readMBR(mbr)
+    return t, nil
+}
+
+func (t *Table) readMBR(mbr []byte) {
+    t.Label = "dos"
+    t.DiskID = fmt.Sprintf("%08x", binary.LittleEndian.Uint32(mbr[440:444]))
+    for i := 0; i < 4; i++ {
+        e := mbr[mbrPartsAt+16*i:]
+        if e[4] == 0 {
+            continue
+        }
+        t.Parts = append(t.Parts, Partition{
+            Number:   i + 1,
+            Start:    int64(binary.LittleEndian.Uint32(e[8:12])) * t.SectorSize,
+            Size:     int64(binary.LittleEndian.Uint32(e[12:16])) * t.SectorSize,
+            Type:     fmt.Sprintf("%02x", e[4]),
+            Bootable: e[0] == 0x80,
+        })
+    }
+}
+
+func (t *Table) readGPT(r io.ReaderAt) error {
+    t.Label = "gpt"
+    hdr, entries, err := readHeader(r, 1, t.SectorSize)
+    if err != nil {
+        last := t.DiskSize/t.SectorSize - 1
+        var backupErr error
+        hdr, entries, backupErr = readHeader(r, last, t.SectorSize)
+        if backupErr != nil {
+            return fmt.Errorf("[gpt.Read] primary GPT: %v, backup GPT: %v", err, backupErr)
+        }
+    }
+    t.DiskID = formatGUID(hdr[56:72])
+    esize := int(binary.LittleEndian.Uint32(hdr[84:88]))
+    for i := 0; i < len(entries)/esize; i++ {
+        e := entries[i*esize : (i+1)*esize]
+        if isZero(e[0:16]) {
+            continue
+        }
+        first := int64(binary.LittleEndian.Uint64(e[32:40]))
+        last := int64(binary.LittleEndian.Uint64(e[40:48]))
+        t.Parts = append(t.Parts, Partition{
+            Number: i + 1,
+            Start:  first * t.SectorSize,
+            Size:   (last - first + 1) * t.SectorSize,
+            Type:   formatGUID(e[0:16]),
+            GUID:   formatGUID(e[16:32]),
+            Name:   decodeName(e[56:128]),
+        })
+    }
+    return nil
+}
+
+// readHeader reads the GPT header at lba and its partition entries,
+// checking both CRC32s.
+func readHeader(r io.ReaderAt, lba, sector int64) ([]byte, []byte, error) {
+    hdr := make([]byte, sector)
+    if _, err := r.ReadAt(hdr, lba*sector); err != nil {
+        return nil, nil, err
+    }
+    if string(hdr[0:8]) != "EFI PART" {
+        return nil, nil, fmt.Errorf("no GPT header at LBA %d", lba)
+    }
+    size := int64(binary.LittleEndian.Uint32(hdr[12:16]))
+    if size < headerSize || size > sector {
+        return nil, nil, fmt.Errorf("GPT header at LBA %d has size %d", lba, size)
+    }
+    check := append([]byte(nil), hdr[:size]...)
+    binary.LittleEndian.PutUint32(check[16:20], 0)
+    if crc32.ChecksumIEEE(check) != binary.LittleEndian.Uint32(hdr[16:20]) {
+        return nil, nil, fmt.Errorf("GPT header at LBA %d has a bad checksum", lba)
+    }
+    if cur := int64(binary.LittleEndian.Uint64(hdr[24:32])); cur != lba {
+        return nil, nil, fmt.Errorf("GPT header at LBA %d says it is at LBA %d", lba, cur)
+    }
+    count := int64(binary.LittleEndian.Uint32(hdr[80:84]))
+    esize := int64(binary.LittleEndian.Uint32(hdr[84:88]))
+    if esize < entrySize || esize%8 != 0 || count*esize > 1<<20 {
+        return nil, nil, fmt.Errorf("GPT header at LBA %d has %d entries of %d bytes", lba, count, esize)
+    }
+    entries := make([]byte, count*esize)
+    if _, err := r.ReadAt(entries, int64(binary.LittleEndian.Uint64(hdr[72:80]))*sector); err != nil {
+        return nil, nil, err
+    }
+    if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:92]) {
+        return nil, nil, fmt.Errorf("GPT entries of the header at LBA %d have a bad checksum", lba)
+    }
+    return hdr, entries, nil
+}
+
+// Write replaces whatever table the device holds with t. Missing GUIDs and
+// disk ids are generated and stored back into t. Nothing is written when a
+// partition is out of range or overlaps another.
+func (t *Table) Write(w io.WriterAt) error {
+    if t.SectorSize < 512 || t.SectorSize%512 != 0 {
+        return fmt.Errorf("[gpt.Write] %d is not a sector size", t.SectorSize)
+    }
+    var err error
+    switch t.Label {
+    case "gpt":
+        err = t.writeGPT(w)
+    case "dos":
+        err = t.writeMBR(w)
+    default:
+        err = fmt.Errorf("unknown partition table %q", t.Label)
+    }
+    if err != nil {
+        return fmt.Errorf("[gpt.Write] %w", err)
+    }
+    return nil
+}
+
+// checkLayout makes sure every partition is a whole number of sectors
+// between the LBAs first and last and that no two of them share a sector.
+// numbers is the highest partition number the table can hold.
+func (t *Table) checkLayout(first, last int64, numbers int) error {
+    sector := t.SectorSize
+    parts := append([]Partition(nil), t.Parts...)
+    sort.Slice(parts, func(i, j int) bool { return parts[i].Start < parts[j].Start })
+    seen := make(map[int]bool)
+    for i, p := range parts {
+        if p.Number < 1 || p.Number > numbers {
+            return fmt.Errorf("partition number %d is out of range 1-%d", p.Number, numbers)
+        }
+        if seen[p.Number] {
+            return fmt.Errorf("partition %d is listed twice", p.Number)
+        }
+        seen[p.Number] = true
+        if p.Start%sector != 0 || p.Size%sector != 0 || p.Size <= 0 {
+            return fmt.Errorf("partition %d is not a whole number of sectors", p.Number)
+        }
+        if p.Start/sector < first || p.Size/sector > last-p.Start/sector+1 {
+            return fmt.Errorf("partition %d lies outside the usable sectors %d-%d", p.Number, first, last)
+        }
+        if i > 0 && parts[i-1].Start+parts[i-1].Size > p.Start {
+            return fmt.Errorf("partitions %d and %d overlap", parts[i-1].Number, p.Number)
+        }
+    }
+    return nil
+}
+
+func (t *Table) writeGPT(w io.WriterAt) error {
+    sector := t.SectorSize
+    lbas := t.DiskSize / sector
+    entrySectors := (entryCount*entrySize + sector - 1) / sector
+    firstUsable, lastUsable := 2+entrySectors, lbas-2-entrySectors
+    backupEntries := lbas - 1 - entrySectors
+    if lastUsable < firstUsable {
+        return fmt.Errorf("%d bytes with %d byte sectors is too small for GPT", t.DiskSize, sector)
+    }
+    if err := t.checkLayout(firstUsable, lastUsable, entryCount); err != nil {
+        return err
+    }
+
+    entries := make([]byte, entryCount*entrySize)
+    for i := range t.Parts {
+        p := &t.Parts[i]
+        typ, err := parseGUID(p.Type)
+        if err != nil {
+            return err
+        }
+        if p.GUID == "" {
+            p.GUID = newGUID()
+        }
+        id, err := parseGUID(p.GUID)
+        if err != nil {
+            return err
+        }
+        name := utf16.Encode([]rune(p.Name))
+        if len(name) > 36 {
+            return fmt.Errorf("partition name %q is longer than 36 characters", p.Name)
+        }
+        e := entries[(p.Number-1)*entrySize:]
+        copy(e[0:16], typ[:])
+        copy(e[16:32], id[:])
+        binary.LittleEndian.PutUint64(e[32:40], uint64(p.Start/sector))
+        binary.LittleEndian.PutUint64(e[40:48], uint64((p.Start+p.Size)/sector-1))
+        for j, c := range name {
+            binary.LittleEndian.PutUint16(e[56+2*j:], c)
+        }
+    }
+
+    if t.DiskID == "" {
+        t.DiskID = newGUID()
+    }
+    disk, err := parseGUID(t.DiskID)
+    if err != nil {
+        return err
+    }
+    entriesCRC := crc32.ChecksumIEEE(entries)
+    header := func(cur, backup, entriesAt int64) []byte {
+        h := make([]byte, sector)
+        copy(h, "EFI PART")
+        binary.LittleEndian.PutUint32(h[8:12], revision)
+        binary.LittleEndian.PutUint32(h[12:16], headerSize)
+        binary.LittleEndian.PutUint64(h[24:32], uint64(cur))
+        binary.LittleEndian.PutUint64(h[32:40], uint64(backup))
+        binary.LittleEndian.PutUint64(h[40:48], uint64(firstUsable))
+        binary.LittleEndian.PutUint64(h[48:56], uint64(lastUsable))
+        copy(h[56:72], disk[:])
+        binary.LittleEndian.PutUint64(h[72:80], uint64(entriesAt))
+        binary.LittleEndian.PutUint32(h[80:84], entryCount)
+        binary.LittleEndian.PutUint32(h[84:88], entrySize)
+        binary.LittleEndian.PutUint32(h[88:92], entriesCRC)
+        binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:headerSize]))
+        return h
+    }
+
+    writes := []struct {
+        at   int64
+        data []byte
+    }{
+        {0, protectiveMBR(lbas)},
+        {sector, header(1, lbas-1, 2)},
+        {2 * sector, entries},
+        {backupEntries * sector, entries},
+        {(lbas - 1) * sector, header(lbas-1, 1, backupEntries)},
+    }
+    for _, wr := range writes {
+        if _, err := w.WriteAt(wr.data, wr.at); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func protectiveMBR(lbas int64) []byte {
+    mbr := make([]byte, 512)
+    e := mbr[mbrPartsAt:]
+    copy(e[1:4], []byte{0x00, 0x02, 0x00})
+    e[4] = 0xEE
+    copy(e[5:8], []byte{0xFF, 0xFF, 0xFF})
+    binary.LittleEndian.PutUint32(e[8:12], 1)
+    n := lbas - 1
+    if n > 0xFFFFFFFF {
+        n = 0xFFFFFFFF
+    }
+    binary.LittleEndian.PutUint32(e[12:16], uint32(n))
+    mbr[510], mbr[511] = 0x55, 0xAA
+    return mbr
+}
+
+// writeMBR writes up to four primary partitions. Both GPT headers are wiped
+// so nothing mistakes the disk for GPT afterwards.
+func (t *Table) writeMBR(w io.WriterAt) error {
+    sector := t.SectorSize
+    lbas := t.DiskSize / sector
+    if lbas < 2 {
+        return fmt.Errorf("%d bytes with %d byte sectors is too small for MBR", t.DiskSize, sector)
+    }
+    if err := t.checkLayout(1, lbas-1, 4); err != nil {
+        return err
+    }
+    mbr := make([]byte, 512)
+    if t.DiskID == "" {
+        var id [4]byte
+        if _, err := rand.Read(id[:]); err != nil {
+            return err
+        }
+        t.DiskID = hex.EncodeToString(id[:])
+    }
+    id, err := strconv.ParseUint(t.DiskID, 16, 32)
+    if err != nil {
+        return fmt.Errorf("MBR disk id %q is not 8 hex digits", t.DiskID)
+    }
+    binary.LittleEndian.PutUint32(mbr[440:444], uint32(id))
+    for _, p := range t.Parts {
+        first, count := p.Start/sector, p.Size/sector
+        if first+count > 0xFFFFFFFF {
+            return fmt.Errorf("partition %d ends beyond the 2 TiB MBR limit", p.Number)
+        }
+        typ, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(p.Type), "0x"), 16, 8)
+        if err != nil || typ == 0 {
+            return fmt.Errorf("MBR partition type %q is not a hex id", p.Type)
+        }
+        e := mbr[mbrPartsAt+16*(p.Number-1):]
+        if p.Bootable {
+            e[0] = 0x80
+        }
+        // CHS addressing is long dead; these values say "use the LBA fields".
+        copy(e[1:4], []byte{0xFE, 0xFF, 0xFF})
+        e[4] = byte(typ)
+        copy(e[5:8], []byte{0xFE, 0xFF, 0xFF})
+        binary.LittleEndian.PutUint32(e[8:12], uint32(first))
+        binary.LittleEndian.PutUint32(e[12:16], uint32(count))
+    }
+    mbr[510], mbr[511] = 0x55, 0xAA
+
+    blank := make([]byte, sector)
+    for _, at := range []int64{sector, (lbas - 1) * sector} {
+        if _, err := w.WriteAt(blank, at); err != nil {
+            return err
+        }
+    }
+    _, err = w.WriteAt(mbr, 0)
+    return err
+}
+
+// parseGUID turns the text form of a GUID into its on-disk form, where the
+// first three groups are little-endian.
+func parseGUID(s string) ([16]byte, error) {
+    var g [16]byte
+    raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+    if err != nil || len(raw) != 16 || len(s) != 36 {
+        return g, fmt.Errorf("%q is not a GUID", s)
+    }
+    g[0], g[1], g[2], g[3] = raw[3], raw[2], raw[1], raw[0]
+    g[4], g[5] = raw[5], raw[4]
+    g[6], g[7] = raw[7], raw[6]
+    copy(g[8:], raw[8:])
+    return g, nil
+}
+
+func formatGUID(g []byte) string {
+    return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+        binary.LittleEndian.Uint32(g[0:4]), binary.LittleEndian.Uint16(g[4:6]),
+        binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:16])
+}
+
+// newGUID returns a random version 4 GUID.
+func newGUID() string {
+    var raw [16]byte
+    if _, err := rand.Read(raw[:]); err != nil {
+        panic(err)
+    }
+    raw[6] = raw[6]&0x0f | 0x40
+    raw[8] = raw[8]&0x3f | 0x80
+    h := strings.ToUpper(hex.EncodeToString(raw[:]))
+    return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func decodeName(b []byte) string {
+    var units []uint16
+    for i := 0; i+1 < len(b); i += 2 {
+        c := binary.LittleEndian.Uint16(b[i:])
+        if c == 0 {
+            break
+        }
+        units = append(units, c)
+    }
+    return string(utf16.Decode(units))
+}
+
+func isZero(b []byte) bool {
+    for _, c := range b {
+        if c != 0 {
+            return false
+        }
+    }
+    return true
+}
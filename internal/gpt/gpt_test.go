@@ -0,0 +1,410 @@
+package gpt
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "unicode/utf16"
+)
+
+// image is an in-memory disk.
+type image []byte
+
+func (m image) ReadAt(p []byte, off int64) (int, error) {
+    if off < 0 || off+int64(len(p)) > int64(len(m)) {
+        return 0, io.ErrUnexpectedEOF
+    }
+    return copy(p, m[off:]), nil
+}
+
+func (m image) WriteAt(p []byte, off int64) (int, error) {
+    if off < 0 || off+int64(len(p)) > int64(len(m)) {
+        return 0, io.ErrShortWrite
+    }
+    return copy(m[off:], p), nil
+}
+
+const (
+    linuxFS = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+    esp     = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+)
+
+// gptTable is the table of gpt512.img, a 128 KiB disk with 512 byte
+// sectors.
+func gptTable() *Table {
+    return &Table{
+        Label:      "gpt",
+        SectorSize: 512,
+        DiskSize:   128 << 10,
+        DiskID:     "8C5A1B2E-3F4D-4E6A-9B7C-0D1E2F3A4B5C",
+        Parts: []Partition{
+            {Number: 1, Start: 34 * 512, Size: 64 * 512, Type: esp, GUID: "11111111-2222-4333-8444-555555555555", Name: "EFI system"},
+            {Number: 2, Start: 98 * 512, Size: 124 * 512, Type: linuxFS, GUID: "66666666-7777-4888-9999-AAAAAAAAAAAA", Name: "phyOS root"},
+        },
+    }
+}
+
+// gpt4kTable is the table of gpt4k.img, a 256 KiB disk with 4096 byte
+// logical sectors, where the entries take 4 sectors instead of 32.
+func gpt4kTable() *Table {
+    return &Table{
+        Label:      "gpt",
+        SectorSize: 4096,
+        DiskSize:   256 << 10,
+        DiskID:     "0A1B2C3D-4E5F-4061-8273-8495A6B7C8D9",
+        Parts: []Partition{
+            {Number: 1, Start: 6 * 4096, Size: 52 * 4096, Type: linuxFS, GUID: "DEADBEEF-0000-4111-8222-333344445555", Name: "data"},
+        },
+    }
+}
+
+// mbrTable is the table of mbr.img, a 64 KiB disk with a legacy MBR.
+func mbrTable() *Table {
+    return &Table{
+        Label:      "dos",
+        SectorSize: 512,
+        DiskSize:   64 << 10,
+        DiskID:     "1234abcd",
+        Parts: []Partition{
+            {Number: 1, Start: 1 * 512, Size: 31 * 512, Type: "ef", Bootable: true},
+            {Number: 3, Start: 32 * 512, Size: 96 * 512, Type: "83"},
+        },
+    }
+}
+
+// fixture returns the image stored as testdata/name.gz. The images are
+// checked against the on-disk format by TestFixturesDecode, which does not
+// use this package, so they are not just what Write happens to produce.
+func fixture(t *testing.T, name string) image {
+    t.Helper()
+    f, err := os.Open(filepath.Join("testdata", name+".gz"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    zr, err := gzip.NewReader(f)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := io.ReadAll(zr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return image(data)
+}
+
+// written writes tab to a blank image of its size.
+func written(t *testing.T, tab *Table) image {
+    t.Helper()
+    img := make(image, tab.DiskSize)
+    if err := tab.Write(img); err != nil {
+        t.Fatal(err)
+    }
+    return img
+}
+
+// guid decodes the mixed-endian GUID at b: the first three fields are
+// little-endian, the last two big-endian.
+func guid(b []byte) string {
+    le := binary.LittleEndian
+    return fmt.Sprintf("%08X-%04X-%04X-%X-%X", le.Uint32(b[0:4]), le.Uint16(b[4:6]), le.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// checkGPTHeader decodes the header in LBA lba of img by the UEFI
+// specification and checks it against want, with the backup in LBA alt.
+// It returns the entry array the header points to.
+func checkGPTHeader(t *testing.T, name string, img image, want *Table, lba, alt int64) []byte {
+    t.Helper()
+    le := binary.LittleEndian
+    ss := want.SectorSize
+    last := want.DiskSize/ss - 1
+    entrySectors := 128 * 128 / ss
+    h := img[lba*ss : lba*ss+92]
+
+    zeroed := append([]byte(nil), h...)
+    copy(zeroed[16:20], make([]byte, 4))
+    entriesLBA := int64(le.Uint64(h[72:80]))
+    entries := img[entriesLBA*ss : entriesLBA*ss+128*128]
+    wantEntriesLBA := last - entrySectors
+    if lba == 1 {
+        wantEntriesLBA = 2
+    }
+    for _, c := range []struct {
+        field     string
+        got, want interface{}
+    }{
+        {"signature", string(h[0:8]), "EFI PART"},
+        {"revision", le.Uint32(h[8:12]), uint32(0x00010000)},
+        {"header size", le.Uint32(h[12:16]), uint32(92)},
+        {"header CRC32", le.Uint32(h[16:20]), crc32.ChecksumIEEE(zeroed)},
+        {"my LBA", int64(le.Uint64(h[24:32])), lba},
+        {"alternate LBA", int64(le.Uint64(h[32:40])), alt},
+        {"first usable LBA", int64(le.Uint64(h[40:48])), 2 + entrySectors},
+        {"last usable LBA", int64(le.Uint64(h[48:56])), last - 1 - entrySectors},
+        {"disk GUID", guid(h[56:72]), want.DiskID},
+        {"entries LBA", entriesLBA, wantEntriesLBA},
+        {"entry count", le.Uint32(h[80:84]), uint32(128)},
+        {"entry size", le.Uint32(h[84:88]), uint32(128)},
+        {"entries CRC32", le.Uint32(h[88:92]), crc32.ChecksumIEEE(entries)},
+    } {
+        if c.got != c.want {
+            t.Errorf("%s: header in LBA %d has %s %v, want %v", name, lba, c.field, c.got, c.want)
+        }
+    }
+    return entries
+}
+
+// TestFixturesDecode checks the fixture images byte by byte against the
+// GPT and MBR formats, independently of Read and Write.
+func TestFixturesDecode(t *testing.T) {
+    le := binary.LittleEndian
+    for name, tab := range map[string]func() *Table{"gpt512.img": gptTable, "gpt4k.img": gpt4kTable} {
+        want := tab()
+        img := fixture(t, name)
+        ss, last := want.SectorSize, want.DiskSize/want.SectorSize-1
+        primary := checkGPTHeader(t, name, img, want, 1, last)
+        backup := checkGPTHeader(t, name, img, want, last, 1)
+        if !bytes.Equal(primary, backup) {
+            t.Errorf("%s: backup entries differ from the primary ones", name)
+        }
+        used := make(map[int]bool)
+        for _, p := range want.Parts {
+            used[p.Number-1] = true
+            e := primary[(p.Number-1)*128 : p.Number*128]
+            var label []uint16
+            for i := 56; i < 128; i += 2 {
+                if c := le.Uint16(e[i:]); c != 0 {
+                    label = append(label, c)
+                }
+            }
+            switch {
+            case guid(e[0:16]) != p.Type:
+                t.Errorf("%s: entry %d has type %s, want %s", name, p.Number, guid(e[0:16]), p.Type)
+            case guid(e[16:32]) != p.GUID:
+                t.Errorf("%s: entry %d has GUID %s, want %s", name, p.Number, guid(e[16:32]), p.GUID)
+            case int64(le.Uint64(e[32:40])) != p.Start/ss || int64(le.Uint64(e[40:48])) != (p.Start+p.Size)/ss-1:
+                t.Errorf("%s: entry %d spans LBA %d-%d", name, p.Number, le.Uint64(e[32:40]), le.Uint64(e[40:48]))
+            case string(utf16.Decode(label)) != p.Name:
+                t.Errorf("%s: entry %d is named %q, want %q", name, p.Number, string(utf16.Decode(label)), p.Name)
+            }
+        }
+        for i := 0; i < 128; i++ {
+            if !used[i] && !isZero(primary[i*128:(i+1)*128]) {
+                t.Errorf("%s: unused entry %d is not empty", name, i+1)
+            }
+        }
+    }
+
+    want := mbrTable()
+    img := fixture(t, "mbr.img")
+    if img[510] != 0x55 || img[511] != 0xAA || le.Uint32(img[440:444]) != 0x1234abcd {
+        t.Errorf("mbr.img: signature %#x %#x, disk signature %#x", img[510], img[511], le.Uint32(img[440:444]))
+    }
+    used := make(map[int]bool)
+    for _, p := range want.Parts {
+        used[p.Number-1] = true
+        e := img[446+(p.Number-1)*16 : 446+p.Number*16]
+        boot := byte(0)
+        if p.Bootable {
+            boot = 0x80
+        }
+        if e[0] != boot || fmt.Sprintf("%02x", e[4]) != p.Type ||
+            int64(le.Uint32(e[8:12])) != p.Start/512 || int64(le.Uint32(e[12:16])) != p.Size/512 {
+            t.Errorf("mbr.img: entry %d is % x", p.Number, e)
+        }
+    }
+    for i := 0; i < 4; i++ {
+        if !used[i] && !isZero(img[446+i*16:446+(i+1)*16]) {
+            t.Errorf("mbr.img: unused entry %d is not empty", i+1)
+        }
+    }
+}
+
+func TestWriteMatchesFixtures(t *testing.T) {
+    for name, tab := range map[string]func() *Table{
+        "gpt512.img": gptTable,
+        "gpt4k.img":  gpt4kTable,
+        "mbr.img":    mbrTable,
+    } {
+        if got := written(t, tab()); !bytes.Equal(got, fixture(t, name)) {
+            t.Errorf("%s: written image differs from the fixture", name)
+        }
+    }
+}
+
+func TestRead(t *testing.T) {
+    for name, tab := range map[string]func() *Table{
+        "gpt512.img": gptTable,
+        "gpt4k.img":  gpt4kTable,
+        "mbr.img":    mbrTable,
+    } {
+        want := tab()
+        img := fixture(t, name)
+        got, err := Read(img, want.DiskSize, want.SectorSize)
+        if err != nil {
+            t.Errorf("%s: %v", name, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("%s: read %+v, want %+v", name, got, want)
+        }
+    }
+}
+
+func TestReadFallsBackToBackup(t *testing.T) {
+    // The fixture is gpt512.img with a byte of the primary header's disk
+    // GUID flipped, so its CRC32 no longer matches.
+    img := fixture(t, "gpt512-bad-primary.img")
+    good := fixture(t, "gpt512.img")
+    for i := range img {
+        if (img[i] != good[i]) != (i == 512+60) {
+            t.Fatalf("byte %d of the fixture is %#x, gpt512.img has %#x", i, img[i], good[i])
+        }
+    }
+    want := gptTable()
+    got, err := Read(img, want.DiskSize, want.SectorSize)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("read %+v, want %+v", got, want)
+    }
+
+    // Without a backup there is nothing left to read.
+    copy(img[len(img)-512:], make([]byte, 512))
+    if _, err := Read(img, want.DiskSize, want.SectorSize); err == nil || !strings.Contains(err.Error(), "backup GPT") {
+        t.Errorf("got %v, want an error about both headers", err)
+    }
+}
+
+func TestReadBadEntries(t *testing.T) {
+    // Damaged primary entries fail their CRC32 and the backup is used.
+    img := written(t, gptTable())
+    img[2*512+56] ^= 0xFF
+    got, err := Read(img, 128<<10, 512)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Parts[0].Name != "EFI system" {
+        t.Errorf("read name %q from the damaged entries", got.Parts[0].Name)
+    }
+}
+
+func TestProtectiveMBR(t *testing.T) {
+    for name, tab := range map[string]func() *Table{"gpt512.img": gptTable, "gpt4k.img": gpt4kTable} {
+        want := tab()
+        img := fixture(t, name)
+        e := img[446:462]
+        lbas := want.DiskSize / want.SectorSize
+        switch {
+        case img[510] != 0x55 || img[511] != 0xAA:
+            t.Errorf("%s: no MBR signature", name)
+        case e[4] != 0xEE:
+            t.Errorf("%s: first MBR entry has type %#x, want 0xee", name, e[4])
+        case le32(e[8:12]) != 1 || int64(le32(e[12:16])) != lbas-1:
+            t.Errorf("%s: protective entry covers LBA %d+%d, want 1+%d", name, le32(e[8:12]), le32(e[12:16]), lbas-1)
+        case !isZero(img[462:510]):
+            t.Errorf("%s: protective MBR has more than one entry", name)
+        }
+        if hdr := img[want.SectorSize : want.SectorSize+8]; string(hdr) != "EFI PART" {
+            t.Errorf("%s: no GPT header in LBA 1", name)
+        }
+    }
+}
+
+func TestLegacyMBR(t *testing.T) {
+    img := fixture(t, "mbr.img")
+    if img[446] != 0x80 || img[446+16] != 0 {
+        t.Errorf("boot flags %#x %#x, want 0x80 0", img[446], img[446+16])
+    }
+    if got := le32(img[440:444]); got != 0x1234abcd {
+        t.Errorf("disk signature %#x, want 0x1234abcd", got)
+    }
+
+    // An MBR written over a GPT wipes both GPT headers.
+    g := written(t, gptTable())
+    m := mbrTable()
+    m.DiskSize = int64(len(g))
+    if err := m.Write(g); err != nil {
+        t.Fatal(err)
+    }
+    if !isZero(g[512:1024]) || !isZero(g[len(g)-512:]) {
+        t.Error("GPT headers survived writing an MBR")
+    }
+    got, err := Read(g, m.DiskSize, 512)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Label != "dos" || len(got.Parts) != 2 {
+        t.Errorf("read %+v after writing an MBR", got)
+    }
+}
+
+func TestReadNoTable(t *testing.T) {
+    if _, err := Read(make(image, 64<<10), 64<<10, 512); !errors.Is(err, ErrNoTable) {
+        t.Errorf("got %v, want ErrNoTable", err)
+    }
+}
+
+func TestWriteRejectsBadLayouts(t *testing.T) {
+    cases := []struct {
+        name string
+        edit func(*Table)
+        want string
+    }{
+        {"gpt overlap", func(t *Table) { t.Parts[1].Start = 90 * 512 }, "overlap"},
+        {"gpt before first usable", func(t *Table) { t.Parts[0].Start = 33 * 512 }, "outside the usable sectors"},
+        {"gpt after last usable", func(t *Table) { t.Parts[1].Size = 126 * 512 }, "outside the usable sectors"},
+        {"gpt negative start", func(t *Table) { t.Parts[0].Start = -512 }, "outside the usable sectors"},
+        {"gpt huge size", func(t *Table) { t.Parts[1].Size = 1 << 62 }, "outside the usable sectors"},
+        {"gpt unaligned", func(t *Table) { t.Parts[0].Size = 100 }, "whole number of sectors"},
+        {"gpt duplicate number", func(t *Table) { t.Parts[1].Number = 1 }, "listed twice"},
+        {"gpt number range", func(t *Table) { t.Parts[1].Number = 129 }, "out of range"},
+        {"gpt too small", func(t *Table) { t.DiskSize = 67 * 512; t.Parts = nil }, "too small"},
+        {"mbr overlap", func(t *Table) { *t = *mbrTable(); t.Parts[1].Start = 16 * 512 }, "overlap"},
+        {"mbr beyond disk", func(t *Table) { *t = *mbrTable(); t.Parts[1].Size = 97 * 512 }, "outside the usable sectors"},
+        {"mbr sector zero", func(t *Table) { *t = *mbrTable(); t.Parts[0].Start = 0 }, "outside the usable sectors"},
+        {"mbr number range", func(t *Table) { *t = *mbrTable(); t.Parts[1].Number = 5 }, "out of range"},
+    }
+    for _, c := range cases {
+        tab := gptTable()
+        c.edit(tab)
+        img := make(image, 128<<10)
+        err := tab.Write(img)
+        if err == nil || !strings.Contains(err.Error(), c.want) {
+            t.Errorf("%s: got %v, want an error containing %q", c.name, err, c.want)
+        }
+        if !isZero(img) {
+            t.Errorf("%s: the image was written to", c.name)
+        }
+    }
+}
+
+func TestWriteGeneratesIDs(t *testing.T) {
+    tab := gptTable()
+    tab.DiskID, tab.Parts[0].GUID = "", ""
+    img := written(t, tab)
+    if tab.DiskID == "" || tab.Parts[0].GUID == "" {
+        t.Fatal("missing GUIDs were not generated")
+    }
+    got, err := Read(img, tab.DiskSize, tab.SectorSize)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.DiskID != tab.DiskID || got.Parts[0].GUID != tab.Parts[0].GUID {
+        t.Errorf("read %s %s, want the generated %s %s", got.DiskID, got.Parts[0].GUID, tab.DiskID, tab.Parts[0].GUID)
+    }
+}
+
+func le32(b []byte) uint32 {
+    return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
@@ -45,6 +45,36 @@ func (d itemDelegate) Render(w io.Writer, m list.Model, index int, listItem list
 	fmt.Fprint(w, fn(str))
 }
 
+// localeDelegate renders like itemDelegate and marks the locales in extra.
+type localeDelegate struct {
+	extra map[string]bool
+}
+
+func (d localeDelegate) Height() int                               { return 1 }
+func (d localeDelegate) Spacing() int                              { return 0 }
+func (d localeDelegate) Update(msg tea.Msg, m *list.Model) tea.Cmd { return nil }
+func (d localeDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
+	i, ok := listItem.(item)
+	if !ok {
+		return
+	}
+	mark := "[ ]"
+	if d.extra[string(i)] {
+		mark = "[x]"
+	}
+	itemDelegate{}.Render(w, m, index, item(mark+" "+string(i)))
+}
+
+// hasItem reports whether items holds s.
+func hasItem(items []list.Item, s string) bool {
+	for _, it := range items {
+		if it == item(s) {
+			return true
+		}
+	}
+	return false
+}
+
 type listModel struct {
 	list     list.Model
 	choice   string
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "regexp"
+    "strings"
+)
+
+// defaultLocale is offered when the live system does not say which locale
+// it runs in.
+const defaultLocale = "en_US.UTF-8"
+
+// localeSources are read in order for the locales glibc can generate. The
+// list in i18n has every one of them; locale.gen, where the package ships it,
+// has them commented out.
+var localeSources = []string{"/usr/share/i18n/SUPPORTED", "/etc/locale.gen"}
+
+var localeName = regexp.MustCompile(`^[A-Za-z]+(_[A-Za-z]+)?(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$`)
+
+// supportedLocales returns the "<locale> <charset>" lines of the first of
+// localeSources that can be read, or nil when none can.
+func supportedLocales() []string {
+    for _, src := range localeSources {
+        data, err := os.ReadFile(src)
+        if err != nil {
+            continue
+        }
+        var out []string
+        for _, l := range strings.Split(string(data), "\n") {
+            // Commented locales in locale.gen start right after the "#";
+            // the comments around them have a space there.
+            l = strings.TrimPrefix(l, "#")
+            if f := strings.Fields(l); len(f) == 2 && !strings.HasPrefix(l, " ") && localeName.MatchString(f[0]) {
+                out = append(out, f[0]+" "+f[1])
+            }
+        }
+        if len(out) > 0 {
+            return out
+        }
+    }
+    return nil
+}
+
+// localeGenLine is the locale.gen line of name. The charset comes from
+// supported when it lists name, else from the codeset in the name the way
+// glibc names them, else it is the Latin-1 glibc assumes.
+func localeGenLine(name string, supported []string) string {
+    for _, l := range supported {
+        if f := strings.Fields(l); f[0] == name {
+            return l
+        }
+    }
+    lang, mod, _ := strings.Cut(name, "@")
+    if _, codeset, ok := strings.Cut(lang, "."); ok {
+        if c := strings.ToLower(strings.ReplaceAll(codeset, "-", "")); c == "utf8" {
+            codeset = "UTF-8"
+        }
+        return name + " " + codeset
+    }
+    if mod == "euro" {
+        return name + " ISO-8859-15"
+    }
+    return name + " ISO-8859-1"
+}
+
+// validateLocales checks the locale and the extra locales to generate.
+func validateLocales(c *InstallConfig) error {
+    if c.Locale != "" && !localeName.MatchString(c.Locale) {
+        return fmt.Errorf("locale %q is not a locale name", c.Locale)
+    }
+    for i, l := range c.ExtraLocales {
+        if !localeName.MatchString(l) {
+            return fmt.Errorf("extra_locales[%d]: %q is not a locale name", i, l)
+        }
+    }
+    return nil
+}
+
+// generatedLocales is the locale of cfg followed by its extra locales, each
+// listed once.
+func generatedLocales(cfg *InstallConfig) []string {
+    var out []string
+    seen := make(map[string]bool)
+    for _, l := range append([]string{cfg.Locale}, cfg.ExtraLocales...) {
+        if l != "" && !seen[l] {
+            seen[l] = true
+            out = append(out, l)
+        }
+    }
+    return out
+}
+
+// localeGenText renders the locale.gen of the installed system.
+func localeGenText(locales, supported []string) string {
+    var b strings.Builder
+    b.WriteString("# /etc/locale.gen, generated by the phyOS installer\n\n")
+    for _, l := range locales {
+        b.WriteString(localeGenLine(l, supported) + "\n")
+    }
+    return b.String()
+}
+
+// localeOps writes locale.gen and locale.conf into the target mounted at
+// root and generates the locales there.
+func localeOps(cfg *InstallConfig, root string) []Operation {
+    locales := generatedLocales(cfg)
+    if len(locales) == 0 {
+        return nil
+    }
+    etc := path.Join(root, "etc")
+    supported := supportedLocales()
+    ops := []Operation{
+        newCmdOp("mkdirTarget", etc),
+        newFileOp(path.Join(etc, "locale.gen"), func(Runner) string { return localeGenText(locales, supported) }),
+    }
+    if cfg.Locale != "" {
+        ops = append(ops, newFileOp(path.Join(etc, "locale.conf"), func(Runner) string { return "LANG=" + cfg.Locale + "\n" }))
+    }
+    return append(ops, newCmdOp("localeGen", root))
+}
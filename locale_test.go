@@ -0,0 +1,31 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLocaleOps(t *testing.T) {
+    supported := filepath.Join(t.TempDir(), "SUPPORTED")
+    if err := os.WriteFile(supported, []byte("de_DE.UTF-8 UTF-8\nde_DE ISO-8859-1\nde_DE@euro ISO-8859-15\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    defer func(old []string) { localeSources = old }(localeSources)
+    localeSources = []string{supported}
+
+    root := testRoot(t)
+    cfg := &InstallConfig{Locale: "de_DE.UTF-8", ExtraLocales: []string{"de_DE@euro", "en_GB.utf8", "de_DE.UTF-8"}}
+    applyInRoot(t, localeOps(cfg, root))
+
+    want := "# /etc/locale.gen, generated by the phyOS installer\n\n" +
+        "de_DE.UTF-8 UTF-8\n" +
+        "de_DE@euro ISO-8859-15\n" +
+        "en_GB.utf8 UTF-8\n"
+    if got := readTarget(t, root, "etc/locale.gen"); got != want {
+        t.Errorf("locale.gen is\n%s\nwant\n%s", got, want)
+    }
+    if got, want := readTarget(t, root, "etc/locale.conf"), "LANG=de_DE.UTF-8\n"; got != want {
+        t.Errorf("locale.conf is %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// luksDefaults are used for the encryption settings an answers file leaves
+// out.
+var luksDefaults = EncryptionConfig{
+    Type:     "luks2",
+    Cipher:   "aes-xts-plain64",
+    KeySize:  512,
+    PBKDF:    "argon2id",
+    IterTime: 2000,
+}
+
+// withDefaults fills in the empty settings of e. luks1 only knows pbkdf2,
+// so that is its default.
+func (e EncryptionConfig) withDefaults() EncryptionConfig {
+    if e.Type == "" {
+        e.Type = luksDefaults.Type
+    }
+    if e.Cipher == "" {
+        e.Cipher = luksDefaults.Cipher
+    }
+    if e.KeySize == 0 {
+        e.KeySize = luksDefaults.KeySize
+    }
+    if e.PBKDF == "" {
+        e.PBKDF = luksDefaults.PBKDF
+        if e.Type == "luks1" {
+            e.PBKDF = "pbkdf2"
+        }
+    }
+    if e.IterTime == 0 {
+        e.IterTime = luksDefaults.IterTime
+    }
+    return e
+}
+
+func (e EncryptionConfig) validate() error {
+    switch e.Type {
+    case "luks1":
+        if e.PBKDF != "pbkdf2" {
+            return fmt.Errorf("luks1 only supports the pbkdf2 pbkdf, not %q", e.PBKDF)
+        }
+    case "luks2":
+        if e.PBKDF != "pbkdf2" && e.PBKDF != "argon2id" && e.PBKDF != "argon2i" {
+            return fmt.Errorf("pbkdf must be argon2id, argon2i or pbkdf2, not %q", e.PBKDF)
+        }
+    default:
+        return fmt.Errorf("type must be luks1 or luks2, not %q", e.Type)
+    }
+    if e.KeySize <= 0 || e.KeySize%8 != 0 {
+        return fmt.Errorf("key_size %d must be a positive multiple of 8", e.KeySize)
+    }
+    if e.IterTime < 0 {
+        return fmt.Errorf("iter_time_ms cannot be negative")
+    }
+    return nil
+}
+
+// luksOps formats dev as a LUKS container and opens it.
+func luksOps(dev string, e EncryptionConfig) []Operation {
+    e = e.withDefaults()
+    return []Operation{
+        newStdinOp("luksFormat", e.Passphrase, e.Type, e.Cipher, e.KeySize, e.PBKDF, e.IterTime, dev),
+        newStdinOp("luksOpen", e.Passphrase, dev, e.Mapper),
+    }
+}
+
+// LUKSVolume is an encrypted device of the installed system, as crypttab
+// and the kernel command line need to know it.
+type LUKSVolume struct {
+    Device string
+    Mapper string
+    Type   string
+    // Root is set when the root filesystem lives inside the container, so
+    // the initramfs has to unlock it.
+    Root bool
+    // Swap marks a plain dm-crypt swap partition keyed from /dev/urandom.
+    Swap bool
+}
+
+// luksVolumes lists the containers cfg creates, followed by its encrypted
+// swap partitions.
+func luksVolumes(cfg *InstallConfig) []LUKSVolume {
+    d := cfg.Disk
+    var swaps []LUKSVolume
+    for _, p := range d.Partitions {
+        if p.Encrypt && p.Mountpoint == "swap" {
+            name := "cryptswap"
+            if len(swaps) > 0 {
+                name += strconv.Itoa(len(swaps))
+            }
+            swaps = append(swaps, LUKSVolume{Device: p.Device, Mapper: name, Type: "plain", Swap: true})
+        }
+    }
+    if !d.Encryption.Enabled || d.Target == "" {
+        return swaps
+    }
+    e := d.Encryption.withDefaults()
+    v := LUKSVolume{Device: d.Target, Mapper: e.Mapper, Type: e.Type}
+    for _, m := range mountEntries(cfg) {
+        if m.Mountpoint == "/" && inLUKS(d, m.Device) {
+            v.Root = true
+        }
+    }
+    return append([]LUKSVolume{v}, swaps...)
+}
+
+// inLUKS reports whether dev lives inside the LUKS container of d.
+func inLUKS(d DiskConfig, dev string) bool {
+    if !d.Encryption.Enabled || d.Target == "" {
+        return false
+    }
+    return dev == "/dev/mapper/"+d.Encryption.Mapper ||
+        d.LVM.Enabled && strings.HasPrefix(dev, "/dev/"+d.LVM.VolumeGroup+"/")
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// PhysicalVolume, VolumeGroup and LogicalVolume are the rows of the pvs, vgs
+// and lvs reports. Sizes are in bytes.
+type PhysicalVolume struct {
+    Name string   `json:"pv_name"`
+    VG   string   `json:"vg_name"`
+    Size lsblkNum `json:"pv_size"`
+    Free lsblkNum `json:"pv_free"`
+}
+
+type VolumeGroup struct {
+    Name        string   `json:"vg_name"`
+    Size        lsblkNum `json:"vg_size"`
+    Free        lsblkNum `json:"vg_free"`
+    ExtentSize  lsblkNum `json:"vg_extent_size"`
+    Extents     lsblkNum `json:"vg_extent_count"`
+    FreeExtents lsblkNum `json:"vg_free_count"`
+}
+
+// LogicalVolume.Pool is the thin pool of a thin volume, empty otherwise.
+type LogicalVolume struct {
+    Name string   `json:"lv_name"`
+    VG   string   `json:"vg_name"`
+    Path string   `json:"lv_path"`
+    Size lsblkNum `json:"lv_size"`
+    Attr string   `json:"lv_attr"`
+    Pool string   `json:"pool_lv"`
+}
+
+// isThinPool reads the volume type from the first lv_attr character.
+func (lv LogicalVolume) isThinPool() bool {
+    return strings.HasPrefix(lv.Attr, "t")
+}
+
+// LVMState is what LVM knows about the machine, or what it will know once
+// the queued LVMOps have run.
+type LVMState struct {
+    PVs []PhysicalVolume
+    VGs []VolumeGroup
+    LVs []LogicalVolume
+}
+
+// ListLVM reads the physical volumes, volume groups and logical volumes from
+// the JSON reports of pvs, vgs and lvs.
+func ListLVM(r Runner) (*LVMState, error) {
+    s := &LVMState{}
+    if err := lvmReport(r, "lvmPvs", "pv", &s.PVs); err != nil {
+        return nil, err
+    }
+    if err := lvmReport(r, "lvmVgs", "vg", &s.VGs); err != nil {
+        return nil, err
+    }
+    if err := lvmReport(r, "lvmLvs", "lv", &s.LVs); err != nil {
+        return nil, err
+    }
+    s.sort()
+    return s, nil
+}
+
+// lvmReport decodes the rows of section from the report printed by
+// commands[key] into rows.
+func lvmReport(r Runner, key, section string, rows interface{}) error {
+    out, err := r.Output(commands[key])
+    if err != nil {
+        return fmt.Errorf("[ListLVM] %s: %w", key, err)
+    }
+    var rep struct {
+        Report []map[string]json.RawMessage `json:"report"`
+    }
+    if err := json.Unmarshal(out, &rep); err != nil {
+        return fmt.Errorf("[ListLVM] %s: %w", key, err)
+    }
+    for _, sec := range rep.Report {
+        if raw, ok := sec[section]; ok {
+            if err := json.Unmarshal(raw, rows); err != nil {
+                return fmt.Errorf("[ListLVM] %s: %w", key, err)
+            }
+        }
+    }
+    return nil
+}
+
+func (s *LVMState) sort() {
+    sort.Slice(s.PVs, func(i, j int) bool { return s.PVs[i].Name < s.PVs[j].Name })
+    sort.Slice(s.VGs, func(i, j int) bool { return s.VGs[i].Name < s.VGs[j].Name })
+    sort.Slice(s.LVs, func(i, j int) bool {
+        if s.LVs[i].VG != s.LVs[j].VG {
+            return s.LVs[i].VG < s.LVs[j].VG
+        }
+        return s.LVs[i].Name < s.LVs[j].Name
+    })
+}
+
+func (s *LVMState) clone() *LVMState {
+    return &LVMState{
+        PVs: append([]PhysicalVolume(nil), s.PVs...),
+        VGs: append([]VolumeGroup(nil), s.VGs...),
+        LVs: append([]LogicalVolume(nil), s.LVs...),
+    }
+}
+
+func (s *LVMState) pv(name string) *PhysicalVolume {
+    for i := range s.PVs {
+        if s.PVs[i].Name == name {
+            return &s.PVs[i]
+        }
+    }
+    return nil
+}
+
+func (s *LVMState) vg(name string) *VolumeGroup {
+    for i := range s.VGs {
+        if s.VGs[i].Name == name {
+            return &s.VGs[i]
+        }
+    }
+    return nil
+}
+
+func (s *LVMState) lv(vg, name string) *LogicalVolume {
+    for i := range s.LVs {
+        if s.LVs[i].VG == vg && s.LVs[i].Name == name {
+            return &s.LVs[i]
+        }
+    }
+    return nil
+}
+
+// findVolume looks up path in blockDevices. Logical volumes may be given as
+// /dev/vg/lv, which lsblk lists under their device-mapper name instead.
+func findVolume(path string) *BlockDevice {
+    if d := FindDevice(blockDevices, path); d != nil {
+        return d
+    }
+    parts := strings.Split(strings.TrimPrefix(path, "/dev/"), "/")
+    if len(parts) != 2 || parts[0] == "mapper" {
+        return nil
+    }
+    mapper := strings.ReplaceAll(parts[0], "-", "--") + "-" + strings.ReplaceAll(parts[1], "-", "--")
+    return FindDevice(blockDevices, "/dev/mapper/"+mapper)
+}
+
+// pvDevice returns the block device a new physical volume goes on. It has
+// to exist and hold nothing: no filesystem or signature, no partitions and
+// nothing mounted.
+func pvDevice(path string) (*BlockDevice, error) {
+    d := FindDevice(blockDevices, path)
+    switch {
+    case d == nil:
+        return nil, fmt.Errorf("%s is not a block device", path)
+    case bool(d.ReadOnly):
+        return nil, fmt.Errorf("%s is read-only", path)
+    case d.InUse():
+        return nil, fmt.Errorf("%s or a device on it is mounted", path)
+    case len(d.Children) > 0:
+        return nil, fmt.Errorf("%s is in use by %s", path, d.Children[0].Path)
+    case d.FSType != "":
+        return nil, fmt.Errorf("%s already holds %s", path, d.FSType)
+    }
+    return d, nil
+}
+
+// lvmFor returns s with the LVM operations in ops applied.
+func lvmFor(s *LVMState, ops []LVMOp) (*LVMState, error) {
+    out := s.clone()
+    for _, op := range ops {
+        if err := out.apply(op); err != nil {
+            return out, err
+        }
+    }
+    out.sort()
+    return out, nil
+}
+
+type lvmOpKind int
+
+const (
+    lvmCreatePV lvmOpKind = iota
+    lvmRemovePV
+    lvmCreateVG
+    lvmExtendVG
+    lvmRenameVG
+    lvmRemoveVG
+    lvmCreateLV
+    lvmResizeLV
+    lvmRenameLV
+    lvmRemoveLV
+    lvmCreateThinPool
+    lvmCreateThinLV
+    lvmSnapshotLV
+)
+
+// LVMOp is a pending change to physical volumes, volume groups or logical
+// volumes. PV names the device for the PV operations and the device added
+// by create and extend; Size is in bytes and rounded down to whole MiB.
+// Thin volumes go into Pool. A snapshot of LV is named NewName and needs a
+// Size unless LV is a thin volume.
+type LVMOp struct {
+    Kind    lvmOpKind
+    PV      string
+    VG      string
+    LV      string
+    Pool    string
+    NewName string
+    Size    int64
+}
+
+func (o LVMOp) Describe() string {
+    return o.String()
+}
+
+func (o LVMOp) Apply(r Runner) error {
+    switch o.Kind {
+    case lvmCreatePV:
+        return runCommand(r, "lvmCreatePv", o.PV)
+    case lvmRemovePV:
+        return runCommand(r, "lvmRemovePv", o.PV)
+    case lvmCreateVG:
+        return runCommand(r, "lvmCreateVg", o.VG, o.PV)
+    case lvmExtendVG:
+        return runCommand(r, "lvmExtendVg", o.VG, o.PV)
+    case lvmRenameVG:
+        return runCommand(r, "lvmRenameVg", o.VG, o.NewName)
+    case lvmRemoveVG:
+        return runCommand(r, "lvmRemoveVg", o.VG)
+    case lvmCreateLV:
+        return runCommand(r, "lvmCreateLv", sizeArg(o.Size), o.LV, o.VG)
+    case lvmResizeLV:
+        return runCommand(r, "lvmResizeLv", sizeArg(o.Size), o.VG+"/"+o.LV)
+    case lvmRenameLV:
+        return runCommand(r, "lvmRenameLv", o.VG, o.LV, o.NewName)
+    case lvmRemoveLV:
+        return runCommand(r, "lvmRemoveLv", o.VG+"/"+o.LV)
+    case lvmCreateThinPool:
+        return runCommand(r, "lvmCreateThinPool", sizeArg(o.Size), o.LV, o.VG)
+    case lvmCreateThinLV:
+        return runCommand(r, "lvmCreateThinLv", sizeArg(o.Size), o.LV, o.VG+"/"+o.Pool)
+    case lvmSnapshotLV:
+        if o.Size == 0 {
+            return runCommand(r, "lvmSnapshotThin", o.NewName, o.VG+"/"+o.LV)
+        }
+        return runCommand(r, "lvmSnapshot", sizeArg(o.Size), o.NewName, o.VG+"/"+o.LV)
+    }
+    return fmt.Errorf("[LVMOp] Unknown operation %d", o.Kind)
+}
+
+func (o LVMOp) String() string {
+    switch o.Kind {
+    case lvmCreatePV:
+        return "Create physical volume on " + o.PV
+    case lvmRemovePV:
+        return "Remove physical volume " + o.PV
+    case lvmCreateVG:
+        return fmt.Sprintf("Create volume group %s on %s", o.VG, o.PV)
+    case lvmExtendVG:
+        return fmt.Sprintf("Add %s to volume group %s", o.PV, o.VG)
+    case lvmRenameVG:
+        return fmt.Sprintf("Rename volume group %s to %s", o.VG, o.NewName)
+    case lvmRemoveVG:
+        return "Remove volume group " + o.VG
+    case lvmCreateLV:
+        return fmt.Sprintf("Create logical volume %s/%s, %s", o.VG, o.LV, humanSize(o.Size))
+    case lvmResizeLV:
+        return fmt.Sprintf("Resize logical volume %s/%s to %s", o.VG, o.LV, humanSize(o.Size))
+    case lvmRenameLV:
+        return fmt.Sprintf("Rename logical volume %s/%s to %s", o.VG, o.LV, o.NewName)
+    case lvmRemoveLV:
+        return fmt.Sprintf("Remove logical volume %s/%s", o.VG, o.LV)
+    case lvmCreateThinPool:
+        return fmt.Sprintf("Create thin pool %s/%s, %s", o.VG, o.LV, humanSize(o.Size))
+    case lvmCreateThinLV:
+        return fmt.Sprintf("Create thin volume %s/%s in %s, %s virtual", o.VG, o.LV, o.Pool, humanSize(o.Size))
+    case lvmSnapshotLV:
+        if o.Size == 0 {
+            return fmt.Sprintf("Snapshot %s/%s as %s", o.VG, o.LV, o.NewName)
+        }
+        return fmt.Sprintf("Snapshot %s/%s as %s, %s for changes", o.VG, o.LV, o.NewName, humanSize(o.Size))
+    }
+    return "Unknown LVM operation"
+}
+
+// apply performs op on the state, refusing what LVM itself would refuse.
+// Space is accounted in bytes; the extent rounding LVM does is ignored.
+func (s *LVMState) apply(op LVMOp) error {
+    switch op.Kind {
+    case lvmCreatePV:
+        if s.pv(op.PV) != nil {
+            return fmt.Errorf("%s is already a physical volume", op.PV)
+        }
+        d, err := pvDevice(op.PV)
+        if err != nil {
+            return err
+        }
+        s.PVs = append(s.PVs, PhysicalVolume{Name: op.PV, Size: d.Size, Free: d.Size})
+    case lvmRemovePV:
+        pv := s.pv(op.PV)
+        if pv == nil {
+            return fmt.Errorf("%s is not a physical volume", op.PV)
+        }
+        if pv.VG != "" {
+            return fmt.Errorf("%s belongs to volume group %s", op.PV, pv.VG)
+        }
+        for i := range s.PVs {
+            if &s.PVs[i] == pv {
+                s.PVs = append(s.PVs[:i], s.PVs[i+1:]...)
+                break
+            }
+        }
+    case lvmCreateVG, lvmExtendVG:
+        pv := s.pv(op.PV)
+        if pv == nil {
+            return fmt.Errorf("%s is not a physical volume", op.PV)
+        }
+        if pv.VG != "" {
+            return fmt.Errorf("%s already belongs to volume group %s", op.PV, pv.VG)
+        }
+        vg := s.vg(op.VG)
+        if op.Kind == lvmCreateVG {
+            if vg != nil {
+                return fmt.Errorf("Volume group %s already exists", op.VG)
+            }
+            if err := checkLVMName(op.VG); err != nil {
+                return err
+            }
+            s.VGs = append(s.VGs, VolumeGroup{Name: op.VG})
+            vg = &s.VGs[len(s.VGs)-1]
+        } else if vg == nil {
+            return fmt.Errorf("There is no volume group %s", op.VG)
+        }
+        pv.VG = op.VG
+        vg.Size += pv.Size
+        vg.Free += pv.Free
+    case lvmRenameVG:
+        vg := s.vg(op.VG)
+        if vg == nil {
+            return fmt.Errorf("There is no volume group %s", op.VG)
+        }
+        if s.vg(op.NewName) != nil {
+            return fmt.Errorf("Volume group %s already exists", op.NewName)
+        }
+        if err := checkLVMName(op.NewName); err != nil {
+            return err
+        }
+        vg.Name = op.NewName
+        for i := range s.PVs {
+            if s.PVs[i].VG == op.VG {
+                s.PVs[i].VG = op.NewName
+            }
+        }
+        for i := range s.LVs {
+            if s.LVs[i].VG == op.VG {
+                s.LVs[i].VG = op.NewName
+                s.LVs[i].Path = "/dev/" + op.NewName + "/" + s.LVs[i].Name
+            }
+        }
+    case lvmRemoveVG:
+        if s.vg(op.VG) == nil {
+            return fmt.Errorf("There is no volume group %s", op.VG)
+        }
+        var lvs []LogicalVolume
+        for _, lv := range s.LVs {
+            if lv.VG != op.VG {
+                lvs = append(lvs, lv)
+            }
+        }
+        var vgs []VolumeGroup
+        for _, vg := range s.VGs {
+            if vg.Name != op.VG {
+                vgs = append(vgs, vg)
+            }
+        }
+        for i := range s.PVs {
+            if s.PVs[i].VG == op.VG {
+                s.PVs[i].VG, s.PVs[i].Free = "", s.PVs[i].Size
+            }
+        }
+        s.LVs, s.VGs = lvs, vgs
+    case lvmCreateLV, lvmCreateThinPool:
+        vg := s.vg(op.VG)
+        if vg == nil {
+            return fmt.Errorf("There is no volume group %s", op.VG)
+        }
+        if s.lv(op.VG, op.LV) != nil {
+            return fmt.Errorf("Logical volume %s/%s already exists", op.VG, op.LV)
+        }
+        if err := checkLVMName(op.LV); err != nil {
+            return err
+        }
+        if op.Size < mib || op.Size > int64(vg.Free) {
+            return fmt.Errorf("%s does not fit, %s is free in %s", humanSize(op.Size), humanSize(int64(vg.Free)), op.VG)
+        }
+        vg.Free -= lsblkNum(op.Size)
+        attr := "-wi-------"
+        if op.Kind == lvmCreateThinPool {
+            attr = "twi-------"
+        }
+        s.LVs = append(s.LVs, LogicalVolume{Name: op.LV, VG: op.VG, Path: "/dev/" + op.VG + "/" + op.LV, Size: lsblkNum(op.Size), Attr: attr})
+    case lvmCreateThinLV:
+        pool := s.lv(op.VG, op.Pool)
+        if pool == nil || !pool.isThinPool() {
+            return fmt.Errorf("%s/%s is not a thin pool", op.VG, op.Pool)
+        }
+        if s.lv(op.VG, op.LV) != nil {
+            return fmt.Errorf("Logical volume %s/%s already exists", op.VG, op.LV)
+        }
+        if err := checkLVMName(op.LV); err != nil {
+            return err
+        }
+        if op.Size < mib {
+            return fmt.Errorf("Logical volumes must be at least 1 MiB")
+        }
+        s.LVs = append(s.LVs, LogicalVolume{Name: op.LV, VG: op.VG, Path: "/dev/" + op.VG + "/" + op.LV, Size: lsblkNum(op.Size), Attr: "Vwi-------", Pool: op.Pool})
+    case lvmSnapshotLV:
+        origin, vg := s.lv(op.VG, op.LV), s.vg(op.VG)
+        if origin == nil || vg == nil || origin.isThinPool() {
+            return fmt.Errorf("There is no logical volume %s/%s to snapshot", op.VG, op.LV)
+        }
+        if s.lv(op.VG, op.NewName) != nil {
+            return fmt.Errorf("Logical volume %s/%s already exists", op.VG, op.NewName)
+        }
+        if err := checkLVMName(op.NewName); err != nil {
+            return err
+        }
+        snap := LogicalVolume{Name: op.NewName, VG: op.VG, Path: "/dev/" + op.VG + "/" + op.NewName, Size: origin.Size, Attr: "Vwi---tz-k", Pool: origin.Pool}
+        if origin.Pool == "" {
+            if op.Size < mib || op.Size > int64(vg.Free) {
+                return fmt.Errorf("%s does not fit, %s is free in %s", humanSize(op.Size), humanSize(int64(vg.Free)), op.VG)
+            }
+            vg.Free -= lsblkNum(op.Size)
+            snap.Size, snap.Attr = lsblkNum(op.Size), "swi-a-s---"
+        }
+        s.LVs = append(s.LVs, snap)
+    case lvmResizeLV:
+        lv, vg := s.lv(op.VG, op.LV), s.vg(op.VG)
+        if lv == nil || vg == nil {
+            return fmt.Errorf("There is no logical volume %s/%s", op.VG, op.LV)
+        }
+        if op.Size < mib {
+            return fmt.Errorf("Logical volumes must be at least 1 MiB")
+        }
+        if lv.Pool == "" {
+            if op.Size > int64(lv.Size+vg.Free) {
+                return fmt.Errorf("%s does not fit, at most %s is available", humanSize(op.Size), humanSize(int64(lv.Size+vg.Free)))
+            }
+            vg.Free += lv.Size - lsblkNum(op.Size)
+        }
+        lv.Size = lsblkNum(op.Size)
+    case lvmRenameLV:
+        lv := s.lv(op.VG, op.LV)
+        if lv == nil {
+            return fmt.Errorf("There is no logical volume %s/%s", op.VG, op.LV)
+        }
+        if s.lv(op.VG, op.NewName) != nil {
+            return fmt.Errorf("Logical volume %s/%s already exists", op.VG, op.NewName)
+        }
+        if err := checkLVMName(op.NewName); err != nil {
+            return err
+        }
+        for i := range s.LVs {
+            if s.LVs[i].VG == op.VG && s.LVs[i].Pool == op.LV {
+                s.LVs[i].Pool = op.NewName
+            }
+        }
+        lv.Name, lv.Path = op.NewName, "/dev/"+op.VG+"/"+op.NewName
+    case lvmRemoveLV:
+        lv, vg := s.lv(op.VG, op.LV), s.vg(op.VG)
+        if lv == nil || vg == nil {
+            return fmt.Errorf("There is no logical volume %s/%s", op.VG, op.LV)
+        }
+        // Removing a pool takes its thin volumes with it; thin volumes
+        // give nothing back to the group.
+        var lvs []LogicalVolume
+        for _, other := range s.LVs {
+            if other.VG == op.VG && (other.Name == op.LV || lv.isThinPool() && other.Pool == op.LV) {
+                if other.Pool == "" {
+                    vg.Free += other.Size
+                }
+                continue
+            }
+            lvs = append(lvs, other)
+        }
+        s.LVs = lvs
+    default:
+        return fmt.Errorf("Unknown LVM operation %d", op.Kind)
+    }
+    return nil
+}
+
+// checkLVMName applies the rules LVM has for VG and LV names.
+func checkLVMName(name string) error {
+    if name == "" || name == "." || name == ".." || name[0] == '-' || len(name) > 127 {
+        return fmt.Errorf("%q is not a valid LVM name", name)
+    }
+    for _, c := range name {
+        ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '_' || c == '.' || c == '-'
+        if !ok {
+            return fmt.Errorf("%q is not a valid LVM name: only letters, digits and +_.- are allowed", name)
+        }
+    }
+    return nil
+}
+
+// lvmSize is a size lvcreate -L accepts: a number with an optional unit.
+var lvmSize = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[bBsSkKmMgGtTpPeE]?$`)
+
+func checkLVMSize(s string) error {
+    if !lvmSize.MatchString(s) {
+        return fmt.Errorf("%q is not a size such as 20G or 512M", s)
+    }
+    return nil
+}
+
+// rootVolume returns the LV of l mounted at /.
+func rootVolume(l LVMConfig) *LogicalVolumeConfig {
+    for i := range l.Volumes {
+        if l.Volumes[i].Mountpoint == "/" {
+            return &l.Volumes[i]
+        }
+    }
+    return nil
+}
+
+// validateVolumes checks the LVs of the default stack. Thin volumes take no
+// space from the group, so they may follow the volume that takes the rest.
+func validateVolumes(l LVMConfig) error {
+    names := make(map[string]bool)
+    pools := make(map[string]bool)
+    rest := ""
+    for i, lv := range l.Volumes {
+        if lv.Name == "" || lv.Size == "" {
+            return fmt.Errorf("disk.lvm.volumes[%d] needs a name and a size", i)
+        }
+        if err := checkLVMName(lv.Name); err != nil {
+            return fmt.Errorf("disk.lvm.volumes[%d]: %w", i, err)
+        }
+        if lv.Size != "rest" {
+            if err := checkLVMSize(lv.Size); err != nil {
+                return fmt.Errorf("disk.lvm.volumes[%d].size: %w", i, err)
+            }
+        }
+        if names[lv.Name] {
+            return fmt.Errorf("disk.lvm.volumes[%d]: %s is listed twice", i, lv.Name)
+        }
+        names[lv.Name] = true
+        switch {
+        case lv.ThinPool && lv.Pool != "":
+            return fmt.Errorf("disk.lvm.volumes[%d]: a volume cannot be a thin pool and live in one", i)
+        case lv.ThinPool:
+            if lv.Mountpoint != "" || lv.Filesystem != "" {
+                return fmt.Errorf("disk.lvm.volumes[%d]: a thin pool cannot be formatted or mounted", i)
+            }
+            pools[lv.Name] = true
+        case lv.Pool != "":
+            if !pools[lv.Pool] {
+                return fmt.Errorf("disk.lvm.volumes[%d]: thin pool %q must be listed before its volumes", i, lv.Pool)
+            }
+            if lv.Size == "rest" {
+                return fmt.Errorf("disk.lvm.volumes[%d]: a thin volume needs an explicit virtual size", i)
+            }
+            continue
+        }
+        if rest != "" {
+            return fmt.Errorf("disk.lvm.volumes[%d]: only thin volumes can follow the volume that uses the rest of the group", i)
+        }
+        if lv.Size == "rest" {
+            rest = lv.Name
+        }
+    }
+    if snap := l.Snapshot; snap != nil {
+        if err := checkLVMName(snap.Name); err != nil {
+            return fmt.Errorf("disk.lvm.snapshot: %w", err)
+        }
+        if names[snap.Name] {
+            return fmt.Errorf("disk.lvm.snapshot: %s is already a volume", snap.Name)
+        }
+        root := rootVolume(l)
+        if root == nil {
+            return fmt.Errorf("disk.lvm.snapshot needs a logical volume mounted at /")
+        }
+        if root.Pool == "" && snap.Size == "" {
+            return fmt.Errorf("disk.lvm.snapshot.size is required when root is not a thin volume")
+        }
+        if snap.Size != "" {
+            if err := checkLVMSize(snap.Size); err != nil {
+                return fmt.Errorf("disk.lvm.snapshot.size: %w", err)
+            }
+        }
+        // A thick snapshot takes its size from the free space of the group,
+        // which a volume of size rest leaves empty.
+        if root.Pool == "" && rest != "" {
+            return fmt.Errorf("disk.lvm.snapshot.size: %s uses the rest of the group and leaves no room for the snapshot, give it a fixed size", rest)
+        }
+    }
+    return nil
+}
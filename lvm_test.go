@@ -0,0 +1,198 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestValidateThickSnapshotNeedsFreeSpace(t *testing.T) {
+    l := defaultConfig().Disk.LVM
+    l.Snapshot = &SnapshotConfig{Name: "root-install", Size: "5G"}
+    if err := validateVolumes(l); err == nil || !strings.Contains(err.Error(), "disk.lvm.snapshot.size") {
+        t.Errorf("snapshot of a root that uses the rest of the group: %v", err)
+    }
+
+    l.Volumes = []LogicalVolumeConfig{{Name: "root", Size: "20G", Mountpoint: "/"}}
+    if err := validateVolumes(l); err != nil {
+        t.Errorf("snapshot of a fixed size root: %v", err)
+    }
+
+    // Thin snapshots live in the pool, so the pool may take the rest.
+    l.Volumes = []LogicalVolumeConfig{
+        {Name: "pool", Size: "rest", ThinPool: true},
+        {Name: "root", Size: "20G", Pool: "pool", Mountpoint: "/"},
+    }
+    l.Snapshot.Size = ""
+    if err := validateVolumes(l); err != nil {
+        t.Errorf("thin snapshot: %v", err)
+    }
+}
+
+const (
+    pvsOutput = `{"report": [{"pv": [
+        {"pv_name": "/dev/sdc", "vg_name": "", "pv_size": "10737418240", "pv_free": "10737418240"},
+        {"pv_name": "/dev/sdb", "vg_name": "data", "pv_size": "21474836480", "pv_free": "4294967296"}
+    ]}]}`
+    vgsOutput = `{"report": [{"vg": [
+        {"vg_name": "data", "vg_size": "21474836480", "vg_free": "4294967296", "vg_extent_size": "4194304", "vg_extent_count": "5120", "vg_free_count": "1024"}
+    ]}]}`
+    lvsOutput = `{"report": [{"lv": [
+        {"lv_name": "vm1", "vg_name": "data", "lv_path": "/dev/data/vm1", "lv_size": "32212254720", "lv_attr": "Vwi-a-tz--", "pool_lv": "pool"},
+        {"lv_name": "pool", "vg_name": "data", "lv_path": "", "lv_size": "17179869184", "lv_attr": "twi-aotz--", "pool_lv": ""}
+    ]}]}`
+)
+
+func TestListLVM(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Outputs["pvs "] = pvsOutput
+    f.Outputs["vgs "] = vgsOutput
+    f.Outputs["lvs "] = lvsOutput
+    s, err := ListLVM(f)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, commands["lvmPvs"], commands["lvmVgs"], commands["lvmLvs"])
+    if len(s.PVs) != 2 || s.PVs[0].Name != "/dev/sdb" || s.PVs[0].VG != "data" || s.PVs[1].Free != 10<<30 {
+        t.Errorf("PVs are %+v", s.PVs)
+    }
+    if len(s.VGs) != 1 || s.VGs[0].Size != 20<<30 || s.VGs[0].Free != 4<<30 || s.VGs[0].FreeExtents != 1024 {
+        t.Errorf("VGs are %+v", s.VGs)
+    }
+    if len(s.LVs) != 2 || s.LVs[0].Name != "pool" || !s.LVs[0].isThinPool() || s.LVs[1].Pool != "pool" || s.LVs[1].isThinPool() {
+        t.Errorf("LVs are %+v", s.LVs)
+    }
+
+    f.Errors["vgs "] = errFake
+    if _, err := ListLVM(f); err == nil || !strings.Contains(err.Error(), "lvmVgs") {
+        t.Errorf("got %v, want the vgs failure", err)
+    }
+}
+
+// TestLVMStateMachine walks a blank disk through everything the LVM editor
+// queues, in the order LVM allows and out of it.
+func TestLVMStateMachine(t *testing.T) {
+    blockDevices = []*BlockDevice{
+        {Name: "/dev/sdb", Path: "/dev/sdb", Type: "disk", Size: 20 << 30},
+        {Name: "/dev/sdc", Path: "/dev/sdc", Type: "disk", Size: 10 << 30, FSType: "ext4"},
+    }
+    defer func() { blockDevices = nil }()
+    s := &LVMState{}
+    step := func(op LVMOp, wantErr string) {
+        t.Helper()
+        err := s.apply(op)
+        switch {
+        case wantErr == "" && err != nil:
+            t.Fatalf("%s: %v", op, err)
+        case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+            t.Fatalf("%s: got %v, want an error containing %q", op, err, wantErr)
+        }
+    }
+    free := func(want int64) {
+        t.Helper()
+        if vg := s.vg("vg0"); vg == nil || int64(vg.Free) != want {
+            t.Fatalf("vg0 is %+v, want %s free", vg, humanSize(want))
+        }
+    }
+
+    step(LVMOp{Kind: lvmCreateVG, VG: "vg0", PV: "/dev/sdb"}, "is not a physical volume")
+    step(LVMOp{Kind: lvmCreatePV, PV: "/dev/sdz"}, "is not a block device")
+    step(LVMOp{Kind: lvmCreatePV, PV: "/dev/sdc"}, "already holds ext4")
+    step(LVMOp{Kind: lvmCreatePV, PV: "/dev/sdb"}, "")
+    step(LVMOp{Kind: lvmCreatePV, PV: "/dev/sdb"}, "already a physical volume")
+    step(LVMOp{Kind: lvmCreateLV, VG: "vg0", LV: "root", Size: 8 << 30}, "no volume group vg0")
+    step(LVMOp{Kind: lvmCreateVG, VG: "vg0", PV: "/dev/sdb"}, "")
+    free(20 << 30)
+    step(LVMOp{Kind: lvmCreateVG, VG: "vg1", PV: "/dev/sdb"}, "already belongs to volume group vg0")
+    step(LVMOp{Kind: lvmRemovePV, PV: "/dev/sdb"}, "belongs to volume group vg0")
+
+    step(LVMOp{Kind: lvmCreateLV, VG: "vg0", LV: "root", Size: 8 << 30}, "")
+    step(LVMOp{Kind: lvmCreateLV, VG: "vg0", LV: "root", Size: 1 << 30}, "already exists")
+    step(LVMOp{Kind: lvmCreateLV, VG: "vg0", LV: "big", Size: 13 << 30}, "does not fit")
+    free(12 << 30)
+    step(LVMOp{Kind: lvmCreateThinPool, VG: "vg0", LV: "pool", Size: 4 << 30}, "")
+    step(LVMOp{Kind: lvmCreateThinLV, VG: "vg0", LV: "vm1", Pool: "root", Size: 10 << 30}, "is not a thin pool")
+    // Thin volumes may promise more than the pool holds.
+    step(LVMOp{Kind: lvmCreateThinLV, VG: "vg0", LV: "vm1", Pool: "pool", Size: 10 << 30}, "")
+    free(8 << 30)
+    step(LVMOp{Kind: lvmSnapshotLV, VG: "vg0", LV: "root", NewName: "root-snap", Size: 1 << 30}, "")
+    step(LVMOp{Kind: lvmSnapshotLV, VG: "vg0", LV: "vm1", NewName: "vm1-snap"}, "")
+    step(LVMOp{Kind: lvmSnapshotLV, VG: "vg0", LV: "pool", NewName: "pool-snap"}, "no logical volume vg0/pool")
+    free(7 << 30)
+    if snap := s.lv("vg0", "vm1-snap"); snap == nil || snap.Pool != "pool" {
+        t.Fatalf("thin snapshot is %+v, want it in the pool", snap)
+    }
+
+    step(LVMOp{Kind: lvmResizeLV, VG: "vg0", LV: "root", Size: 16 << 30}, "does not fit")
+    step(LVMOp{Kind: lvmResizeLV, VG: "vg0", LV: "root", Size: 10 << 30}, "")
+    free(5 << 30)
+
+    // Removing the pool takes its thin volumes and their snapshots along.
+    step(LVMOp{Kind: lvmRemoveLV, VG: "vg0", LV: "pool"}, "")
+    free(9 << 30)
+    if s.lv("vg0", "vm1") != nil || s.lv("vg0", "vm1-snap") != nil || len(s.LVs) != 2 {
+        t.Fatalf("LVs after removing the pool are %+v", s.LVs)
+    }
+
+    step(LVMOp{Kind: lvmRemoveVG, VG: "vg0"}, "")
+    if len(s.VGs) != 0 || len(s.LVs) != 0 || s.PVs[0].VG != "" || s.PVs[0].Free != 20<<30 {
+        t.Fatalf("state after removing vg0 is %+v", *s)
+    }
+    step(LVMOp{Kind: lvmRemovePV, PV: "/dev/sdb"}, "")
+    if len(s.PVs) != 0 {
+        t.Fatalf("PVs left: %+v", s.PVs)
+    }
+}
+
+func TestLVMForStopsAtFirstError(t *testing.T) {
+    blockDevices = []*BlockDevice{{Name: "/dev/sdb", Path: "/dev/sdb", Type: "disk", Size: 20 << 30}}
+    defer func() { blockDevices = nil }()
+    base := &LVMState{}
+    ops := []LVMOp{
+        {Kind: lvmCreatePV, PV: "/dev/sdb"},
+        {Kind: lvmCreateLV, VG: "vg0", LV: "root", Size: 8 << 30},
+        {Kind: lvmCreateVG, VG: "vg0", PV: "/dev/sdb"},
+    }
+    s, err := lvmFor(base, ops)
+    if err == nil || len(s.PVs) != 1 || len(s.VGs) != 0 {
+        t.Errorf("got %+v, %v, want the PV and the error of the LV before its VG", *s, err)
+    }
+    if len(base.PVs) != 0 {
+        t.Errorf("lvmFor changed the state it started from: %+v", *base)
+    }
+}
+
+func TestLVMOpApply(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    for _, op := range []LVMOp{
+        {Kind: lvmCreatePV, PV: "/dev/sdb"},
+        {Kind: lvmCreateVG, VG: "vg0", PV: "/dev/sdb"},
+        {Kind: lvmCreateLV, VG: "vg0", LV: "root", Size: 8 << 30},
+        {Kind: lvmCreateThinPool, VG: "vg0", LV: "pool", Size: 4 << 30},
+        {Kind: lvmCreateThinLV, VG: "vg0", LV: "vm1", Pool: "pool", Size: 10 << 30},
+        {Kind: lvmSnapshotLV, VG: "vg0", LV: "root", NewName: "root-snap", Size: 1 << 30},
+        {Kind: lvmSnapshotLV, VG: "vg0", LV: "vm1", NewName: "vm1-snap"},
+        {Kind: lvmResizeLV, VG: "vg0", LV: "root", Size: 10 << 30},
+        {Kind: lvmRemoveLV, VG: "vg0", LV: "pool"},
+        {Kind: lvmRemoveVG, VG: "vg0"},
+        {Kind: lvmRemovePV, PV: "/dev/sdb"},
+    } {
+        if err := op.Apply(f); err != nil {
+            t.Fatalf("%s: %v", op, err)
+        }
+    }
+    checkCalls(t, f,
+        "pvcreate -f /dev/sdb",
+        "vgcreate -f vg0 /dev/sdb",
+        "lvcreate -L 8192M -n root vg0",
+        "lvcreate --type thin-pool -L 4096M -n pool vg0",
+        "lvcreate --type thin -V 10240M -n vm1 --thinpool vg0/pool",
+        "lvcreate --snapshot -L 1024M -n root-snap vg0/root",
+        "lvcreate --snapshot -n vm1-snap vg0/vm1",
+        "lvresize --resizefs -L 10240M vg0/root",
+        "lvremove -f vg0/pool",
+        "vgremove -f vg0",
+        "pvremove /dev/sdb",
+    )
+}
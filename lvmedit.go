@@ -0,0 +1,349 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/charmbracelet/bubbles/textinput"
+    tea "github.com/charmbracelet/bubbletea"
+)
+
+// lvmModel is the LVM tab. Like the partition editor it writes nothing:
+// every change goes into the operations queue and is shown on top of what
+// LVM reported when the installer started.
+type lvmModel struct {
+    base    *LVMState
+    q       *OpQueue
+    cursor  int
+    form    *lvmForm
+    confirm *LVMOp
+    err     error
+}
+
+// lvmForm asks for the names and sizes op still needs.
+type lvmForm struct {
+    title  string
+    op     LVMOp
+    labels []string
+    inputs []textinput.Model
+    focus  int
+    avail  int64
+}
+
+// lvmRow is one selectable line of the tab.
+type lvmRow struct {
+    pv *PhysicalVolume
+    vg *VolumeGroup
+    lv *LogicalVolume
+}
+
+func newLVMModel(r Runner, q *OpQueue) lvmModel {
+    s, err := ListLVM(r)
+    if err != nil {
+        s = &LVMState{}
+    }
+    return lvmModel{base: s, q: q, err: err}
+}
+
+// state is what LVM will look like once the queue has run. Every change is
+// checked when it is queued, so lvmFor cannot fail here.
+func (m lvmModel) state() *LVMState {
+    s, _ := lvmFor(m.base, m.q.lvmChanges())
+    return s
+}
+
+func (m lvmModel) rows(s *LVMState) []lvmRow {
+    var rows []lvmRow
+    for i := range s.PVs {
+        rows = append(rows, lvmRow{pv: &s.PVs[i]})
+    }
+    for i := range s.VGs {
+        rows = append(rows, lvmRow{vg: &s.VGs[i]})
+    }
+    for i := range s.LVs {
+        rows = append(rows, lvmRow{lv: &s.LVs[i]})
+    }
+    return rows
+}
+
+func (m lvmModel) selected(s *LVMState) (lvmRow, bool) {
+    rows := m.rows(s)
+    if m.cursor >= len(rows) {
+        return lvmRow{}, false
+    }
+    return rows[m.cursor], true
+}
+
+func (m *lvmModel) openForm(title string, op LVMOp, avail int64, labels ...string) tea.Cmd {
+    f := &lvmForm{title: title, op: op, labels: labels, avail: avail}
+    for range labels {
+        in := textinput.New()
+        in.Prompt = ""
+        in.Width = 36
+        in.CharLimit = 127
+        f.inputs = append(f.inputs, in)
+    }
+    m.form = f
+    m.err = nil
+    return f.inputs[0].Focus()
+}
+
+// queue checks op against the pending state before adding it.
+func (m *lvmModel) queue(op LVMOp) {
+    if err := m.state().apply(op); err != nil {
+        m.err = err
+        return
+    }
+    m.q.Add(op)
+    m.err = nil
+    m.form = nil
+}
+
+func (m lvmModel) update(msg tea.KeyMsg) (lvmModel, tea.Cmd) {
+    if m.confirm != nil {
+        if msg.String() == "y" {
+            m.queue(*m.confirm)
+        }
+        m.confirm = nil
+        return m, nil
+    }
+    if m.form != nil {
+        return m.updateForm(msg)
+    }
+    s := m.state()
+    row, ok := m.selected(s)
+    switch msg.String() {
+    case "up", "ctrl+k":
+        if m.cursor > 0 {
+            m.cursor--
+        }
+    case "down", "ctrl+j":
+        if m.cursor < len(m.rows(s))-1 {
+            m.cursor++
+        }
+    case "p":
+        return m, m.openForm("New physical volume", LVMOp{Kind: lvmCreatePV}, 0, "Device for the new physical volume")
+    case "v":
+        if ok && row.pv != nil && row.pv.VG == "" {
+            return m, m.openForm("New volume group on "+row.pv.Name, LVMOp{Kind: lvmCreateVG, PV: row.pv.Name}, 0, "Name of the new volume group")
+        }
+    case "x":
+        if ok && row.pv != nil && row.pv.VG == "" {
+            return m, m.openForm("Extend a volume group", LVMOp{Kind: lvmExtendVG, PV: row.pv.Name}, 0, "Volume group to add "+row.pv.Name+" to")
+        }
+    case "n":
+        if ok && row.lv != nil && row.lv.isThinPool() {
+            return m, m.openForm("New thin volume in "+row.lv.VG+"/"+row.lv.Name, LVMOp{Kind: lvmCreateThinLV, VG: row.lv.VG, Pool: row.lv.Name},
+                int64(row.lv.Size), "Name of the new thin volume", "Virtual size (512M, 20G, 30%, rest of the pool)")
+        }
+        vg := ""
+        if ok && row.vg != nil {
+            vg = row.vg.Name
+        } else if ok && row.lv != nil {
+            vg = row.lv.VG
+        }
+        if g := s.vg(vg); g != nil {
+            return m, m.openForm("New logical volume in "+vg, LVMOp{Kind: lvmCreateLV, VG: vg}, int64(g.Free), "Name of the new logical volume", "Size (512M, 20G, 30%, rest)")
+        }
+    case "t":
+        vg := ""
+        if ok && row.vg != nil {
+            vg = row.vg.Name
+        } else if ok && row.lv != nil {
+            vg = row.lv.VG
+        }
+        if g := s.vg(vg); g != nil {
+            return m, m.openForm("New thin pool in "+vg, LVMOp{Kind: lvmCreateThinPool, VG: vg}, int64(g.Free), "Name of the new thin pool", "Size (512M, 20G, 30%, rest)")
+        }
+    case "s":
+        if ok && row.lv != nil && !row.lv.isThinPool() {
+            op := LVMOp{Kind: lvmSnapshotLV, VG: row.lv.VG, LV: row.lv.Name}
+            title := "Snapshot " + row.lv.VG + "/" + row.lv.Name
+            if row.lv.Pool != "" {
+                return m, m.openForm(title, op, 0, "Name of the snapshot")
+            }
+            return m, m.openForm(title, op, int64(s.vg(row.lv.VG).Free), "Name of the snapshot", "Space for changes (512M, 20G, 30%, rest)")
+        }
+    case "r":
+        if ok && row.lv != nil {
+            avail := int64(row.lv.Size + s.vg(row.lv.VG).Free)
+            return m, m.openForm("Resize "+row.lv.VG+"/"+row.lv.Name, LVMOp{Kind: lvmResizeLV, VG: row.lv.VG, LV: row.lv.Name}, avail, "New size (512M, 20G, 30%, rest)")
+        }
+    case "e":
+        if ok && row.vg != nil {
+            return m, m.openForm("Rename volume group", LVMOp{Kind: lvmRenameVG, VG: row.vg.Name}, 0, "New name for "+row.vg.Name)
+        }
+        if ok && row.lv != nil {
+            return m, m.openForm("Rename logical volume", LVMOp{Kind: lvmRenameLV, VG: row.lv.VG, LV: row.lv.Name}, 0, "New name for "+row.lv.VG+"/"+row.lv.Name)
+        }
+    case "d":
+        switch {
+        case ok && row.pv != nil:
+            m.confirm = &LVMOp{Kind: lvmRemovePV, PV: row.pv.Name}
+        case ok && row.vg != nil:
+            m.confirm = &LVMOp{Kind: lvmRemoveVG, VG: row.vg.Name}
+        case ok && row.lv != nil:
+            m.confirm = &LVMOp{Kind: lvmRemoveLV, VG: row.lv.VG, LV: row.lv.Name}
+        }
+    case "u":
+        m.err = nil
+        undone := m.q.UndoIf(func(op Operation) bool {
+            _, ok := op.(LVMOp)
+            return ok
+        })
+        if !undone && m.q.Len() > 0 {
+            m.err = fmt.Errorf("The last change is not an LVM change, undo it in the Pending tab")
+        }
+    }
+    return m, nil
+}
+
+func (m lvmModel) updateForm(msg tea.KeyMsg) (lvmModel, tea.Cmd) {
+    f := m.form
+    switch msg.String() {
+    case "esc":
+        m.form, m.err = nil, nil
+        return m, nil
+    case "tab", "down", "ctrl+j", "shift+tab", "up", "ctrl+k":
+        step := 1
+        if s := msg.String(); s == "shift+tab" || s == "up" || s == "ctrl+k" {
+            step = len(f.inputs) - 1
+        }
+        f.inputs[f.focus].Blur()
+        f.focus = (f.focus + step) % len(f.inputs)
+        return m, f.inputs[f.focus].Focus()
+    case "enter":
+        m.submit()
+        return m, nil
+    }
+    var cmd tea.Cmd
+    f.inputs[f.focus], cmd = f.inputs[f.focus].Update(msg)
+    return m, cmd
+}
+
+func (m *lvmModel) submit() {
+    f := m.form
+    op := f.op
+    v := make([]string, len(f.inputs))
+    for i, in := range f.inputs {
+        v[i] = strings.TrimSpace(in.Value())
+    }
+    var err error
+    switch op.Kind {
+    case lvmCreatePV:
+        op.PV = v[0]
+    case lvmCreateVG, lvmExtendVG:
+        op.VG = v[0]
+    case lvmRenameVG, lvmRenameLV:
+        op.NewName = v[0]
+    case lvmCreateLV, lvmCreateThinPool, lvmCreateThinLV:
+        op.LV = v[0]
+        op.Size, err = parseSize(v[1], f.avail)
+    case lvmSnapshotLV:
+        op.NewName = v[0]
+        if len(v) > 1 {
+            op.Size, err = parseSize(v[1], f.avail)
+        }
+    case lvmResizeLV:
+        op.Size, err = parseSize(v[0], f.avail)
+        if err == nil {
+            err = checkResizeFS(m.state(), op)
+        }
+    }
+    if err != nil {
+        m.err = err
+        return
+    }
+    m.queue(op)
+}
+
+func (m lvmModel) View() string {
+    s := m.state()
+    var b strings.Builder
+    if m.form != nil {
+        b.WriteString("\n" + inputStyle.Render(m.form.title) + "\n\n")
+        for i, label := range m.form.labels {
+            marker := "  "
+            if i == m.form.focus {
+                marker = "> "
+            }
+            fmt.Fprintf(&b, "%s%s:\n   %s\n\n", marker, label, m.form.inputs[i].View())
+        }
+        if m.form.avail > 0 {
+            fmt.Fprintf(&b, "  %s available\n\n", humanSize(m.form.avail))
+        }
+        b.WriteString(continueStyle.Render("enter: queue  tab: next field  esc: cancel") + "\n")
+    } else {
+        rows := m.rows(s)
+        line := func(i int, text string) {
+            if i == m.cursor {
+                b.WriteString(editorCursorStyle.Render("> "+text) + "\n")
+            } else {
+                b.WriteString("  " + text + "\n")
+            }
+        }
+        b.WriteString("\n" + inputStyle.Render("Physical volumes") + "\n")
+        fmt.Fprintf(&b, "  %-24s %-16s %12s %12s\n", "PV", "VG", "Size", "Free")
+        for i, r := range rows {
+            if r.pv != nil {
+                line(i, fmt.Sprintf("%-24s %-16s %12s %12s", r.pv.Name, r.pv.VG, humanSize(int64(r.pv.Size)), humanSize(int64(r.pv.Free))))
+            }
+        }
+        b.WriteString("\n" + inputStyle.Render("Volume groups") + "\n")
+        fmt.Fprintf(&b, "  %-24s %12s %12s %16s\n", "VG", "Size", "Free", "Free extents")
+        for i, r := range rows {
+            if r.vg != nil {
+                extents := "-"
+                if r.vg.ExtentSize > 0 {
+                    extents = fmt.Sprintf("%d/%d", r.vg.Free/r.vg.ExtentSize, r.vg.Size/r.vg.ExtentSize)
+                }
+                line(i, fmt.Sprintf("%-24s %12s %12s %16s", r.vg.Name, humanSize(int64(r.vg.Size)), humanSize(int64(r.vg.Free)), extents))
+            }
+        }
+        b.WriteString("\n" + inputStyle.Render("Logical volumes") + "\n")
+        fmt.Fprintf(&b, "  %-24s %-16s %12s  %-10s  %s\n", "LV", "VG", "Size", "Attr", "Pool")
+        for i, r := range rows {
+            if r.lv != nil {
+                line(i, fmt.Sprintf("%-24s %-16s %12s  %-10s  %s", r.lv.Name, r.lv.VG, humanSize(int64(r.lv.Size)), r.lv.Attr, r.lv.Pool))
+            }
+        }
+        b.WriteString("\n")
+        if m.confirm != nil {
+            b.WriteString(inputStyle.Render(m.confirm.String()+"? (y/n)") + "\n")
+        } else {
+            b.WriteString(continueStyle.Render("p: new PV  v: new VG on PV  x: add PV to VG  n: new LV (thin in a pool)  t: new thin pool  s: snapshot  r: resize LV  e: rename  d: remove  u: undo") + "\n")
+        }
+    }
+
+    var pending []string
+    for _, op := range m.q.lvmChanges() {
+        pending = append(pending, "  "+op.String())
+    }
+    if len(pending) > 0 {
+        b.WriteString("\n" + inputStyle.Render("Pending operations:") + "\n" + strings.Join(pending, "\n") + "\n")
+    }
+    if m.err != nil {
+        b.WriteString("\n" + inputStyle.Render(m.err.Error()) + "\n")
+    }
+    return b.String()
+}
+
+// checkResizeFS refuses a resize the filesystem on the volume cannot follow.
+// Filesystems the registry does not know are left to lvresize to judge.
+func checkResizeFS(s *LVMState, op LVMOp) error {
+    lv := s.lv(op.VG, op.LV)
+    if lv == nil {
+        return nil
+    }
+    d := findVolume(lv.Path)
+    if d == nil || d.FSType == "" {
+        return nil
+    }
+    if _, err := lookupFilesystem(d.FSType); err != nil {
+        return nil
+    }
+    if !canResize(d.FSType, int64(lv.Size), op.Size) {
+        return fmt.Errorf("%s cannot be resized from %s to %s", d.FSType, humanSize(int64(lv.Size)), humanSize(op.Size))
+    }
+    return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "sort"
+    "strings"
+)
+
+// mountPresets are the mount points the Partitions tab cycles through.
+var mountPresets = []string{"", "/", "/boot", "/boot/efi", "/home", "swap"}
+
+// defaultMountRoot is where the target system is assembled.
+const defaultMountRoot = "/mnt"
+
+// MountEntry is a device that becomes part of the installed system. Options
+// are passed to mount and end up in fstab.
+type MountEntry struct {
+    Device     string
+    Mountpoint string
+    Filesystem string
+    Options    string
+}
+
+// mountEntries lists everything cfg mounts: the volumes of the target stack,
+// the extra partitions and the subvolumes of a btrfs root, in the order
+// they must be mounted. The options of btrfs mounts follow the btrfs layout
+// alone, so turning noatime off there sticks.
+func mountEntries(cfg *InstallConfig) []MountEntry {
+    plain := plainMountEntries(cfg)
+    for i, e := range plain {
+        if f, err := lookupFilesystem(e.Filesystem); err == nil && e.Options == "" && e.Mountpoint != "swap" {
+            plain[i].Options = f.MountOptions
+        }
+    }
+    out := expandBtrfs(cfg.Disk, plain)
+    // Parents before children: / before /boot before /boot/efi.
+    sort.SliceStable(out, func(i, j int) bool {
+        return mountDepth(out[i].Mountpoint) < mountDepth(out[j].Mountpoint)
+    })
+    return out
+}
+
+// plainMountEntries lists the devices cfg mounts, one entry each.
+func plainMountEntries(cfg *InstallConfig) []MountEntry {
+    var out []MountEntry
+    d := cfg.Disk
+    if d.Target != "" {
+        if d.LVM.Enabled {
+            for _, lv := range d.LVM.Volumes {
+                if lv.Mountpoint == "" {
+                    continue
+                }
+                fs := lv.Filesystem
+                if fs == "" {
+                    fs = d.Filesystem
+                }
+                out = append(out, MountEntry{"/dev/" + d.LVM.VolumeGroup + "/" + lv.Name, lv.Mountpoint, fs, ""})
+            }
+        } else {
+            dev := d.Target
+            if d.Encryption.Enabled {
+                dev = "/dev/mapper/" + d.Encryption.Mapper
+            }
+            out = append(out, MountEntry{dev, "/", d.Filesystem, ""})
+        }
+    }
+    for _, p := range d.Partitions {
+        if p.Mountpoint == "" || p.Encrypt {
+            continue
+        }
+        fs := p.Filesystem
+        if fs == "" {
+            fs = defaultFilesystem(p.Mountpoint)
+        }
+        out = append(out, MountEntry{p.Device, p.Mountpoint, fs, ""})
+    }
+    return out
+}
+
+func mountDepth(mp string) int {
+    if mp == "swap" {
+        return 1 << 10
+    }
+    if mp == "/" {
+        return 0
+    }
+    return strings.Count(mp, "/")
+}
+
+// validateMounts requires exactly one root and no mount point used twice.
+func validateMounts(entries []MountEntry) error {
+    seen := make(map[string]string)
+    var roots int
+    for _, e := range entries {
+        if e.Mountpoint == "swap" {
+            continue
+        }
+        if !path.IsAbs(e.Mountpoint) || path.Clean(e.Mountpoint) != e.Mountpoint || strings.ContainsAny(e.Mountpoint, " \t\n\\") {
+            return fmt.Errorf("%s: mount point %q must be a clean absolute path without spaces", e.Device, e.Mountpoint)
+        }
+        if e.Mountpoint == "/" {
+            roots++
+        }
+        if other, ok := seen[e.Mountpoint]; ok {
+            return fmt.Errorf("%s and %s are both mounted at %s", other, e.Device, e.Mountpoint)
+        }
+        seen[e.Mountpoint] = e.Device
+    }
+    if roots != 1 {
+        return fmt.Errorf("exactly one filesystem must be mounted at /, found %d", roots)
+    }
+    return nil
+}
+
+// mountOps mounts the target system under root and enables its swap.
+func mountOps(root string, entries []MountEntry) []Operation {
+    var ops []Operation
+    for _, e := range entries {
+        if e.Mountpoint == "swap" {
+            ops = append(ops, newCmdOp("swapOn", e.Device))
+            continue
+        }
+        dir := path.Join(root, e.Mountpoint)
+        if e.Options != "" {
+            ops = append(ops, newCmdOp("mkdirTarget", dir), newCmdOp("mountDevOpts", e.Options, e.Device, dir))
+            continue
+        }
+        ops = append(ops, newCmdOp("mkdirTarget", dir), newCmdOp("mountDev", e.Device, dir))
+    }
+    return ops
+}
+
+// defaultFilesystem picks what a partition mounted at mp is formatted with
+// when nothing else was chosen.
+func defaultFilesystem(mp string) string {
+    switch mp {
+    case "swap":
+        return "swap"
+    case "/boot/efi":
+        return "vfat"
+    }
+    return "ext4"
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/charmbracelet/bubbles/textinput"
+    tea "github.com/charmbracelet/bubbletea"
+    "github.com/charmbracelet/lipgloss"
+)
+
+var (
+    editorCursorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("229")).Background(lipgloss.Color("57"))
+    editorFreeStyle   = lipgloss.NewStyle().Foreground(darkGray)
+)
+
+// partEditor edits the partition table of one disk. Nothing is written:
+// every change is added to the operations queue for the user to review.
+type partEditor struct {
+    disk   *BlockDevice
+    q      *OpQueue
+    cursor int
+    form   *partForm
+    err    error
+    closed bool
+}
+
+// partForm asks for the values of one operation. Which fields it shows
+// depends on the kind of operation.
+type partForm struct {
+    kind    partOpKind
+    seg     segment
+    size    textinput.Model
+    label   textinput.Model
+    typeIdx int
+    field   int
+}
+
+const (
+    formSize = iota
+    formType
+    formLabel
+)
+
+func newPartEditor(disk *BlockDevice, q *OpQueue) *partEditor {
+    return &partEditor{disk: disk, q: q}
+}
+
+func (e *partEditor) layout() *diskLayout {
+    l, err := layoutFor(e.disk, e.q.partOps())
+    if err != nil {
+        e.err = err
+    }
+    return l
+}
+
+func (e *partEditor) current() (segment, bool) {
+    segs := e.layout().segments()
+    if len(segs) == 0 {
+        return segment{}, false
+    }
+    if e.cursor >= len(segs) {
+        e.cursor = len(segs) - 1
+    }
+    return segs[e.cursor], true
+}
+
+func (e *partEditor) fields() []int {
+    switch e.form.kind {
+    case opCreate:
+        return []int{formSize, formType, formLabel}
+    case opResize:
+        return []int{formSize}
+    case opSetType:
+        return []int{formType}
+    }
+    return []int{formLabel}
+}
+
+func (e *partEditor) openForm(kind partOpKind, seg segment) tea.Cmd {
+    f := &partForm{kind: kind, seg: seg}
+    f.size = textinput.New()
+    f.size.Prompt = ""
+    f.size.Width = 20
+    f.size.CharLimit = 20
+    f.size.SetValue("rest")
+    f.label = textinput.New()
+    f.label.Prompt = ""
+    f.label.Width = 36
+    f.label.CharLimit = 36
+    if seg.Part != nil {
+        f.label.SetValue(seg.Part.Label)
+        f.size.SetValue(fmt.Sprintf("%dM", seg.Part.Size/mib))
+        for i, pt := range partTypes {
+            if strings.EqualFold(pt.GUID, seg.Part.Type) {
+                f.typeIdx = i
+            }
+        }
+    }
+    e.form = f
+    e.err = nil
+    f.field = e.fields()[0]
+    return e.focusForm()
+}
+
+func (e *partEditor) focusForm() tea.Cmd {
+    e.form.size.Blur()
+    e.form.label.Blur()
+    switch e.form.field {
+    case formSize:
+        return e.form.size.Focus()
+    case formLabel:
+        return e.form.label.Focus()
+    }
+    return nil
+}
+
+func (e *partEditor) queue(op PartOp) {
+    l := e.layout()
+    if op.Kind != opNewTable {
+        op.Table = l.Table
+    }
+    op.SectorSize = int64(e.disk.LogSec)
+    if err := l.apply(op); err != nil {
+        e.err = err
+        return
+    }
+    e.q.Add(op)
+    e.err = nil
+    e.form = nil
+}
+
+func (e *partEditor) update(msg tea.Msg) tea.Cmd {
+    key, ok := msg.(tea.KeyMsg)
+    if !ok {
+        return nil
+    }
+    if e.form != nil {
+        return e.updateForm(key)
+    }
+    segs := e.layout().segments()
+    seg, ok := e.current()
+    switch key.String() {
+    case "esc":
+        e.closed = true
+    case "up", "ctrl+k":
+        if e.cursor > 0 {
+            e.cursor--
+        }
+    case "down", "ctrl+j":
+        if e.cursor < len(segs)-1 {
+            e.cursor++
+        }
+    case "enter", "n":
+        if ok && seg.Part == nil {
+            return e.openForm(opCreate, seg)
+        }
+    case "g", "m":
+        table := "gpt"
+        if key.String() == "m" {
+            table = "dos"
+        }
+        e.queue(PartOp{Kind: opNewTable, Disk: e.disk.Path, Table: table})
+        e.cursor = 0
+    case "u":
+        e.err = nil
+        undone := e.q.UndoIf(func(op Operation) bool {
+            if g, ok := op.(guidedOp); ok {
+                op = g.PartOp
+            }
+            p, ok := op.(PartOp)
+            return ok && p.Disk == e.disk.Path
+        })
+        if !undone && e.q.Len() > 0 {
+            e.err = fmt.Errorf("The last change is not on %s, undo it in the Pending tab", e.disk.Path)
+        }
+    case "d":
+        if ok && seg.Part != nil {
+            e.queue(PartOp{Kind: opDelete, Disk: e.disk.Path, Number: seg.Part.Number})
+        }
+    case "r":
+        if ok && seg.Part != nil {
+            return e.openForm(opResize, seg)
+        }
+    case "t":
+        if ok && seg.Part != nil {
+            return e.openForm(opSetType, seg)
+        }
+    case "l":
+        if ok && seg.Part != nil {
+            return e.openForm(opSetLabel, seg)
+        }
+    }
+    return nil
+}
+
+func (e *partEditor) updateForm(key tea.KeyMsg) tea.Cmd {
+    f := e.form
+    fields := e.fields()
+    idx := 0
+    for i, fl := range fields {
+        if fl == f.field {
+            idx = i
+        }
+    }
+    switch key.String() {
+    case "esc":
+        e.form = nil
+        e.err = nil
+        return nil
+    case "tab", "down", "ctrl+j":
+        f.field = fields[(idx+1)%len(fields)]
+        return e.focusForm()
+    case "shift+tab", "up", "ctrl+k":
+        f.field = fields[(idx+len(fields)-1)%len(fields)]
+        return e.focusForm()
+    case "enter":
+        e.submit()
+        return nil
+    case "left", "right":
+        if f.field == formType {
+            step := 1
+            if key.String() == "left" {
+                step = len(partTypes) - 1
+            }
+            f.typeIdx = (f.typeIdx + step) % len(partTypes)
+            return nil
+        }
+    }
+    var cmd tea.Cmd
+    switch f.field {
+    case formSize:
+        f.size, cmd = f.size.Update(key)
+    case formLabel:
+        f.label, cmd = f.label.Update(key)
+    }
+    return cmd
+}
+
+func (e *partEditor) submit() {
+    f := e.form
+    op := PartOp{Kind: f.kind, Disk: e.disk.Path, Type: partTypes[f.typeIdx], Label: strings.TrimSpace(f.label.Value())}
+    if (f.kind == opCreate || f.kind == opSetType) && e.layout().Table == "dos" && op.Type.MBR == "" {
+        e.err = fmt.Errorf("%s partitions only exist on GPT disks", op.Type.Name)
+        return
+    }
+    switch f.kind {
+    case opCreate:
+        size, err := parseSize(f.size.Value(), f.seg.Size)
+        if err != nil {
+            e.err = err
+            return
+        }
+        op.Start, op.Size = f.seg.Start, size
+        op.Number = e.layout().nextNumber()
+    case opResize:
+        op.Number = f.seg.Part.Number
+        op.From = f.seg.Part.Size
+        op.FSType, op.FSSize = f.seg.Part.FSType, f.seg.Part.FSSize
+        size, err := parseSize(f.size.Value(), f.seg.Part.Size+e.layout().freeAfter(f.seg.Part))
+        if err != nil {
+            e.err = err
+            return
+        }
+        op.Size = size
+    default:
+        op.Number = f.seg.Part.Number
+    }
+    e.queue(op)
+}
+
+func (e *partEditor) View() string {
+    l := e.layout()
+    var b strings.Builder
+    title := fmt.Sprintf("Editing %s (%s, %s)", e.disk.Path, l.Table, humanSize(l.Size))
+    if e.disk.Model != "" {
+        title += " " + e.disk.Model
+    }
+    b.WriteString("\n" + inputStyle.Render(title) + "\n\n")
+
+    if e.form != nil {
+        b.WriteString(e.formView())
+    } else {
+        fmt.Fprintf(&b, "  %-18s %12s %12s  %-20s %s\n", "Partition", "Start", "Size", "Type", "Label")
+        for i, s := range l.segments() {
+            var line string
+            if s.Part == nil {
+                line = editorFreeStyle.Render(fmt.Sprintf("%-18s %12s %12s", "free space", humanSize(s.Start), humanSize(s.Size)))
+            } else {
+                line = fmt.Sprintf("%-18s %12s %12s  %-20s %s", s.Part.Path, humanSize(s.Start), humanSize(s.Size), partTypeName(s.Part.Type), s.Part.Label)
+            }
+            if i == e.cursor {
+                line = editorCursorStyle.Render("> " + line)
+            } else {
+                line = "  " + line
+            }
+            b.WriteString(line + "\n")
+        }
+        b.WriteString("\n" + continueStyle.Render("enter/n: new in free space  d: delete  r: resize  t: type  l: label  g/m: new GPT/MBR table  u: undo  esc: back") + "\n")
+    }
+
+    var pending []string
+    for _, op := range e.q.partOps() {
+        if op.Disk == e.disk.Path {
+            pending = append(pending, "  "+op.String())
+        }
+    }
+    if len(pending) > 0 {
+        b.WriteString("\n" + inputStyle.Render("Pending operations:") + "\n" + strings.Join(pending, "\n") + "\n")
+    }
+    if e.err != nil {
+        b.WriteString("\n" + inputStyle.Render(e.err.Error()) + "\n")
+    }
+    return b.String()
+}
+
+func (e *partEditor) formView() string {
+    f := e.form
+    var b strings.Builder
+    marker := func(field int) string {
+        if f.field == field {
+            return "> "
+        }
+        return "  "
+    }
+    for _, field := range e.fields() {
+        switch field {
+        case formSize:
+            avail := f.seg.Size
+            if f.seg.Part != nil {
+                avail = f.seg.Part.Size + e.layout().freeAfter(f.seg.Part)
+            }
+            fmt.Fprintf(&b, "%sSize (512M, 20G, 30%%, rest), up to %s:\n   %s\n\n", marker(field), humanSize(avail), f.size.View())
+        case formType:
+            fmt.Fprintf(&b, "%sType: < %s >\n\n", marker(field), partTypes[f.typeIdx].Name)
+        case formLabel:
+            fmt.Fprintf(&b, "%sLabel:\n   %s\n\n", marker(field), f.label.View())
+        }
+    }
+    b.WriteString(continueStyle.Render("enter: queue  tab: next field  left/right: change type  esc: cancel") + "\n")
+    return b.String()
+}
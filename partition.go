@@ -0,0 +1,623 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+
+    "github.com/ft-labs/phyOS-installer/internal/gpt"
+)
+
+const mib = 1 << 20
+
+// PartType is a partition type the editor can assign, with its GPT type GUID
+// and its MBR system id.
+type PartType struct {
+    Name string
+    GUID string
+    MBR  string
+}
+
+var partTypes = []PartType{
+    {"Linux filesystem", "0FC63DAF-8483-4772-8E79-3D69D8477DE4", "83"},
+    {"Linux root (x86-64)", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", "83"},
+    {"EFI System", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "ef"},
+    {"Linux swap", "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F", "82"},
+    {"Linux LVM", "E6D6D379-F507-44C2-A23C-238F2A3DF928", "8e"},
+    {"Linux LUKS", "CA7D7CCB-63ED-4C53-861C-1742536059CC", "83"},
+    // GRUB embeds itself here on GPT disks of BIOS machines. MBR has no
+    // equivalent.
+    {"BIOS boot", "21686148-6449-6E6F-744E-656564454649", ""},
+}
+
+// partTypeName names the PARTTYPE value lsblk reports: a GUID on GPT disks,
+// an id like 0x83 on MBR disks.
+func partTypeName(t string) string {
+    id := strings.TrimPrefix(strings.ToLower(t), "0x")
+    for _, pt := range partTypes {
+        if strings.EqualFold(pt.GUID, t) {
+            return pt.Name
+        }
+    }
+    for _, pt := range partTypes {
+        if pt.MBR != "" && pt.MBR == id {
+            return pt.Name
+        }
+    }
+    return t
+}
+
+// layoutPart is a partition as the editor sees it. Offsets are in bytes.
+type layoutPart struct {
+    Number int
+    Path   string
+    Start  int64
+    Size   int64
+    Type   string
+    Label  string
+    FSType string
+    // FSSize is how many bytes of the partition the filesystem spans, as
+    // its superblock says. It is zero for new partitions and for
+    // filesystems whose size is not known.
+    FSSize int64
+}
+
+// diskLayout is the partition table of a disk with the pending operations
+// applied to it.
+type diskLayout struct {
+    Disk  *BlockDevice
+    Table string
+    Size  int64
+    Parts []*layoutPart
+}
+
+func newDiskLayout(d *BlockDevice) *diskLayout {
+    l := &diskLayout{Disk: d, Table: d.PTType, Size: int64(d.Size)}
+    if l.Table == "" {
+        l.Table = "gpt"
+    }
+    for _, c := range d.Children {
+        if c.Type != "part" {
+            continue
+        }
+        l.Parts = append(l.Parts, &layoutPart{
+            Number: partNumber(c.Path),
+            Path:   c.Path,
+            Start:  int64(c.Start) * 512,
+            Size:   int64(c.Size),
+            Type:   c.PartType,
+            Label:  c.PartLabel,
+            FSType: c.FSType,
+            FSSize: int64(c.FSExtent),
+        })
+    }
+    l.sort()
+    return l
+}
+
+// layoutFor returns the layout of disk with the operations queued for it.
+func layoutFor(disk *BlockDevice, ops []PartOp) (*diskLayout, error) {
+    l := newDiskLayout(disk)
+    for _, op := range ops {
+        if op.Disk != disk.Path {
+            continue
+        }
+        if err := l.apply(op); err != nil {
+            return l, err
+        }
+    }
+    return l, nil
+}
+
+func (l *diskLayout) sort() {
+    sort.Slice(l.Parts, func(i, j int) bool { return l.Parts[i].Start < l.Parts[j].Start })
+}
+
+// partNumber reads the partition number off the end of a device path.
+func partNumber(path string) int {
+    i := len(path)
+    for i > 0 && unicode.IsDigit(rune(path[i-1])) {
+        i--
+    }
+    n, _ := strconv.Atoi(path[i:])
+    return n
+}
+
+// partPath names partition n of the disk the way the kernel does: nvme0n1
+// and mmcblk0 get a "p" before the number, sda does not.
+func partPath(disk string, n int) string {
+    if disk != "" && unicode.IsDigit(rune(disk[len(disk)-1])) {
+        return fmt.Sprintf("%sp%d", disk, n)
+    }
+    return fmt.Sprintf("%s%d", disk, n)
+}
+
+// segment is a stretch of the disk, either a partition or free space.
+type segment struct {
+    Part  *layoutPart
+    Start int64
+    Size  int64
+}
+
+// segments lists partitions and the free space between them. The first and
+// last MiB are kept for the partition table and its backup, and free space
+// starts on a MiB boundary so new partitions come out aligned.
+func (l *diskLayout) segments() []segment {
+    var segs []segment
+    pos, end := int64(mib), l.Size-mib
+    for _, p := range l.Parts {
+        if free := alignUp(pos); p.Start-free >= mib {
+            segs = append(segs, segment{Start: free, Size: p.Start - free})
+        }
+        segs = append(segs, segment{Part: p, Start: p.Start, Size: p.Size})
+        if p.Start+p.Size > pos {
+            pos = p.Start + p.Size
+        }
+    }
+    if free := alignUp(pos); end-free >= mib {
+        segs = append(segs, segment{Start: free, Size: end - free})
+    }
+    return segs
+}
+
+func alignUp(n int64) int64 {
+    return (n + mib - 1) / mib * mib
+}
+
+// freeAfter returns how much free space directly follows partition p.
+func (l *diskLayout) freeAfter(p *layoutPart) int64 {
+    for _, s := range l.segments() {
+        if s.Part == nil && s.Start == p.Start+p.Size {
+            return s.Size
+        }
+    }
+    return 0
+}
+
+func (l *diskLayout) part(n int) *layoutPart {
+    for _, p := range l.Parts {
+        if p.Number == n {
+            return p
+        }
+    }
+    return nil
+}
+
+// nextNumber is the lowest partition number not in use.
+func (l *diskLayout) nextNumber() int {
+    for n := 1; ; n++ {
+        if l.part(n) == nil {
+            return n
+        }
+    }
+}
+
+type partOpKind int
+
+const (
+    opCreate partOpKind = iota
+    opDelete
+    opResize
+    opSetType
+    opSetLabel
+    opNewTable
+)
+
+// PartOp is a pending change to a partition table. Number is filled in for
+// created partitions when the operation is queued, Table and SectorSize are
+// copied from the disk so the operation can be applied on its own. A new
+// table replaces everything on the disk with Table and the opCreate
+// operations in Parts. A resize carries the size it starts From and the
+// FSType and FSSize of the partition, so Apply can resize the filesystem
+// with it or refuse to cut off what is on it.
+type PartOp struct {
+    Kind       partOpKind
+    Disk       string
+    Table      string
+    SectorSize int64
+    Number     int
+    Start      int64
+    Size       int64
+    Type       PartType
+    Label      string
+    Parts      []PartOp
+    From       int64
+    FSType     string
+    FSSize     int64
+}
+
+func (o PartOp) Describe() string {
+    return o.String()
+}
+
+func (o PartOp) typeID() string {
+    if o.Table == "dos" {
+        return o.Type.MBR
+    }
+    return o.Type.GUID
+}
+
+func (o PartOp) sector() int64 {
+    if o.SectorSize == 0 {
+        return 512
+    }
+    return o.SectorSize
+}
+
+// scriptLine is the sfdisk input line that creates the partition.
+func (o PartOp) scriptLine() string {
+    sector := o.sector()
+    line := fmt.Sprintf("start=%d, size=%d, type=%s", o.Start/sector, o.Size/sector, o.typeID())
+    if o.Label != "" && o.Table != "dos" {
+        line += ", name=" + strconv.Quote(o.Label)
+    }
+    return line
+}
+
+// sfdiskScript renders a new table in sfdisk's input format. Partitions
+// start on MiB boundaries, so the first usable sector is at 1 MiB.
+func (o PartOp) sfdiskScript() string {
+    lines := []string{"label: " + o.Table, "unit: sectors"}
+    if o.Table == "gpt" {
+        lines = append(lines, fmt.Sprintf("first-lba: %d", mib/o.sector()))
+    }
+    lines = append(lines, "")
+    for _, p := range o.Parts {
+        p.Table, p.SectorSize = o.Table, o.SectorSize
+        lines = append(lines, p.scriptLine())
+    }
+    return strings.Join(lines, "\n")
+}
+
+// Apply writes the change with sfdisk. Every change is followed by a
+// re-read of the table and udevadm settle, so the device nodes match the
+// table before anything uses them. A filesystem the registry can resize is
+// shrunk before its partition shrinks and grown to fill it after it grows.
+func (o PartOp) Apply(r Runner) error {
+    sector := o.sector()
+    switch o.Kind {
+    case opNewTable:
+        if writesNatively(o.Disk) {
+            if err := writeTableNatively(r, o); err != nil || !strings.HasPrefix(o.Disk, "/dev/") {
+                return err
+            }
+            return settle(r, o.Disk)
+        }
+        if err := runCommand(r, "sfdiskWrite", o.sfdiskScript(), o.Disk); err != nil {
+            return err
+        }
+        return settle(r, o.Disk)
+    case opCreate:
+        if err := runCommand(r, "sfdiskAppend", o.scriptLine(), o.Disk); err != nil {
+            return err
+        }
+        return settle(r, o.Disk)
+    case opDelete:
+        if err := runCommand(r, "sfdiskDelete", o.Disk, o.Number); err != nil {
+            return err
+        }
+        return settle(r, o.Disk)
+    case opResize:
+        dev := partPath(o.Disk, o.Number)
+        if err := checkResizePart(dev, o.FSType, o.FSSize, o.From, o.Size); err != nil {
+            return fmt.Errorf("[PartOp] %w", err)
+        }
+        if o.Size < o.From && canResize(o.FSType, o.From, o.Size) {
+            if err := resizeFilesystem(r, dev, o.FSType, o.Size); err != nil {
+                return err
+            }
+        }
+        if err := runCommand(r, "sfdiskResize", fmt.Sprintf(",%d", o.Size/sector), o.Number, o.Disk); err != nil {
+            return err
+        }
+        if err := settle(r, o.Disk); err != nil {
+            return err
+        }
+        if o.Size > o.From {
+            return resizeFilesystem(r, dev, o.FSType, 0)
+        }
+        return nil
+    case opSetType:
+        if err := runCommand(r, "sfdiskType", o.Disk, o.Number, o.typeID()); err != nil {
+            return err
+        }
+        return settle(r, o.Disk)
+    case opSetLabel:
+        if err := runCommand(r, "sfdiskLabel", o.Disk, o.Number, o.Label); err != nil {
+            return err
+        }
+        return settle(r, o.Disk)
+    }
+    return fmt.Errorf("[PartOp] Unknown operation %d", o.Kind)
+}
+
+// checkResizePart refuses a partition resize from bytes to size that the
+// filesystem on dev cannot follow. A filesystem the registry can resize
+// that way is shrunk before or grown after the partition. Any other
+// shrink must keep the fsSize bytes the filesystem spans, which is unsafe
+// when fsSize is not known. Signatures the registry does not know, like
+// LUKS or LVM, may grow and are left as they are.
+func checkResizePart(dev, fsType string, fsSize, from, size int64) error {
+    if fsType == "" || size == from {
+        return nil
+    }
+    _, err := lookupFilesystem(fsType)
+    known := err == nil
+    if known && canResize(fsType, from, size) {
+        return nil
+    }
+    if size > from {
+        if known {
+            return fmt.Errorf("%s cannot grow, %s would not use the new space", fsType, dev)
+        }
+        return nil
+    }
+    if fsSize == 0 {
+        return fmt.Errorf("the size of the %s on %s is not known, shrinking it could cut it off", fsType, dev)
+    }
+    if size < fsSize {
+        return fmt.Errorf("%s holds %s, shrinking it below %s would cut it off", dev, fsType, humanSize(fsSize))
+    }
+    return nil
+}
+
+// resizeMount is where filesystems that only resize while mounted are
+// mounted for it.
+const resizeMount = "/run/phyos-resize"
+
+// resizeFilesystem resizes the filesystem of type fsType on dev to size
+// bytes, or grows it to fill dev when size is zero. Filesystems the registry
+// cannot resize are left alone.
+func resizeFilesystem(r Runner, dev, fsType string, size int64) error {
+    f, err := lookupFilesystem(fsType)
+    if err != nil {
+        return nil
+    }
+    key, args := f.Grow, []interface{}{}
+    if size > 0 {
+        key, args = f.Shrink, []interface{}{size / 1024}
+    }
+    if key == "" {
+        return nil
+    }
+    if !f.ResizeMounted {
+        return runCommand(r, key, append([]interface{}{dev}, args...)...)
+    }
+    if err := runCommand(r, "mkdirTarget", resizeMount); err != nil {
+        return err
+    }
+    if err := runCommand(r, "mountDev", dev, resizeMount); err != nil {
+        return err
+    }
+    err = runCommand(r, key, append([]interface{}{resizeMount}, args...)...)
+    if uerr := runCommand(r, "umountDev", resizeMount); err == nil {
+        err = uerr
+    }
+    return err
+}
+
+// settle makes the kernel re-read the table of disk and waits for udev to
+// create the device nodes.
+func settle(r Runner, disk string) error {
+    if err := runCommand(r, "partprobe", disk); err != nil {
+        return err
+    }
+    return runCommand(r, "udevSettle")
+}
+
+// writesNatively reports whether the table of disk is written by the gpt
+// package instead of sfdisk: disk images and loop devices.
+func writesNatively(disk string) bool {
+    if strings.HasPrefix(disk, "/dev/loop") {
+        return true
+    }
+    st, err := os.Stat(disk)
+    return err == nil && st.Mode().IsRegular()
+}
+
+// writeTableNatively writes the new table of o and reads it back to check
+// it. A dry run only records the step.
+func writeTableNatively(r Runner, o PartOp) error {
+    if p, ok := r.(planRecorder); ok {
+        p.Record("", fmt.Sprintf("write a new %s partition table with %d partitions to %s", tableName(o.Table), len(o.Parts), o.Disk))
+        return nil
+    }
+    f, err := os.OpenFile(o.Disk, os.O_RDWR, 0)
+    if err != nil {
+        return fmt.Errorf("[writeTableNatively] %w", err)
+    }
+    defer f.Close()
+    size, err := f.Seek(0, io.SeekEnd)
+    if err != nil {
+        return fmt.Errorf("[writeTableNatively] %w", err)
+    }
+    t := &gpt.Table{Label: o.Table, SectorSize: o.sector(), DiskSize: size}
+    for _, p := range o.Parts {
+        p.Table = o.Table
+        t.Parts = append(t.Parts, gpt.Partition{Number: p.Number, Start: p.Start, Size: p.Size / t.SectorSize * t.SectorSize, Type: p.typeID(), Name: p.Label})
+    }
+    if err := t.Write(f); err != nil {
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        return fmt.Errorf("[writeTableNatively] %w", err)
+    }
+    back, err := gpt.Read(f, size, t.SectorSize)
+    if err != nil {
+        return fmt.Errorf("[writeTableNatively] reading back %s: %w", o.Disk, err)
+    }
+    if len(back.Parts) != len(t.Parts) {
+        return fmt.Errorf("[writeTableNatively] %s holds %d partitions after writing %d", o.Disk, len(back.Parts), len(t.Parts))
+    }
+    return nil
+}
+
+func (o PartOp) String() string {
+    dev := partPath(o.Disk, o.Number)
+    switch o.Kind {
+    case opNewTable:
+        s := fmt.Sprintf("New %s partition table on %s", tableName(o.Table), o.Disk)
+        for _, p := range o.Parts {
+            s += "\n     " + p.String()
+        }
+        return s
+    case opCreate:
+        s := fmt.Sprintf("Create %s, %s, %s", dev, humanSize(o.Size), o.Type.Name)
+        if o.Label != "" {
+            s += fmt.Sprintf(", label %q", o.Label)
+        }
+        return s
+    case opDelete:
+        return "Delete " + dev
+    case opResize:
+        return fmt.Sprintf("Resize %s to %s", dev, humanSize(o.Size))
+    case opSetType:
+        return fmt.Sprintf("Set type of %s to %s", dev, o.Type.Name)
+    case opSetLabel:
+        return fmt.Sprintf("Set label of %s to %q", dev, o.Label)
+    }
+    return "Unknown operation on " + dev
+}
+
+func tableName(t string) string {
+    if t == "dos" {
+        return "MBR"
+    }
+    return strings.ToUpper(t)
+}
+
+// apply performs op on the layout, refusing anything the disk cannot hold.
+func (l *diskLayout) apply(op PartOp) error {
+    if op.Kind == opNewTable {
+        if op.Table != "gpt" && op.Table != "dos" {
+            return fmt.Errorf("Unknown partition table %q, expected gpt or dos", op.Table)
+        }
+        l.Table, l.Parts = op.Table, nil
+        for _, p := range op.Parts {
+            p.Kind = opCreate
+            if err := l.apply(p); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if op.Kind == opCreate {
+        if op.Start%mib != 0 {
+            return fmt.Errorf("Partitions must start on a MiB boundary")
+        }
+        if l.Table == "dos" && len(l.Parts) >= 4 {
+            return fmt.Errorf("An MBR disk holds at most 4 primary partitions")
+        }
+        if op.Size < mib {
+            return fmt.Errorf("Partitions must be at least 1 MiB")
+        }
+        var fits bool
+        for _, s := range l.segments() {
+            if s.Part == nil && op.Start >= s.Start && op.Start+op.Size <= s.Start+s.Size {
+                fits = true
+            }
+        }
+        if !fits {
+            return fmt.Errorf("%s does not fit in free space", humanSize(op.Size))
+        }
+        l.Parts = append(l.Parts, &layoutPart{
+            Number: op.Number,
+            Path:   partPath(l.Disk.Path, op.Number),
+            Start:  op.Start,
+            Size:   op.Size,
+            Type:   op.Type.GUID,
+            Label:  op.Label,
+        })
+        l.sort()
+        return nil
+    }
+
+    p := l.part(op.Number)
+    if p == nil {
+        return fmt.Errorf("%s has no partition %d", l.Disk.Path, op.Number)
+    }
+    switch op.Kind {
+    case opDelete:
+        for i := range l.Parts {
+            if l.Parts[i] == p {
+                l.Parts = append(l.Parts[:i], l.Parts[i+1:]...)
+                break
+            }
+        }
+    case opResize:
+        if op.Size < mib {
+            return fmt.Errorf("Partitions must be at least 1 MiB")
+        }
+        if op.Size > p.Size+l.freeAfter(p) {
+            return fmt.Errorf("%s does not fit, at most %s is available", humanSize(op.Size), humanSize(p.Size+l.freeAfter(p)))
+        }
+        if err := checkResizePart(p.Path, p.FSType, p.FSSize, p.Size, op.Size); err != nil {
+            return err
+        }
+        p.Size = op.Size
+    case opSetType:
+        p.Type = op.Type.GUID
+    case opSetLabel:
+        if l.Table == "dos" {
+            return fmt.Errorf("MBR partitions cannot have labels")
+        }
+        p.Label = op.Label
+    }
+    return nil
+}
+
+// parseSize reads a size typed into the editor: "512M", "20G", "1.5T",
+// "30%" of avail, or "rest" for all of avail. Sizes as humanSize writes
+// them, like "10.00 GiB", are read too. The result is rounded down to whole
+// MiB.
+func parseSize(s string, avail int64) (int64, error) {
+    s = strings.ReplaceAll(strings.ToUpper(s), " ", "")
+    var size int64
+    switch {
+    case s == "REST":
+        size = avail
+    case strings.HasSuffix(s, "%"):
+        pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+        if err != nil || pct <= 0 || pct > 100 {
+            return 0, fmt.Errorf("%q is not a percentage between 0 and 100", s)
+        }
+        size = int64(float64(avail) * pct / 100)
+    default:
+        s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+        if s == "" {
+            return 0, fmt.Errorf("Size is empty")
+        }
+        units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+        unit, ok := units[s[len(s)-1]]
+        if !ok {
+            return 0, fmt.Errorf("%q needs a unit: K, M, G or T", s)
+        }
+        v, err := strconv.ParseFloat(s[:len(s)-1], 64)
+        if err != nil || v <= 0 {
+            return 0, fmt.Errorf("%q is not a size", s)
+        }
+        size = int64(v * unit)
+    }
+    size = size / mib * mib
+    if size < mib {
+        return 0, fmt.Errorf("Partitions must be at least 1 MiB")
+    }
+    if size > avail {
+        return 0, fmt.Errorf("%s is more than the %s available", humanSize(size), humanSize(avail))
+    }
+    return size, nil
+}
+
+func humanSize(n int64) string {
+    units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+    v, i := float64(n), 0
+    for v >= 1024 && i < len(units)-1 {
+        v /= 1024
+        i++
+    }
+    return strconv.FormatFloat(v, 'f', 2, 64) + " " + units[i]
+}
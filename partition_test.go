@@ -0,0 +1,113 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestPartOpResizeGrowsFilesystem(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    op := PartOp{Kind: opResize, Disk: "/dev/sda", Number: 3, From: 10 << 30, Size: 20 << 30, FSType: "xfs", FSSize: 10 << 30}
+    if err := op.Apply(f); err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, "echo ,41943040 | sfdisk -N 3 /dev/sda", "partprobe /dev/sda", "udevadm settle",
+        "mkdir -p "+resizeMount, "mount /dev/sda3 "+resizeMount, "xfs_growfs "+resizeMount, "umount "+resizeMount)
+
+    f = NewFakeRunner()
+    op.FSType = "ext4"
+    if err := op.Apply(f); err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, "echo ,41943040 | sfdisk -N 3 /dev/sda", "partprobe /dev/sda", "udevadm settle",
+        "{ e2fsck -f -p /dev/sda3 || [ $? -le 1 ]; } && resize2fs /dev/sda3")
+}
+
+func TestPartOpShrinkShrinksFilesystemFirst(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    op := PartOp{Kind: opResize, Disk: "/dev/sda", Number: 3, From: 20 << 30, Size: 10 << 30, FSType: "ext4", FSSize: 20 << 30}
+    if err := op.Apply(f); err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, "{ e2fsck -f -p /dev/sda3 || [ $? -le 1 ]; } && resize2fs /dev/sda3 10485760K",
+        "echo ,20971520 | sfdisk -N 3 /dev/sda", "partprobe /dev/sda", "udevadm settle")
+
+    f = NewFakeRunner()
+    op.FSType, op.FSSize = "xfs", 8<<30
+    if err := op.Apply(f); err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, "echo ,20971520 | sfdisk -N 3 /dev/sda", "partprobe /dev/sda", "udevadm settle")
+}
+
+func TestCheckResizePart(t *testing.T) {
+    for _, c := range []struct {
+        fsType             string
+        fsSize, from, size int64
+        ok                 bool
+    }{
+        {"", 0, 20 << 30, 10 << 30, true},
+        {"ext4", 0, 20 << 30, 10 << 30, true},
+        {"xfs", 8 << 30, 20 << 30, 10 << 30, true},
+        {"xfs", 12 << 30, 20 << 30, 10 << 30, false},
+        {"xfs", 0, 20 << 30, 10 << 30, false},
+        {"xfs", 0, 10 << 30, 20 << 30, true},
+        {"vfat", 1 << 30, 1 << 30, 2 << 30, false},
+        {"crypto_LUKS", 0, 10 << 30, 20 << 30, true},
+    } {
+        err := checkResizePart("/dev/sda3", c.fsType, c.fsSize, c.from, c.size)
+        if (err == nil) != c.ok {
+            t.Errorf("resizing %s of %d bytes from %d to %d: %v, want ok %v", c.fsType, c.fsSize, c.from, c.size, err, c.ok)
+        }
+    }
+}
+
+func TestParseSizeReadsHumanSize(t *testing.T) {
+    for _, s := range []string{humanSize(10 << 30), "10240M", "10 GiB", "10g"} {
+        if size, err := parseSize(s, 20<<30); err != nil || size != 10<<30 {
+            t.Errorf("parseSize(%q) = %d, %v, want 10 GiB", s, size, err)
+        }
+    }
+}
+
+func TestSfdiskScript(t *testing.T) {
+    esp, root := partTypeByName("EFI System"), partTypeByName("Linux filesystem")
+    parts := []PartOp{
+        {Start: mib, Size: 512 * mib, Type: esp, Label: "EFI"},
+        {Start: 513 * mib, Size: 20 << 30, Type: root, Label: "phyOS root"},
+    }
+    for _, c := range []struct {
+        table  string
+        sector int64
+        want   string
+    }{
+        {"gpt", 512, "label: gpt\nunit: sectors\nfirst-lba: 2048\n\n" +
+            "start=2048, size=1048576, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, name=\"EFI\"\n" +
+            "start=1050624, size=41943040, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name=\"phyOS root\""},
+        {"gpt", 4096, "label: gpt\nunit: sectors\nfirst-lba: 256\n\n" +
+            "start=256, size=131072, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, name=\"EFI\"\n" +
+            "start=131328, size=5242880, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, name=\"phyOS root\""},
+        // MBR has no partition names, and types are one byte ids.
+        {"dos", 4096, "label: dos\nunit: sectors\n\n" +
+            "start=256, size=131072, type=ef\n" +
+            "start=131328, size=5242880, type=83"},
+    } {
+        op := PartOp{Kind: opNewTable, Disk: "/dev/sda", Table: c.table, SectorSize: c.sector, Parts: parts}
+        if got := op.sfdiskScript(); got != c.want {
+            t.Errorf("%s with %d byte sectors:\n%s\nwant\n%s", c.table, c.sector, got, c.want)
+        }
+    }
+}
+
+func TestPartOpCreateAppendsInSectors(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    op := PartOp{Kind: opCreate, Disk: "/dev/sda", Table: "gpt", SectorSize: 4096, Number: 3,
+        Start: 2 << 30, Size: 8 << 30, Type: partTypeByName("Linux swap"), Label: "swap"}
+    if err := op.Apply(f); err != nil {
+        t.Fatal(err)
+    }
+    checkCalls(t, f, `echo 'start=524288, size=2097152, type=0657FD6D-A4AB-43C4-84E5-0933C84B4F4F, name="swap"' | sfdisk --append /dev/sda`,
+        "partprobe /dev/sda", "udevadm settle")
+}
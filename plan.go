@@ -0,0 +1,192 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+)
+
+// Secret is a command argument that must never show up in a plan. It
+// formats as a placeholder; runCommand substitutes the real value only in
+// the line that is actually executed.
+type Secret string
+
+func (Secret) String() string { return "<redacted>" }
+
+func (s Secret) GoString() string { return s.String() }
+
+// MarshalJSON and MarshalYAML keep secrets out of anything serialized by
+// accident; SaveConfig hashes or drops them before writing an answers file.
+func (s Secret) MarshalJSON() ([]byte, error) {
+    return json.Marshal(s.String())
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+    return s.String(), nil
+}
+
+// PlanStep is one command the installer would have executed.
+type PlanStep struct {
+    Key string
+    Cmd string
+}
+
+// planRecorder is implemented by runners that collect commands instead of
+// executing them.
+type planRecorder interface {
+    Record(key, cmd string)
+}
+
+// DryRunner passes read-only probes through to Inner and collects every
+// command that would modify the machine into an ordered plan.
+type DryRunner struct {
+    Inner Runner
+    Steps []PlanStep
+}
+
+func (d *DryRunner) Run(cmd string) error {
+    d.Record("", cmd)
+    return nil
+}
+
+func (d *DryRunner) Output(cmd string) ([]byte, error) {
+    return d.Inner.Output(cmd)
+}
+
+func (d *DryRunner) ExecInput(argv []string, stdin Secret) error {
+    d.Record("", stdinString(argv, stdin))
+    return nil
+}
+
+func (d *DryRunner) Record(key, cmd string) {
+    d.Steps = append(d.Steps, PlanStep{key, cmd})
+}
+
+func (d *DryRunner) String() string {
+    return formatPlan(d.Steps)
+}
+
+func formatPlan(steps []PlanStep) string {
+    if len(steps) == 0 {
+        return "Nothing to do.\n"
+    }
+    var b strings.Builder
+    for i, s := range steps {
+        if s.Key != "" {
+            fmt.Fprintf(&b, "%3d. [%s] %s\n", i+1, s.Key, s.Cmd)
+        } else {
+            fmt.Fprintf(&b, "%3d. %s\n", i+1, s.Cmd)
+        }
+    }
+    return b.String()
+}
+
+// shellArgs is a run of options the caller has already made safe for bash,
+// such as the label options of mkfs. It goes into a template as it is.
+type shellArgs string
+
+// shellCommand fills in the commands[key] template. Every string argument
+// is quoted into a single word, so nothing from an answers file or the TUI
+// can reach bash as syntax.
+func shellCommand(key string, args ...interface{}) string {
+    quoted := make([]interface{}, len(args))
+    for i, a := range args {
+        switch v := a.(type) {
+        case shellArgs:
+            quoted[i] = string(v)
+        case string:
+            quoted[i] = shellWord(v)
+        default:
+            quoted[i] = a
+        }
+    }
+    return fmt.Sprintf(commands[key], quoted...)
+}
+
+// runCommand fills in the commands[key] template and runs it through bash.
+// Secrets are refused: they would end up in the process list and in the
+// hands of the shell. Use runSecret for commands that need one.
+func runCommand(r Runner, key string, args ...interface{}) error {
+    if _, ok := commands[key]; !ok {
+        return fmt.Errorf("[runCommand] Unknown command %q", key)
+    }
+    for _, a := range args {
+        if _, ok := a.(Secret); ok {
+            return fmt.Errorf("[runCommand] %s: secrets must be passed with runSecret", key)
+        }
+    }
+    cmd := shellCommand(key, args...)
+    if p, ok := r.(planRecorder); ok {
+        p.Record(key, cmd)
+        return nil
+    }
+    if err := r.Run(cmd); err != nil {
+        return fmt.Errorf("[%s] %w", key, err)
+    }
+    return nil
+}
+
+// runSecret runs the commands[key] template without a shell and feeds
+// stdin to it. The template is split into words before it is filled in, so
+// an argument stays one argument whatever it contains.
+func runSecret(r Runner, key string, stdin Secret, args ...interface{}) error {
+    argv, err := commandArgv(key, args...)
+    if err != nil {
+        return err
+    }
+    if p, ok := r.(planRecorder); ok {
+        p.Record(key, stdinString(argv, stdin))
+        return nil
+    }
+    if err := r.ExecInput(argv, stdin); err != nil {
+        return fmt.Errorf("[%s] %w", key, err)
+    }
+    return nil
+}
+
+func commandArgv(key string, args ...interface{}) ([]string, error) {
+    tmpl, ok := commands[key]
+    if !ok {
+        return nil, fmt.Errorf("[runSecret] Unknown command %q", key)
+    }
+    var argv []string
+    for _, word := range strings.Fields(tmpl) {
+        n := strings.Count(word, "%") - 2*strings.Count(word, "%%")
+        if n > len(args) {
+            return nil, fmt.Errorf("[runSecret] %s: not enough arguments", key)
+        }
+        argv = append(argv, fmt.Sprintf(word, args[:n]...))
+        args = args[n:]
+    }
+    if len(args) > 0 {
+        return nil, fmt.Errorf("[runSecret] %s: too many arguments", key)
+    }
+    return argv, nil
+}
+
+// argvString renders argv as a command line for plans and logs.
+func argvString(argv []string) string {
+    words := make([]string, len(argv))
+    for i, a := range argv {
+        words[i] = shellWord(a)
+    }
+    return strings.Join(words, " ")
+}
+
+func stdinString(argv []string, stdin Secret) string {
+    return argvString(argv) + " < " + stdin.String()
+}
+
+// planModel is the Plan tab shown in dry-run mode. err is why the install
+// would fail, in place of its commands.
+type planModel struct {
+    steps []PlanStep
+    err   error
+}
+
+func (p planModel) View() string {
+    if p.err != nil {
+        return "\n" + inputStyle.Render(p.err.Error()) + "\n"
+    }
+    return "\n" + inputStyle.Render("Commands that would be executed:") + "\n\n" + formatPlan(p.steps)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestDryRunnerRedactsSecrets(t *testing.T) {
+    makeCmdMap()
+    blockDevices = nil
+    cfg := testConfig()
+    cfg.Disk.Encryption.Passphrase = "disk passphrase"
+    cfg.Users = []UserConfig{{Name: "alice", Password: "login password"}}
+    f := NewFakeRunner()
+    d := &DryRunner{Inner: f}
+    if err := Install(d, cfg, nil, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    plan := d.String()
+    for _, secret := range []string{"disk passphrase", "login password", "$6$"} {
+        if strings.Contains(plan, secret) {
+            t.Errorf("plan shows %q:\n%s", secret, plan)
+        }
+    }
+    for _, want := range []string{"luksFormat --type luks2", "open --type luks --key-file - /dev/phyos-test2 phyos < <redacted>", "chpasswd -e < <redacted>"} {
+        if !strings.Contains(plan, want) {
+            t.Errorf("plan has no %q:\n%s", want, plan)
+        }
+    }
+    // Only read-only probes pass through to the machine.
+    for _, c := range f.Calls {
+        if !strings.HasPrefix(c, "blkid ") {
+            t.Errorf("the dry run ran %q", c)
+        }
+    }
+}
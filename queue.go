@@ -0,0 +1,216 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    tea "github.com/charmbracelet/bubbletea"
+)
+
+// Operation is one destructive step. Nothing writes to a disk except through
+// Operation.Apply, and operations only run from OpQueue.Apply, so choosing
+// what to do and doing it stay separate.
+type Operation interface {
+    Describe() string
+    Apply(r Runner) error
+}
+
+// OpQueue holds pending operations in the order they will run, with undo
+// and redo of the most recent ones.
+type OpQueue struct {
+    ops    []Operation
+    undone []Operation
+}
+
+// Add queues op and forgets everything that could have been redone.
+func (q *OpQueue) Add(op Operation) {
+    q.ops = append(q.ops, op)
+    q.undone = nil
+}
+
+func (q *OpQueue) Undo() bool {
+    if len(q.ops) == 0 {
+        return false
+    }
+    last := q.ops[len(q.ops)-1]
+    q.ops = q.ops[:len(q.ops)-1]
+    q.undone = append(q.undone, last)
+    return true
+}
+
+// UndoIf undoes the last operation only when match accepts it, so an editor
+// does not take back a change made somewhere else.
+func (q *OpQueue) UndoIf(match func(Operation) bool) bool {
+    if len(q.ops) == 0 || !match(q.ops[len(q.ops)-1]) {
+        return false
+    }
+    return q.Undo()
+}
+
+func (q *OpQueue) Redo() bool {
+    if len(q.undone) == 0 {
+        return false
+    }
+    last := q.undone[len(q.undone)-1]
+    q.undone = q.undone[:len(q.undone)-1]
+    q.ops = append(q.ops, last)
+    return true
+}
+
+func (q *OpQueue) Ops() []Operation {
+    return q.ops
+}
+
+func (q *OpQueue) Len() int {
+    return len(q.ops)
+}
+
+// partOps returns the partition table changes in the queue.
+func (q *OpQueue) partOps() []PartOp {
+    var out []PartOp
+    for _, op := range q.ops {
+        switch p := op.(type) {
+        case PartOp:
+            out = append(out, p)
+        case guidedOp:
+            out = append(out, p.PartOp)
+        }
+    }
+    return out
+}
+
+// lvmChanges returns the LVM changes in the queue.
+func (q *OpQueue) lvmChanges() []LVMOp {
+    var out []LVMOp
+    for _, op := range q.ops {
+        if l, ok := op.(LVMOp); ok {
+            out = append(out, l)
+        }
+    }
+    return out
+}
+
+// Apply runs the queued operations in order and stops at the first failure.
+// progress, when not nil, is called before each operation starts.
+func (q *OpQueue) Apply(r Runner, progress func(i, n int, op Operation)) error {
+    for i, op := range q.ops {
+        if progress != nil {
+            progress(i, len(q.ops), op)
+        }
+        if err := op.Apply(r); err != nil {
+            return fmt.Errorf("[Apply] %s: %w", op.Describe(), err)
+        }
+    }
+    q.ops, q.undone = nil, nil
+    return nil
+}
+
+// cmdOp runs one entry of the commands map.
+type cmdOp struct {
+    key  string
+    args []interface{}
+}
+
+func newCmdOp(key string, args ...interface{}) cmdOp {
+    return cmdOp{key, args}
+}
+
+func (o cmdOp) Describe() string {
+    return shellCommand(o.key, o.args...)
+}
+
+func (o cmdOp) Apply(r Runner) error {
+    return runCommand(r, o.key, o.args...)
+}
+
+// stdinOp runs one entry of the commands map without a shell, with a
+// secret on its standard input.
+type stdinOp struct {
+    key   string
+    stdin Secret
+    args  []interface{}
+}
+
+func newStdinOp(key string, stdin Secret, args ...interface{}) stdinOp {
+    return stdinOp{key, stdin, args}
+}
+
+func (o stdinOp) Describe() string {
+    argv, err := commandArgv(o.key, o.args...)
+    if err != nil {
+        return err.Error()
+    }
+    return stdinString(argv, o.stdin)
+}
+
+func (o stdinOp) Apply(r Runner) error {
+    return runSecret(r, o.key, o.stdin, o.args...)
+}
+
+func printProgress(i, n int, op Operation) {
+    fmt.Printf("[%d/%d] %s\n", i+1, n, op.Describe())
+}
+
+// queueModel is the Pending tab: the queued edits, the installation steps
+// that follow them, and the explicit Apply step.
+type queueModel struct {
+    q          *OpQueue
+    install    []Operation
+    boot       string
+    warnings   []string
+    err        error
+    confirming bool
+}
+
+func (m queueModel) update(msg tea.KeyMsg) (queueModel, bool) {
+    if m.confirming {
+        m.confirming = false
+        return m, msg.String() == "y"
+    }
+    switch msg.String() {
+    case "u":
+        m.q.Undo()
+    case "r":
+        m.q.Redo()
+    case "a":
+        m.confirming = m.err == nil && m.q.Len()+len(m.install) > 0
+    }
+    return m, false
+}
+
+func (m queueModel) View() string {
+    var b strings.Builder
+    b.WriteString("\n" + inputStyle.Render("Pending changes:") + "\n\n")
+    if m.q.Len() == 0 {
+        b.WriteString("  none\n")
+    }
+    for i, op := range m.q.Ops() {
+        fmt.Fprintf(&b, "%3d. %s\n", i+1, op.Describe())
+    }
+    if len(m.install) > 0 {
+        b.WriteString("\n" + inputStyle.Render("Then install:") + "\n\n")
+        for i, op := range m.install {
+            fmt.Fprintf(&b, "%3d. %s\n", m.q.Len()+i+1, op.Describe())
+        }
+    }
+    b.WriteString("\n")
+    if m.boot != "" {
+        b.WriteString("Bootloader: " + m.boot + "\n\n")
+    }
+    for _, w := range m.warnings {
+        b.WriteString(continueStyle.Render("warning: "+w) + "\n")
+    }
+    if len(m.warnings) > 0 {
+        b.WriteString("\n")
+    }
+    if m.err != nil {
+        b.WriteString(inputStyle.Render(m.err.Error()) + "\n\n")
+    }
+    if m.confirming {
+        n := m.q.Len() + len(m.install)
+        b.WriteString(inputStyle.Render(fmt.Sprintf("Apply %d operations now? This cannot be undone. (y/n)", n)) + "\n")
+    } else {
+        b.WriteString(continueStyle.Render("u: undo  r: redo  b: bootloader  a: apply") + "\n")
+    }
+    return b.String()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// queued lists what q holds, one Describe per operation.
+func queued(q *OpQueue) string {
+    var s []string
+    for _, op := range q.Ops() {
+        s = append(s, op.Describe())
+    }
+    return strings.Join(s, "; ")
+}
+
+func TestOpQueueUndoRedo(t *testing.T) {
+    makeCmdMap()
+    q := &OpQueue{}
+    if q.Undo() || q.Redo() {
+        t.Fatal("undo or redo of an empty queue did something")
+    }
+    q.Add(newCmdOp("mkdirTarget", "/a"))
+    q.Add(newCmdOp("mkdirTarget", "/b"))
+    q.Add(newCmdOp("mkdirTarget", "/c"))
+
+    if !q.Undo() || !q.Undo() || queued(q) != "mkdir -p /a" {
+        t.Fatalf("after two undos the queue holds %q", queued(q))
+    }
+    if !q.Redo() || queued(q) != "mkdir -p /a; mkdir -p /b" {
+        t.Fatalf("after a redo the queue holds %q", queued(q))
+    }
+
+    // A new operation forgets what could have been redone.
+    q.Add(newCmdOp("mkdirTarget", "/d"))
+    if q.Redo() {
+        t.Errorf("redid %q after a new Add", queued(q))
+    }
+    if queued(q) != "mkdir -p /a; mkdir -p /b; mkdir -p /d" || q.Len() != 3 {
+        t.Errorf("queue holds %q", queued(q))
+    }
+
+    for q.Undo() {
+    }
+    if q.Len() != 0 {
+        t.Fatalf("queue holds %q after undoing everything", queued(q))
+    }
+    for q.Redo() {
+    }
+    if queued(q) != "mkdir -p /a; mkdir -p /b; mkdir -p /d" {
+        t.Errorf("redoing everything gives %q", queued(q))
+    }
+}
+
+func TestOpQueueUndoIf(t *testing.T) {
+    q := &OpQueue{}
+    q.Add(PartOp{Kind: opDelete, Disk: "/dev/sda", Number: 1})
+    q.Add(LVMOp{Kind: lvmRemoveVG, VG: "vg0"})
+    onSda := func(op Operation) bool {
+        p, ok := op.(PartOp)
+        return ok && p.Disk == "/dev/sda"
+    }
+    if q.UndoIf(onSda) || q.Len() != 2 {
+        t.Fatalf("undid the LVM change from the partition editor, %d left", q.Len())
+    }
+    q.Undo()
+    if !q.UndoIf(onSda) || q.Len() != 0 {
+        t.Errorf("did not undo the partition change, %d left", q.Len())
+    }
+}
+
+func TestOpQueueApply(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Errors["mkdir -p /b"] = errFake
+    q := &OpQueue{}
+    for _, dir := range []string{"/a", "/b", "/c"} {
+        q.Add(newCmdOp("mkdirTarget", dir))
+    }
+    var started []int
+    err := q.Apply(f, func(i, n int, op Operation) { started = append(started, i) })
+    if err == nil || !strings.Contains(err.Error(), "mkdir -p /b") {
+        t.Errorf("got %v, want the failure of mkdir -p /b", err)
+    }
+    checkCalls(t, f, "mkdir -p /a", "mkdir -p /b")
+    if len(started) != 2 || q.Len() != 3 {
+        t.Errorf("started %v and kept %d operations, want the queue kept after a failure", started, q.Len())
+    }
+
+    delete(f.Errors, "mkdir -p /b")
+    if err := q.Apply(f, nil); err != nil || q.Len() != 0 || q.Redo() {
+        t.Errorf("Apply gave %v and left %d operations to run and redo", err, q.Len())
+    }
+}
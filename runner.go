@@ -0,0 +1,100 @@
+package main
+
+import (
+    "fmt"
+    "os/exec"
+    "sort"
+    "strings"
+)
+
+// Runner executes the shell commands built from the commands map. Every
+// probe and every destructive action of the installer goes through one, so
+// the backend can be swapped for tests or for machines with no disks to wipe.
+type Runner interface {
+    // Run executes cmd and waits for it to finish.
+    Run(cmd string) error
+    // Output executes cmd and returns its standard output.
+    Output(cmd string) ([]byte, error)
+    // ExecInput executes argv directly, without a shell, and writes stdin
+    // to its standard input. It is how passwords reach a command.
+    ExecInput(argv []string, stdin Secret) error
+}
+
+// ExecRunner runs commands on the local machine through bash.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd string) error {
+    return exec.Command("/bin/bash", "-c", cmd).Run()
+}
+
+func (ExecRunner) Output(cmd string) ([]byte, error) {
+    return exec.Command("/bin/bash", "-c", cmd).Output()
+}
+
+func (ExecRunner) ExecInput(argv []string, stdin Secret) error {
+    cmd := exec.Command(argv[0], argv[1:]...)
+    cmd.Stdin = strings.NewReader(string(stdin))
+    return cmd.Run()
+}
+
+// FakeRunner records every command it is given and never executes anything.
+// Outputs and Errors are looked up by exact command first and then by the
+// longest matching prefix, so a single entry can answer a family of probes.
+type FakeRunner struct {
+    Outputs map[string]string
+    Errors  map[string]error
+    Calls   []string
+}
+
+func NewFakeRunner() *FakeRunner {
+    return &FakeRunner{
+        Outputs: make(map[string]string),
+        Errors:  make(map[string]error),
+    }
+}
+
+func (f *FakeRunner) Run(cmd string) error {
+    _, err := f.Output(cmd)
+    return err
+}
+
+// ExecInput records argv like a command line; stdin is not kept.
+func (f *FakeRunner) ExecInput(argv []string, stdin Secret) error {
+    return f.Run(argvString(argv))
+}
+
+func (f *FakeRunner) Output(cmd string) ([]byte, error) {
+    f.Calls = append(f.Calls, cmd)
+    if err, ok := lookupCmd(f.Errors, cmd); ok {
+        return nil, err
+    }
+    out, _ := lookupCmd(f.Outputs, cmd)
+    return []byte(out), nil
+}
+
+func lookupCmd[T any](m map[string]T, cmd string) (T, bool) {
+    if v, ok := m[cmd]; ok {
+        return v, true
+    }
+    var prefixes []string
+    for k := range m {
+        if strings.HasPrefix(cmd, k) {
+            prefixes = append(prefixes, k)
+        }
+    }
+    var zero T
+    if len(prefixes) == 0 {
+        return zero, false
+    }
+    sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+    return m[prefixes[0]], true
+}
+
+// String lists the recorded commands, one per line.
+func (f *FakeRunner) String() string {
+    var b strings.Builder
+    for i, c := range f.Calls {
+        fmt.Fprintf(&b, "%3d  %s\n", i+1, c)
+    }
+    return b.String()
+}
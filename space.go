@@ -0,0 +1,182 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// SpaceInfo is the size and usage of a filesystem in bytes. Known is false
+// when they could not be determined, which the UI shows as "unknown".
+type SpaceInfo struct {
+    Total lsblkNum
+    Free  lsblkNum
+    Used  lsblkNum
+    Known bool
+}
+
+// unprobeable lists the FSTYPE values that have no filesystem to measure.
+var unprobeable = map[string]bool{
+    "":                  true,
+    "swap":              true,
+    "crypto_LUKS":       true,
+    "LVM2_member":       true,
+    "linux_raid_member": true,
+    "BitLocker":         true,
+}
+
+// roMountOptions keeps a probe mount from replaying journals or logs, which
+// would write to a filesystem we only want to look at.
+var roMountOptions = map[string]string{
+    "ext3":  "ro,noload",
+    "ext4":  "ro,noload",
+    "xfs":   "ro,norecovery",
+    "btrfs": "ro,nologreplay",
+    "f2fs":  "ro,norecovery",
+}
+
+// ProbeSpace measures the filesystem on d. Mounted filesystems are measured
+// where they are; others are mounted read-only on a temporary directory and
+// measured with statfs, falling back to tune2fs for ext2/3/4.
+func ProbeSpace(r Runner, d *BlockDevice) SpaceInfo {
+    if unprobeable[d.FSType] {
+        return SpaceInfo{}
+    }
+    if d.Mountpoint != "" {
+        if d.FSSize > 0 {
+            return SpaceInfo{Total: d.FSSize, Free: d.FSAvail, Used: d.FSUsed, Known: true}
+        }
+        return statfsSpace(d.Mountpoint)
+    }
+    if isMounted(r, d.Path) {
+        out, err := r.Output(shellCommand("findMountpoint", d.Path))
+        if err == nil {
+            return statfsSpace(strings.TrimSpace(string(out)))
+        }
+        return SpaceInfo{}
+    }
+    if sp := mountedSpace(r, d); sp.Known {
+        return sp
+    }
+    switch d.FSType {
+    case "ext2", "ext3", "ext4":
+        return extSpace(r, d.Path)
+    }
+    return SpaceInfo{}
+}
+
+// mountedSpace mounts d read-only on a temporary directory to measure it.
+func mountedSpace(r Runner, d *BlockDevice) SpaceInfo {
+    var sp SpaceInfo
+    withProbeMount(r, d, func(dir string) {
+        sp = statfsSpace(dir)
+    })
+    return sp
+}
+
+// withProbeMount mounts d read-only on a temporary directory and calls fn
+// with it. fn is not called when d cannot be mounted, nor in a dry run,
+// whose runner passes the mount through to the machine.
+func withProbeMount(r Runner, d *BlockDevice, fn func(dir string)) {
+    if _, ok := r.(planRecorder); ok {
+        return
+    }
+    dir, err := os.MkdirTemp("", "phyos-probe-")
+    if err != nil {
+        return
+    }
+    defer os.Remove(dir)
+    opts, ok := roMountOptions[d.FSType]
+    if !ok {
+        opts = "ro"
+    }
+    if _, err := r.Output(shellCommand("mountProbe", opts, d.Path, dir)); err != nil {
+        return
+    }
+    defer r.Output(shellCommand("umountProbe", dir))
+    fn(dir)
+}
+
+func statfsSpace(path string) SpaceInfo {
+    var st syscall.Statfs_t
+    if path == "" || syscall.Statfs(path, &st) != nil || st.Blocks == 0 {
+        return SpaceInfo{}
+    }
+    bs := lsblkNum(st.Bsize)
+    return SpaceInfo{
+        Total: lsblkNum(st.Blocks) * bs,
+        Free:  lsblkNum(st.Bavail) * bs,
+        Used:  lsblkNum(st.Blocks-st.Bfree) * bs,
+        Known: true,
+    }
+}
+
+// extSpace reads the superblock of an ext2/3/4 filesystem with tune2fs. The
+// reserved blocks are not counted as free, matching what df reports.
+func extSpace(r Runner, dev string) SpaceInfo {
+    fields := superblock(r, "extStats", dev, ":")
+    bs, total := fields["Block size"], fields["Block count"]
+    if bs == 0 || total == 0 {
+        return SpaceInfo{}
+    }
+    free := fields["Free blocks"] - fields["Reserved block count"]
+    if free < 0 {
+        free = 0
+    }
+    return SpaceInfo{
+        Total: lsblkNum(total * bs),
+        Free:  lsblkNum(free * bs),
+        Used:  lsblkNum((total - fields["Free blocks"]) * bs),
+        Known: true,
+    }
+}
+
+// FilesystemExtent reads from the superblock how many bytes of d the
+// filesystem on it spans, which can be less than d. It is zero when the
+// filesystem has no reader here or the superblock cannot be read.
+func FilesystemExtent(r Runner, d *BlockDevice) int64 {
+    switch d.FSType {
+    case "ext2", "ext3", "ext4":
+        f := superblock(r, "extStats", d.Path, ":")
+        return f["Block count"] * f["Block size"]
+    case "xfs":
+        f := superblock(r, "xfsSuper", d.Path, "=")
+        return f["dblocks"] * f["blocksize"]
+    case "btrfs":
+        return superblock(r, "btrfsSuper", d.Path, "")["dev_item.total_bytes"]
+    }
+    return 0
+}
+
+// superblock runs the dump command key on dev and collects the numeric
+// fields of its "name<sep>value" lines. An empty sep splits on blanks.
+func superblock(r Runner, key, dev, sep string) map[string]int64 {
+    fields := make(map[string]int64)
+    out, err := r.Output(shellCommand(key, dev))
+    if err != nil {
+        return fields
+    }
+    sc := bufio.NewScanner(bytes.NewReader(out))
+    for sc.Scan() {
+        var k, v string
+        if sep == "" {
+            f := strings.Fields(sc.Text())
+            if len(f) != 2 {
+                continue
+            }
+            k, v = f[0], f[1]
+        } else {
+            var ok bool
+            if k, v, ok = strings.Cut(sc.Text(), sep); !ok {
+                continue
+            }
+        }
+        if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+            fields[strings.TrimSpace(k)] = n
+        }
+    }
+    return fields
+}
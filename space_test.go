@@ -0,0 +1,127 @@
+package main
+
+import (
+    "errors"
+    "strings"
+    "testing"
+)
+
+// checkCalls compares the commands f was given with want. A command only
+// has to start with its entry in want, for the ones naming a temporary
+// directory.
+func checkCalls(t *testing.T, f *FakeRunner, want ...string) {
+    t.Helper()
+    if len(f.Calls) != len(want) {
+        t.Errorf("ran\n%swant %d commands starting with %q", f, len(want), want)
+        return
+    }
+    for i, c := range f.Calls {
+        if !strings.HasPrefix(c, want[i]) {
+            t.Errorf("command %d is %q, want one starting with %q", i+1, c, want[i])
+        }
+    }
+}
+
+const tune2fsOutput = `tune2fs 1.47.0 (5-Feb-2023)
+Filesystem volume name:   <none>
+Block count:              1000
+Reserved block count:     50
+Free blocks:              600
+Block size:               4096
+`
+
+var errFake = errors.New("exit status 1")
+
+func TestProbeSpaceWithoutFilesystem(t *testing.T) {
+    makeCmdMap()
+    for _, fs := range []string{"", "swap", "crypto_LUKS", "LVM2_member"} {
+        f := NewFakeRunner()
+        if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda1", FSType: fs}); sp.Known {
+            t.Errorf("%q: measured %+v", fs, sp)
+        }
+        checkCalls(t, f)
+    }
+}
+
+func TestProbeSpaceMounted(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    d := &BlockDevice{Path: "/dev/sda1", FSType: "ext4", Mountpoint: "/", FSSize: 100, FSAvail: 60, FSUsed: 40}
+    want := SpaceInfo{Total: 100, Free: 60, Used: 40, Known: true}
+    if sp := ProbeSpace(f, d); sp != want {
+        t.Errorf("measured %+v, want what lsblk reported", sp)
+    }
+    checkCalls(t, f)
+}
+
+func TestProbeSpaceMountedElsewhere(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Outputs["findmnt -n -f -o TARGET --source /dev/sda1"] = t.TempDir() + "\n"
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda1", FSType: "ext4"}); !sp.Known || sp.Total == 0 {
+        t.Errorf("measured %+v at the mountpoint findmnt found", sp)
+    }
+    checkCalls(t, f, "findmnt /dev/sda1", "findmnt -n -f -o TARGET --source /dev/sda1")
+
+    f.Errors["findmnt -n"] = errFake
+    f.Calls = nil
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda1", FSType: "ext4"}); sp.Known {
+        t.Errorf("measured %+v without a mountpoint", sp)
+    }
+    checkCalls(t, f, "findmnt /dev/sda1", "findmnt -n -f -o TARGET --source /dev/sda1")
+}
+
+func TestProbeSpaceProbeMount(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Errors["findmnt "] = errFake
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda2", FSType: "btrfs"}); !sp.Known {
+        t.Errorf("measured nothing on the probe mount")
+    }
+    checkCalls(t, f, "findmnt /dev/sda2", "mount -o ro,nologreplay /dev/sda2 /", "umount /")
+    if dir := strings.Fields(f.Calls[1])[4]; f.Calls[2] != "umount "+dir {
+        t.Errorf("mounted on %s but ran %q", dir, f.Calls[2])
+    }
+}
+
+func TestProbeSpaceTune2fs(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Errors["findmnt "] = errFake
+    f.Errors["mount "] = errFake
+    f.Outputs["tune2fs -l /dev/sda3"] = tune2fsOutput
+    want := SpaceInfo{Total: 1000 * 4096, Free: 550 * 4096, Used: 400 * 4096, Known: true}
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda3", FSType: "ext4"}); sp != want {
+        t.Errorf("measured %+v, want %+v", sp, want)
+    }
+    checkCalls(t, f, "findmnt /dev/sda3", "mount -o ro,noload /dev/sda3 /", "tune2fs -l /dev/sda3")
+
+    // Only ext2/3/4 have tune2fs to fall back on.
+    f.Calls = nil
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda3", FSType: "xfs"}); sp.Known {
+        t.Errorf("measured %+v on xfs without mounting it", sp)
+    }
+    checkCalls(t, f, "findmnt /dev/sda3", "mount -o ro,norecovery /dev/sda3 /")
+
+    f.Errors["tune2fs "] = errFake
+    f.Calls = nil
+    if sp := ProbeSpace(f, &BlockDevice{Path: "/dev/sda3", FSType: "ext4"}); sp.Known {
+        t.Errorf("measured %+v when tune2fs failed", sp)
+    }
+    checkCalls(t, f, "findmnt /dev/sda3", "mount -o ro,noload /dev/sda3 /", "tune2fs -l /dev/sda3")
+}
+
+func TestProbeSpaceDryRun(t *testing.T) {
+    makeCmdMap()
+    f := NewFakeRunner()
+    f.Errors["findmnt "] = errFake
+    f.Outputs["tune2fs -l /dev/sda3"] = tune2fsOutput
+    d := &DryRunner{Inner: f}
+    if sp := ProbeSpace(d, &BlockDevice{Path: "/dev/sda3", FSType: "ext4"}); !sp.Known {
+        t.Errorf("measured nothing with tune2fs")
+    }
+    checkCalls(t, f, "findmnt /dev/sda3", "tune2fs -l /dev/sda3")
+    if len(d.Steps) != 0 {
+        t.Errorf("probing recorded %v", d.Steps)
+    }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "regexp"
+    "strings"
+)
+
+var (
+    hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+    timezoneName  = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+    keymapName    = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// validateSystem checks the settings written into /etc of the target.
+func validateSystem(c *InstallConfig) error {
+    if c.Hostname != "" {
+        if len(c.Hostname) > 64 {
+            return fmt.Errorf("hostname %q is longer than 64 characters", c.Hostname)
+        }
+        for _, label := range strings.Split(c.Hostname, ".") {
+            if !hostnameLabel.MatchString(label) {
+                return fmt.Errorf("hostname %q is not a valid host name", c.Hostname)
+            }
+        }
+    }
+    if c.Timezone != "" && !timezoneName.MatchString(c.Timezone) {
+        return fmt.Errorf("timezone %q is not a zoneinfo name", c.Timezone)
+    }
+    if c.Keymap != "" && !keymapName.MatchString(c.Keymap) {
+        return fmt.Errorf("keymap %q is not a keymap name", c.Keymap)
+    }
+    switch c.HardwareClock {
+    case "", "utc", "local":
+    default:
+        return fmt.Errorf("hardware_clock must be utc or local, not %q", c.HardwareClock)
+    }
+    return nil
+}
+
+// hostsText is /etc/hosts with the loopback names and, when there is one,
+// the hostname on 127.0.1.1.
+func hostsText(hostname string) string {
+    s := "127.0.0.1  localhost\n::1        localhost\n"
+    if hostname != "" {
+        short, _, _ := strings.Cut(hostname, ".")
+        if short == hostname {
+            s += "127.0.1.1  " + hostname + ".localdomain " + hostname + "\n"
+        } else {
+            s += "127.0.1.1  " + hostname + " " + short + "\n"
+        }
+    }
+    return s
+}
+
+// adjtimeText is /etc/adjtime saying whether the hardware clock keeps UTC
+// or local time. The drift fields start at zero, as hwclock leaves them.
+func adjtimeText(clock string) string {
+    mode := "UTC"
+    if clock == "local" {
+        mode = "LOCAL"
+    }
+    return "0.0 0 0.0\n0\n" + mode + "\n"
+}
+
+// systemOps writes the hostname, time zone, console keymap and hardware
+// clock mode of cfg into the target mounted at root. They only create files
+// under root, so they can be run against any directory.
+func systemOps(cfg *InstallConfig, root string) []Operation {
+    etc := path.Join(root, "etc")
+    static := func(s string) func(Runner) string {
+        return func(Runner) string { return s }
+    }
+    ops := []Operation{newCmdOp("mkdirTarget", etc)}
+    if cfg.Hostname != "" {
+        ops = append(ops, newFileOp(path.Join(etc, "hostname"), static(cfg.Hostname+"\n")))
+    }
+    ops = append(ops, newFileOp(path.Join(etc, "hosts"), static(hostsText(cfg.Hostname))))
+    if cfg.Timezone != "" {
+        // Relative, like systemd creates it, so the link also resolves
+        // from outside the target.
+        ops = append(ops, newCmdOp("symlinkFile", "../usr/share/zoneinfo/"+cfg.Timezone, path.Join(etc, "localtime")))
+    }
+    if cfg.Keymap != "" {
+        ops = append(ops, newFileOp(path.Join(etc, "vconsole.conf"), static("KEYMAP="+cfg.Keymap+"\n")))
+    }
+    return append(ops, newFileOp(path.Join(etc, "adjtime"), static(adjtimeText(cfg.HardwareClock))))
+}
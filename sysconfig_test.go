@@ -0,0 +1,82 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// testRoot is an empty target directory. Its name needs quoting, so every
+// path written under it checks that the destination reaches bash as one
+// word.
+func testRoot(t *testing.T) string {
+    t.Helper()
+    return filepath.Join(t.TempDir(), "phyOS target's root")
+}
+
+// applyInRoot runs ops with ExecRunner. Commands that run inside the target
+// with arch-chroot, and the password, need an installed system and are
+// skipped.
+func applyInRoot(t *testing.T, ops []Operation) {
+    t.Helper()
+    makeCmdMap()
+    for _, op := range ops {
+        switch o := op.(type) {
+        case cmdOp:
+            if strings.HasPrefix(commands[o.key], "arch-chroot ") {
+                continue
+            }
+        case passwordOp:
+            continue
+        }
+        if err := op.Apply(ExecRunner{}); err != nil {
+            t.Fatalf("%s: %v", op.Describe(), err)
+        }
+    }
+}
+
+// readTarget returns the file at name under root.
+func readTarget(t *testing.T, root, name string) string {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join(root, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+func TestSystemOps(t *testing.T) {
+    root := testRoot(t)
+    cfg := &InstallConfig{Hostname: "phyos", Timezone: "Europe/Berlin", Keymap: "de-latin1", HardwareClock: "local"}
+    applyInRoot(t, systemOps(cfg, root))
+
+    for name, want := range map[string]string{
+        "etc/hostname":      "phyos\n",
+        "etc/hosts":         "127.0.0.1  localhost\n::1        localhost\n127.0.1.1  phyos.localdomain phyos\n",
+        "etc/vconsole.conf": "KEYMAP=de-latin1\n",
+        "etc/adjtime":       "0.0 0 0.0\n0\nLOCAL\n",
+    } {
+        if got := readTarget(t, root, name); got != want {
+            t.Errorf("%s is %q, want %q", name, got, want)
+        }
+    }
+    link, err := os.Readlink(filepath.Join(root, "etc/localtime"))
+    if err != nil || link != "../usr/share/zoneinfo/Europe/Berlin" {
+        t.Errorf("localtime links to %q (%v), want the relative zoneinfo path", link, err)
+    }
+}
+
+func TestSystemOpsDefaults(t *testing.T) {
+    root := testRoot(t)
+    applyInRoot(t, systemOps(&InstallConfig{}, root))
+
+    if got, want := readTarget(t, root, "etc/adjtime"), "0.0 0 0.0\n0\nUTC\n"; got != want {
+        t.Errorf("adjtime is %q, want %q", got, want)
+    }
+    for _, name := range []string{"etc/hostname", "etc/vconsole.conf", "etc/localtime"} {
+        if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+            t.Errorf("%s written without a value for it: %v", name, err)
+        }
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// DeviceSource discovers the block devices of the machine.
+type DeviceSource interface {
+    Devices() ([]*BlockDevice, error)
+}
+
+// lsblkSource asks lsblk through the runner.
+type lsblkSource struct {
+    r Runner
+}
+
+func (s lsblkSource) Devices() ([]*BlockDevice, error) {
+    return ListBlockDevices(s.r)
+}
+
+// SysfsSource builds the same tree as lsblkTree by reading sysfs directly,
+// so it works on live media without util-linux. Root is normally /sys but
+// can point at a captured fixture tree. UdevData and Mounts are optional and
+// fill in filesystem details and mount points when present.
+type SysfsSource struct {
+    Root     string
+    UdevData string
+    Mounts   string
+}
+
+// NewSysfsSource reads the udev database and the mount table next to root,
+// from run/ and proc/ in the directory holding it. For /sys these are the
+// ones of the running system; a fixture tree brings its own, so it is never
+// mixed with the host's.
+func NewSysfsSource(root string) SysfsSource {
+    top := filepath.Dir(filepath.Clean(root))
+    return SysfsSource{
+        Root:     root,
+        UdevData: filepath.Join(top, "run", "udev", "data"),
+        Mounts:   filepath.Join(top, "proc", "self", "mounts"),
+    }
+}
+
+// sysfsNode is a device found in sysfs together with its kernel name.
+type sysfsNode struct {
+    dev    *BlockDevice
+    kname  string
+    slaves []string
+}
+
+func (s SysfsSource) Devices() ([]*BlockDevice, error) {
+    blockDir := filepath.Join(s.Root, "block")
+    entries, err := os.ReadDir(blockDir)
+    if err != nil {
+        return nil, fmt.Errorf("[SysfsSource] %w", err)
+    }
+    mounts := s.readMounts()
+
+    nodes := make(map[string]*sysfsNode)
+    var order []string
+    for _, e := range entries {
+        dir := filepath.Join(blockDir, e.Name())
+        n := s.readNode(dir, e.Name(), nil)
+        if n.dev.Size == 0 {
+            continue
+        }
+        nodes[n.kname] = n
+        order = append(order, n.kname)
+
+        parts, _ := os.ReadDir(dir)
+        for _, p := range parts {
+            pdir := filepath.Join(dir, p.Name())
+            if !fileExists(filepath.Join(pdir, "partition")) {
+                continue
+            }
+            pn := s.readNode(pdir, p.Name(), n.dev)
+            n.dev.Children = append(n.dev.Children, pn.dev)
+            nodes[pn.kname] = pn
+        }
+        sort.Slice(n.dev.Children, func(i, j int) bool {
+            return n.dev.Children[i].Name < n.dev.Children[j].Name
+        })
+    }
+
+    // Stacked devices (dm, md) hang under every device they are built on.
+    var top []*BlockDevice
+    for _, name := range order {
+        n := nodes[name]
+        var stacked bool
+        for _, slave := range n.slaves {
+            parent, ok := nodes[slave]
+            if !ok {
+                continue
+            }
+            parent.dev.Children = append(parent.dev.Children, n.dev)
+            if n.dev.Parent == nil {
+                n.dev.Parent = parent.dev
+            }
+            stacked = true
+        }
+        if !stacked {
+            top = append(top, n.dev)
+        }
+    }
+    // The mount table names device mapper devices by either their
+    // /dev/mapper path or their kernel name.
+    for kname, n := range nodes {
+        if mp, ok := mounts[n.dev.Path]; ok {
+            n.dev.Mountpoint = mp
+        } else {
+            n.dev.Mountpoint = mounts["/dev/"+kname]
+        }
+    }
+    return top, nil
+}
+
+func (s SysfsSource) readNode(dir, kname string, parent *BlockDevice) *sysfsNode {
+    d := &BlockDevice{
+        Name:      "/dev/" + kname,
+        Path:      "/dev/" + kname,
+        Type:      "disk",
+        Size:      lsblkNum(readSysInt(dir, "size") * 512),
+        Removable: readSysInt(dir, "removable") == 1,
+        ReadOnly:  readSysInt(dir, "ro") == 1,
+        Parent:    parent,
+    }
+    n := &sysfsNode{dev: d, kname: kname}
+    if parent != nil {
+        d.Type = "part"
+        d.Start = lsblkNum(readSysInt(dir, "start"))
+        d.LogSec = parent.LogSec
+        d.Rota = parent.Rota
+        d.Tran = parent.Tran
+    } else {
+        d.LogSec = lsblkNum(readSysInt(dir, "queue/logical_block_size"))
+        d.Rota = readSysInt(dir, "queue/rotational") == 1
+        d.Model = readSysString(dir, "device/model")
+        d.Serial = readSysString(dir, "device/serial")
+        d.Tran = sysfsTransport(dir, kname)
+    }
+
+    switch {
+    case strings.HasPrefix(kname, "loop"):
+        d.Type = "loop"
+    case strings.HasPrefix(kname, "sr"):
+        d.Type = "rom"
+    case strings.HasPrefix(kname, "md"):
+        d.Type = "raid" + strings.TrimPrefix(readSysString(dir, "md/level"), "raid")
+    case fileExists(filepath.Join(dir, "dm")):
+        name := readSysString(dir, "dm/name")
+        d.Path = "/dev/mapper/" + name
+        d.Name = d.Path
+        uuid := readSysString(dir, "dm/uuid")
+        switch {
+        case strings.HasPrefix(uuid, "CRYPT-"):
+            d.Type = "crypt"
+        case strings.HasPrefix(uuid, "LVM-"):
+            d.Type = "lvm"
+        default:
+            d.Type = "dm"
+        }
+    }
+    if slaves, err := os.ReadDir(filepath.Join(dir, "slaves")); err == nil {
+        for _, sl := range slaves {
+            n.slaves = append(n.slaves, sl.Name())
+        }
+    }
+    s.readUdev(d, readSysString(dir, "dev"))
+    return n
+}
+
+// readUdev fills in what only udev knows (filesystem and partition table
+// details) from its database entry for the major:minor number dev.
+func (s SysfsSource) readUdev(d *BlockDevice, dev string) {
+    if s.UdevData == "" || dev == "" {
+        return
+    }
+    f, err := os.Open(filepath.Join(s.UdevData, "b"+dev))
+    if err != nil {
+        return
+    }
+    defer f.Close()
+    props := make(map[string]string)
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        line := sc.Text()
+        if !strings.HasPrefix(line, "E:") {
+            continue
+        }
+        if k, v, ok := strings.Cut(line[2:], "="); ok {
+            props[k] = v
+        }
+    }
+    setIfEmpty := func(dst *string, key string) {
+        if *dst == "" {
+            *dst = props[key]
+        }
+    }
+    setIfEmpty(&d.FSType, "ID_FS_TYPE")
+    setIfEmpty(&d.UUID, "ID_FS_UUID")
+    setIfEmpty(&d.Label, "ID_FS_LABEL")
+    setIfEmpty(&d.PartUUID, "ID_PART_ENTRY_UUID")
+    setIfEmpty(&d.PartType, "ID_PART_ENTRY_TYPE")
+    setIfEmpty(&d.PartLabel, "ID_PART_ENTRY_NAME")
+    setIfEmpty(&d.PTType, "ID_PART_TABLE_TYPE")
+    setIfEmpty(&d.Model, "ID_MODEL")
+    setIfEmpty(&d.Serial, "ID_SERIAL_SHORT")
+}
+
+// readMounts maps device paths to where they are mounted.
+func (s SysfsSource) readMounts() map[string]string {
+    mounts := make(map[string]string)
+    if s.Mounts == "" {
+        return mounts
+    }
+    f, err := os.Open(s.Mounts)
+    if err != nil {
+        return mounts
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        fields := strings.Fields(sc.Text())
+        if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+            continue
+        }
+        if _, ok := mounts[fields[0]]; !ok {
+            mounts[fields[0]] = fields[1]
+        }
+    }
+    return mounts
+}
+
+// sysfsTransport guesses what lsblk reports as TRAN from where the device
+// sits in the device hierarchy.
+func sysfsTransport(dir, kname string) string {
+    if strings.HasPrefix(kname, "nvme") {
+        return "nvme"
+    }
+    real, err := filepath.EvalSymlinks(dir)
+    if err != nil {
+        return ""
+    }
+    switch {
+    case strings.Contains(real, "/usb"):
+        return "usb"
+    case strings.Contains(real, "/ata"):
+        return "sata"
+    case strings.Contains(real, "/mmc_host/"):
+        return "mmc"
+    case strings.Contains(real, "/virtio"):
+        return "virtio"
+    }
+    return ""
+}
+
+func readSysString(dir, name string) string {
+    b, err := os.ReadFile(filepath.Join(dir, name))
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(b))
+}
+
+func readSysInt(dir, name string) int64 {
+    v, _ := strconv.ParseInt(readSysString(dir, name), 10, 64)
+    return v
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
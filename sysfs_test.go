@@ -0,0 +1,51 @@
+package main
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+// TestSysfsSource reads testdata/sysfs, a captured tree of one GPT disk
+// with 4K sectors holding an ESP and a LUKS container, which holds the
+// root LV of the phyos volume group. The mount table names the LV by its
+// kernel name, dm-1.
+func TestSysfsSource(t *testing.T) {
+    devs, err := NewSysfsSource(filepath.Join("testdata", "sysfs", "sys")).Devices()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(devs) != 1 {
+        t.Fatalf("found %d top level devices, want only /dev/sda", len(devs))
+    }
+    sda := devs[0]
+    if sda.Path != "/dev/sda" || sda.Type != "disk" || sda.Size != 125829120*512 || sda.LogSec != 4096 ||
+        sda.PTType != "gpt" || sda.Model != "Fixture Disk" || sda.Serial != "FX0001" || sda.Rota || sda.Removable {
+        t.Errorf("disk is %+v", *sda)
+    }
+    if len(sda.Children) != 2 {
+        t.Fatalf("/dev/sda has %d partitions, want 2", len(sda.Children))
+    }
+
+    esp, luks := sda.Children[0], sda.Children[1]
+    if esp.Path != "/dev/sda1" || esp.Type != "part" || esp.Start != 2048 || esp.Size != 2097152*512 ||
+        esp.FSType != "vfat" || esp.Label != "ESP" || esp.PartLabel != "EFI" || !isESP(esp) ||
+        esp.Mountpoint != "/boot" || esp.LogSec != 4096 || esp.Parent != sda {
+        t.Errorf("ESP is %+v", *esp)
+    }
+    if luks.Path != "/dev/sda2" || luks.FSType != "crypto_LUKS" || luks.UUID != "6f1c2e0a-9b8d-4c3e-8a7b-6c5d4e3f2a1b" || len(luks.Children) != 1 {
+        t.Fatalf("LUKS partition is %+v", *luks)
+    }
+
+    crypt := luks.Children[0]
+    if crypt.Path != "/dev/mapper/cryptroot" || crypt.Type != "crypt" || crypt.FSType != "LVM2_member" || crypt.Parent != luks || len(crypt.Children) != 1 {
+        t.Fatalf("dm-crypt device is %+v", *crypt)
+    }
+    lv := crypt.Children[0]
+    if lv.Path != "/dev/mapper/phyos-root" || lv.Type != "lvm" || lv.Size != 41943040*512 || lv.FSType != "ext4" ||
+        lv.Label != "root" || lv.Mountpoint != "/" || lv.Parent != crypt || len(lv.Children) != 0 {
+        t.Errorf("LV is %+v", *lv)
+    }
+    if d := FindDevice(devs, "/dev/mapper/phyos-root"); d != lv {
+        t.Errorf("FindDevice found %v for the LV", d)
+    }
+}
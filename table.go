@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"golang.org/x/term"
@@ -24,10 +26,140 @@ type model struct {
     TabContent []RenderStr
 	tabCurrent *RenderStr
     tabNumber  int
+    cfg        *InstallConfig
+    q          *OpQueue
+    apply      bool
 }
 
 type tableModel struct {
     table.Model
+    target string
+    q      *OpQueue
+    editor *partEditor
+    btrfs  *btrfsEditor
+    mounts map[string]PartitionConfig
+    // layout is what the mounts and target amount to with the queued
+    // guided layouts applied. refreshPlan keeps it current.
+    layout DiskConfig
+    err    error
+    // firmware is how the machine boots, uefi or bios.
+    firmware string
+}
+
+// mountLabel describes what happens to dev in the Mount column.
+func (m tableModel) mountLabel(dev string) string {
+    var pc PartitionConfig
+    ok := false
+    for _, p := range m.layout.Partitions {
+        if p.Device == dev {
+            pc, ok = p, true
+        }
+    }
+    if !ok {
+        return ""
+    }
+    action := "keep"
+    if pc.Format {
+        fs := pc.Filesystem
+        if fs == "" {
+            fs = defaultFilesystem(pc.Mountpoint)
+        }
+        action = "format " + fs
+    }
+    if pc.Mountpoint == "" {
+        return action
+    }
+    return pc.Mountpoint + ", " + action
+}
+
+func (m tableModel) rows() []table.Row {
+    rows := make([]table.Row, len(TablePartitionArr))
+    for i, r := range TablePartitionArr {
+        rows[i] = append(append(table.Row{}, r...), m.mountLabel(r[0]))
+    }
+    return rows
+}
+
+// checkGuided refuses to edit the mount of dev by hand while a guided
+// layout erases its disk.
+func (m tableModel) checkGuided(dev string) error {
+    if disk := guidedDisk(m.q, dev); disk != "" {
+        return fmt.Errorf("%s is laid out by the guided layout, undo it in the Pending tab to edit it", disk)
+    }
+    return nil
+}
+
+// assign cycles the mount point of dev through mountPresets, or toggles
+// whether it is formatted or keeps its data.
+func (m *tableModel) assign(dev string, toggleFormat bool) {
+    pc, ok := m.mounts[dev]
+    if !ok {
+        pc = PartitionConfig{Device: dev, Format: true}
+    }
+    if toggleFormat {
+        pc.Format = !pc.Format
+    } else {
+        next := 0
+        for i, mp := range mountPresets {
+            if mp == pc.Mountpoint {
+                next = (i + 1) % len(mountPresets)
+            }
+        }
+        pc.Mountpoint = mountPresets[next]
+    }
+    d := FindDevice(blockDevices, dev)
+    if d != nil && !pc.Format {
+        pc.Filesystem = d.FSType
+    } else if toggleFormat {
+        pc.Filesystem = ""
+    }
+    if pc.Format && pc.Filesystem == "" && d != nil && isESP(d) {
+        // An ESP mounted at /boot must stay FAT to be bootable.
+        pc.Filesystem = "vfat"
+    }
+    if pc.Mountpoint == "" && !toggleFormat {
+        delete(m.mounts, dev)
+    } else {
+        m.mounts[dev] = pc
+    }
+    m.SetRows(m.rows())
+}
+
+// cycleFilesystem moves dev, which must be marked for formatting, on to the
+// next filesystem in the registry.
+func (m *tableModel) cycleFilesystem(dev string) {
+    pc, ok := m.mounts[dev]
+    if !ok || !pc.Format {
+        return
+    }
+    fs := pc.Filesystem
+    if fs == "" {
+        fs = defaultFilesystem(pc.Mountpoint)
+    }
+    pc.Filesystem = nextFilesystem(fs, pc.Mountpoint == "/")
+    m.mounts[dev] = pc
+    m.SetRows(m.rows())
+}
+
+func (m tableModel) View() string {
+    if m.editor != nil {
+        return m.editor.View()
+    }
+    if m.btrfs != nil {
+        return m.btrfs.View()
+    }
+    help := "\n" + continueStyle.Render("enter: edit partitions  space: pick install target  m: mount point  f: format/keep  t: filesystem  g: erase disk with guided layout  b: btrfs subvolumes")
+    if m.err != nil {
+        help += "\n" + inputStyle.Render(m.err.Error())
+    }
+    view := m.Model.View()
+    if m.firmware != "" {
+        view += "\n" + inputStyle.Render("Boot mode: ") + strings.ToUpper(m.firmware)
+    }
+    if m.layout.Target == "" {
+        return view + help
+    }
+    return view + "\n" + inputStyle.Render("Install target: ") + m.layout.Target + help
 }
 
 type tabString struct {
@@ -40,10 +172,156 @@ func (t tabString) View() string {
 
 func (m model) Init() tea.Cmd { return nil }
 
+// config merges what was entered in the TUI into the loaded answers file
+// and applies the guided layouts that are queued.
+func (m model) config() *InstallConfig {
+    c := *m.cfg
+    c.Users = append([]UserConfig(nil), m.cfg.Users...)
+    for _, tab := range m.TabContent {
+        switch v := tab.(type) {
+        case tableModel:
+            if v.target != "" {
+                c.Disk.Target = v.target
+            }
+            c.Disk.Partitions = nil
+            for _, pc := range v.mounts {
+                c.Disk.Partitions = append(c.Disk.Partitions, pc)
+            }
+            sort.Slice(c.Disk.Partitions, func(i, j int) bool {
+                return c.Disk.Partitions[i].Device < c.Disk.Partitions[j].Device
+            })
+        case textInputModel:
+            c.Hostname = strings.TrimSpace(v.inputs[HOSTNAME].Value())
+            c.Timezone = strings.TrimSpace(v.inputs[TIMEZONE].Value())
+            c.Keymap = strings.TrimSpace(v.inputs[KBD].Value())
+            c.Locale = strings.TrimSpace(v.inputs[LOCALE].Value())
+            c.ExtraLocales = v.selectedExtras()
+            u := UserConfig{Groups: []string{"wheel", "audio", "video"}, Sudo: true}
+            if len(c.Users) > 0 {
+                u = c.Users[0]
+            } else {
+                c.Users = append(c.Users, u)
+            }
+            u.Name = strings.TrimSpace(v.inputs[USERNAME].Value())
+            u.Password = Secret(v.inputs[PASS].Value())
+            if u.Password != "" {
+                // A password typed in replaces the hash of an answers file.
+                u.PasswordHash = ""
+            }
+            c.Users[0] = u
+            // Without a passphrase of its own the disk is unlocked with
+            // the password; the User Info tab says so.
+            if c.Disk.Encryption.Passphrase == "" {
+                c.Disk.Encryption.Passphrase = u.Password
+            }
+        }
+    }
+    return withLayouts(&c, m.q)
+}
+
+// refreshPlan keeps the Plan, fstab and Pending tabs in sync with the
+// current choices.
+func (m model) refreshPlan() {
+    cfg := m.config()
+    for i, c := range m.TabContent {
+        switch v := c.(type) {
+        case planModel:
+            steps, err := previewInstall(cfg, m.q)
+            m.TabContent[i] = planModel{steps, err}
+        case fstabModel:
+            m.TabContent[i] = v.refresh(cfg, m.q)
+        case queueModel:
+            v.install, v.warnings, v.err = nil, nil, nil
+            v.boot = bootSummary(cfg.Bootloader)
+            if cfg.Disk.Target != "" || len(cfg.Disk.Partitions) > 0 {
+                v.install, v.err = installOps(cfg)
+            }
+            if v.install != nil {
+                v.warnings, v.err = checkFirmware(blockDevices, cfg, m.q)
+            }
+            m.TabContent[i] = v
+        case textInputModel:
+            e := m.cfg.Disk.Encryption
+            v.encrypted = e.Enabled
+            v.unlocksDisk = e.Enabled && e.Passphrase == ""
+            m.TabContent[i] = v
+        case tableModel:
+            v.firmware = cfg.Bootloader.withDefaults().Firmware
+            v.layout = cfg.Disk
+            v.SetRows(v.rows())
+            m.TabContent[i] = v
+        }
+    }
+}
+
+// guided queues the automatic layout for the disk holding dev. The
+// Partitions tab shows the result through refreshPlan.
+func (m model) guided(dev string) error {
+    d := FindDevice(blockDevices, dev)
+    if d == nil {
+        return fmt.Errorf("%s is not a block device", dev)
+    }
+    disk := d.Disk()
+    for _, op := range m.q.partOps() {
+        if op.Disk == disk.Path {
+            return fmt.Errorf("%s has pending changes, undo them first", disk.Path)
+        }
+    }
+    cfg := m.config()
+    cfg.Disk.Guided = &GuidedConfig{Disk: disk.Path, Swap: true, Home: "auto"}
+    op, err := applyGuided(cfg, blockDevices)
+    if err != nil {
+        return err
+    }
+    m.q.Add(op)
+    return nil
+}
+
+// showTab switches to the first tab holding a T.
+func showTab[T RenderStr](m *model) {
+    for i, c := range m.TabContent {
+        if _, ok := c.(T); ok {
+            m.tabNumber = i
+            m.tabCurrent = &m.TabContent[i]
+            return
+        }
+    }
+}
+
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+    mdl, cmd := m.update(msg)
+    mdl.(model).refreshPlan()
+    return mdl, cmd
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+        if mdl, ok := (*m.tabCurrent).(textInputModel); ok && mdl.saving {
+            return m.updateSave(mdl, msg)
+        }
+        if mdl, ok := (*m.tabCurrent).(tableModel); ok && mdl.editor != nil && msg.String() != "ctrl+c" {
+            cmd := mdl.editor.update(msg)
+            if mdl.editor.closed {
+                mdl.editor = nil
+            }
+            m.TabContent[m.tabNumber] = mdl
+            return m, cmd
+        }
+        if mdl, ok := (*m.tabCurrent).(tableModel); ok && mdl.btrfs != nil && msg.String() != "ctrl+c" {
+            cmd := mdl.btrfs.update(msg)
+            if mdl.btrfs.closed {
+                mdl.btrfs = nil
+            }
+            m.TabContent[m.tabNumber] = mdl
+            return m, cmd
+        }
+        if mdl, ok := (*m.tabCurrent).(lvmModel); ok && (mdl.form != nil || mdl.confirm != nil) && msg.String() != "ctrl+c" {
+            mdl, cmd = mdl.update(msg)
+            m.TabContent[m.tabNumber] = mdl
+            return m, cmd
+        }
 		switch msg.String() {
         case "tab":
             m.tabNumber = (m.tabNumber+1) % len(m.Tabs)
@@ -70,15 +348,91 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
         case tableModel:
             switch msg.String() {
                 case "enter":
-                    return m, tea.Batch(
-                        tea.Printf("Let's go to %s!", mdl.SelectedRow()[1]), cmd)
+                    if len(mdl.SelectedRow()) == 0 {
+                        return m, cmd
+                    }
+                    if d := FindDevice(blockDevices, mdl.SelectedRow()[0]); d != nil {
+                        mdl.editor = newPartEditor(d.Disk(), mdl.q)
+                        m.TabContent[m.tabNumber] = mdl
+                    }
+                    return m, cmd
+                case "b":
+                    mdl.btrfs = newBtrfsEditor(m.cfg)
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, cmd
+                case "g":
+                    if len(mdl.SelectedRow()) == 0 {
+                        return m, cmd
+                    }
+                    mdl.err = m.guided(mdl.SelectedRow()[0])
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, cmd
+                case "m", "f":
+                    if len(mdl.SelectedRow()) == 0 {
+                        return m, cmd
+                    }
+                    if mdl.err = mdl.checkGuided(mdl.SelectedRow()[0]); mdl.err != nil {
+                        m.TabContent[m.tabNumber] = mdl
+                        return m, cmd
+                    }
+                    mdl.assign(mdl.SelectedRow()[0], msg.String() == "f")
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, cmd
+                case "t":
+                    if len(mdl.SelectedRow()) == 0 {
+                        return m, cmd
+                    }
+                    if mdl.err = mdl.checkGuided(mdl.SelectedRow()[0]); mdl.err != nil {
+                        m.TabContent[m.tabNumber] = mdl
+                        return m, cmd
+                    }
+                    mdl.cycleFilesystem(mdl.SelectedRow()[0])
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, cmd
+                case " ":
+                    if len(mdl.SelectedRow()) == 0 {
+                        return m, cmd
+                    }
+                    if mdl.target == mdl.SelectedRow()[0] {
+                        mdl.target = ""
+                    } else {
+                        mdl.target = mdl.SelectedRow()[0]
+                    }
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, cmd
+                }
+            case lvmModel:
+                mdl, cmd = mdl.update(msg)
+                m.TabContent[m.tabNumber] = mdl
+                return m, cmd
+            case queueModel:
+                if msg.String() == "b" && !mdl.confirming {
+                    m.cfg.Bootloader.Type = nextBootloader(m.cfg.Bootloader.withDefaults().Type)
+                    return m, nil
+                }
+                var apply bool
+                mdl, apply = mdl.update(msg)
+                m.TabContent[m.tabNumber] = mdl
+                if apply {
+                    m.apply = true
+                    return m, tea.Quit
                 }
+                return m, nil
             case textInputModel:
                 switch msg.String() {
                 case "enter":
-                if mdl.focused == len(mdl.inputs)-1 {
-                    return m, tea.Quit
-                } else if mdl.focused == 4 {
+                if mdl.focused == CONTINUE {
+                    if mdl.inputs[PASS].Value() != mdl.inputs[PASSCONFIRM].Value() {
+                        mdl.err = fmt.Errorf("Passwords do not match")
+                        m.TabContent[m.tabNumber] = mdl
+                        return m, nil
+                    }
+                    mdl.err = nil
+                    mdl.saving = true
+                    mdl.savePath.Focus()
+                    m.TabContent[m.tabNumber] = mdl
+                    return m, textinput.Blink
+                } else if mdl.focused == TIMEZONE {
                     if mdl.renderList == 0 {
                         mdl.renderList = TIMEZONE
                     } else {
@@ -86,7 +440,15 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                         mdl.renderList = 0
                     }
                     m.TabContent[m.tabNumber] = mdl
-                } else if mdl.focused == 6 {
+                } else if mdl.focused == LOCALE {
+                    if mdl.renderList == 0 {
+                        mdl.renderList = LOCALE
+                    } else {
+                        mdl.inputs[mdl.focused].SetValue(string(mdl.localeList.SelectedItem().(item)))
+                        mdl.renderList = 0
+                    }
+                    m.TabContent[m.tabNumber] = mdl
+                } else if mdl.focused == KBD {
                     if mdl.renderList == 0 {
                         mdl.renderList = KBD
                     } else {
@@ -95,6 +457,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                     }
                     m.TabContent[m.tabNumber] = mdl
                 }
+                case " ":
+                    if mdl.renderList == LOCALE {
+                        l := string(mdl.localeList.SelectedItem().(item))
+                        mdl.extraLocales[l] = !mdl.extraLocales[l]
+                        m.TabContent[m.tabNumber] = mdl
+                        return m, nil
+                    }
                 case "ctrl+k", "up":
                     mdl, ok := (*m.tabCurrent).(textInputModel); if ok{
                         mdl.prevInput()
@@ -133,6 +502,8 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                 mdl.zoneList, cmd = mdl.zoneList.Update(msg)
             } else if mdl.renderList == KBD {
                 mdl.kbdList, cmd = mdl.kbdList.Update(msg)
+            } else if mdl.renderList == LOCALE {
+                mdl.localeList, cmd = mdl.localeList.Update(msg)
             }
             m.TabContent[m.tabNumber] = mdl
             return m, cmd
@@ -140,10 +511,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		for i := range mdl.inputs {
 			mdl.inputs[i].Blur()
 		}
-		mdl.inputs[mdl.focused].Focus()
+		if mdl.focused < len(mdl.inputs) {
+			mdl.inputs[mdl.focused].Focus()
+		}
         var cmds []tea.Cmd = make([]tea.Cmd, len(mdl.inputs))
         for i := range mdl.inputs {
-            if i != 4 && i != 5 {
+            if i != TIMEZONE && i != LOCALE {
                 mdl.inputs[i], cmds[i] = mdl.inputs[i].Update(msg)
             }
         }
@@ -154,6 +527,34 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// updateSave handles the prompt shown after "Continue ->" that offers to
+// save the collected choices as an answers file, then moves on to the
+// Pending tab where they can be reviewed and applied.
+func (m model) updateSave(mdl textInputModel, msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+    var cmd tea.Cmd
+    switch msg.String() {
+    case "ctrl+c":
+        return m, tea.Quit
+    case "esc":
+    case "enter":
+        if path := strings.TrimSpace(mdl.savePath.Value()); path != "" {
+            if err := SaveConfig(path, m.config()); err != nil {
+                mdl.err = err
+                m.TabContent[m.tabNumber] = mdl
+                return m, nil
+            }
+        }
+    default:
+        mdl.savePath, cmd = mdl.savePath.Update(msg)
+        m.TabContent[m.tabNumber] = mdl
+        return m, cmd
+    }
+    mdl.saving = false
+    m.TabContent[m.tabNumber] = mdl
+    showTab[queueModel](&m)
+    return m, nil
+}
+
 func tabBorderWithBottom(left, middle, right string) lipgloss.Border {
 	border := lipgloss.RoundedBorder()
 	border.BottomLeft = left
@@ -220,17 +621,22 @@ func (m model) View() string {
             }
             doc.WriteString(t)
         default:
-            doc.WriteString(windowStyle.Render(v.View()))
+            t := windowStyle.Render(v.View())
+            if borPos - 2 > 1  {
+                t = t[:borPos - 8] + "┴─" + t[borPos - 2:]
+            }
+            doc.WriteString(t)
         }
         return docStyle.Render(doc.String())
 }
 
-func CreatePartitionTable() {
+func CreatePartitionTable(r Runner, cfg *InstallConfig, q *OpQueue, dryRun bool) model {
 
 
     colLen, lineLen, _ := term.GetSize(0)
     totSum := 0
 
+    TableMaxStrLenArr[5] = IntMax(TableMaxStrLenArr[5], len("/boot/efi, format btrfs"))
     for _, i := range TableMaxStrLenArr {
         totSum += i
     }
@@ -246,6 +652,7 @@ func CreatePartitionTable() {
         {Title: "Fsavail (GB)", Width:TableMaxStrLenArr[2] + toAdd},
         {Title: "Fstype", Width: TableMaxStrLenArr[3] + toAdd},
         {Title: "Size (GB)", Width:   TableMaxStrLenArr[4] + toAdd},
+        {Title: "Mount", Width:       TableMaxStrLenArr[5] + toAdd},
     }
 
     if lineLen > len(TablePartitionArr) {
@@ -273,15 +680,26 @@ func CreatePartitionTable() {
 		Bold(false)
 	t.SetStyles(s)
 
-    tableM := tableModel{t}
+    tableM := tableModel{Model: t, target: cfg.Disk.Target, q: q, mounts: make(map[string]PartitionConfig)}
+    for _, pc := range cfg.Disk.Partitions {
+        tableM.mounts[pc.Device] = pc
+    }
+    tableM.SetRows(tableM.rows())
 
 
-    tabs := []string{"User Info", "Partitions"}
-    tabContent := []RenderStr{initialtextInputModel(), tableM}
+    tabs := []string{"User Info", "Partitions", "LVM", "fstab", "Pending"}
+    tabContent := []RenderStr{initialtextInputModel(r, cfg), tableM, newLVMModel(r, q), fstabModel{r: r}, queueModel{q: q}}
+    if dryRun {
+        tabs = append(tabs, "Plan")
+        tabContent = append(tabContent, planModel{})
+    }
 
-	m := model{tabs, tabContent, &tabContent[0], 0}
-	if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+	m := model{Tabs: tabs, TabContent: tabContent, tabCurrent: &tabContent[0], cfg: cfg, q: q}
+    m.refreshPlan()
+	res, err := tea.NewProgram(m, tea.WithAltScreen()).Run()
+	if err != nil {
 		fmt.Println("Error running program:", err)
 		os.Exit(1)
 	}
+    return res.(model)
 }
@@ -22,6 +22,8 @@ const (
         TIMEZONE
         LOCALE
         KBD
+        // CONTINUE is the "Continue ->" line after the last input.
+        CONTINUE
     )
 
     const (
@@ -38,9 +40,20 @@ type textInputModel struct {
 	inputs  []textinput.Model
     zoneList list.Model
     kbdList  list.Model
+    localeList list.Model
+    // extraLocales are the locales marked in localeList to be generated
+    // next to the default one. localeDelegate shares the map.
+    extraLocales map[string]bool
     renderList int
 	focused int
 	err     error
+    saving   bool
+    savePath textinput.Model
+    // encrypted is set when the disk is encrypted. unlocksDisk is set when
+    // it has no passphrase of its own, so the password is used for LUKS as
+    // well.
+    encrypted   bool
+    unlocksDisk bool
 }
 
 // Validator functions to ensure valid input
@@ -92,8 +105,8 @@ func cvvValidator(s string) error {
 	return err
 }
 
-func initialtextInputModel() textInputModel {
-    cmd, _ := RunCmdOutput("timedatectl list-timezones")
+func initialtextInputModel(r Runner, cfg *InstallConfig) textInputModel {
+    cmd, _ := r.Output("timedatectl list-timezones")
     cmdArr := strings.Split(string(cmd), "\n")
     var items, itemskbd []list.Item
 
@@ -110,7 +123,7 @@ func initialtextInputModel() textInputModel {
     l.Styles.PaginationStyle = paginationStyle
     l.Styles.HelpStyle = helpStyle
 
-    cmd, _ = RunCmdOutput("timedatectl list-keymaps")
+    cmd, _ = r.Output("timedatectl list-keymaps")
     cmdArr = strings.Split(string(cmd), "\n")
 
     for _, val := range cmdArr {
@@ -124,15 +137,39 @@ func initialtextInputModel() textInputModel {
     lk.Styles.PaginationStyle = paginationStyle
     lk.Styles.HelpStyle = helpStyle
 
-	var inputs []textinput.Model = make([]textinput.Model, 8)
-    cmd, _ = RunCmdOutput("hostnamectl --static")
+    extra := make(map[string]bool)
+    var itemslocale []list.Item
+    for _, l := range supportedLocales() {
+        itemslocale = append(itemslocale, item(strings.Fields(l)[0]))
+    }
+    if len(itemslocale) == 0 {
+        itemslocale = append(itemslocale, item(defaultLocale))
+    }
+    for _, l := range cfg.ExtraLocales {
+        extra[l] = true
+    }
+    for _, l := range generatedLocales(cfg) {
+        if !hasItem(itemslocale, l) {
+            itemslocale = append(itemslocale, item(l))
+        }
+    }
+
+    ll := list.New(itemslocale, localeDelegate{extra}, defaultWidth, IntMin(len(itemslocale), 25))
+    ll.SetShowStatusBar(false)
+    ll.SetFilteringEnabled(false)
+    ll.SetShowTitle(false)
+    ll.Styles.PaginationStyle = paginationStyle
+    ll.Styles.HelpStyle = helpStyle
+
+	var inputs []textinput.Model = make([]textinput.Model, CONTINUE)
+    cmd, _ = r.Output("hostnamectl --static")
 	inputs[HOSTNAME] = textinput.New()
 	inputs[HOSTNAME].CharLimit = 20
 	inputs[HOSTNAME].Width = 30
 	inputs[HOSTNAME].SetValue(string(cmd))
 	inputs[HOSTNAME].Prompt = ""
 
-    cmd, _ = RunCmdOutput("echo -n $SUDO_USER")
+    cmd, _ = r.Output("echo -n $SUDO_USER")
 	inputs[USERNAME] = textinput.New()
 	inputs[USERNAME].SetValue(string(cmd))
 	inputs[USERNAME].CharLimit = 13
@@ -153,35 +190,90 @@ func initialtextInputModel() textInputModel {
 	inputs[PASSCONFIRM].Prompt = ""
     inputs[PASSCONFIRM].EchoMode = textinput.EchoPassword
 
-    cmd, _ = RunCmdOutput("readlink /etc/localtime | cut -d / -f 5- | tr -d '\n'")
+    cmd, _ = r.Output("readlink /etc/localtime | cut -d / -f 5- | tr -d '\n'")
 	inputs[TIMEZONE] = textinput.New()
 	inputs[TIMEZONE].CharLimit = 50
 	inputs[TIMEZONE].Width = 50
 	inputs[TIMEZONE].SetValue(string(cmd))
 	inputs[TIMEZONE].Prompt = ""
 
-    cmd, _ = RunCmdOutput("localectl status | grep -Po '(?<=Keymap: ).*' ")
+    cmd, _ = r.Output("localectl status | grep -Po '(?<=LANG=).*' | tr -d '\n'")
+	inputs[LOCALE] = textinput.New()
+	inputs[LOCALE].CharLimit = 50
+	inputs[LOCALE].Width = 50
+	inputs[LOCALE].SetValue(string(cmd))
+	if inputs[LOCALE].Value() == "" {
+		inputs[LOCALE].SetValue(defaultLocale)
+	}
+	inputs[LOCALE].Prompt = ""
+
+    cmd, _ = r.Output("localectl status | grep -Po '(?<=Keymap: ).*' ")
 	inputs[KBD] = textinput.New()
 	inputs[KBD].CharLimit = 50
 	inputs[KBD].Width = 50
 	inputs[KBD].SetValue(string(cmd))
 	inputs[KBD].Prompt = ""
 
+    prefillInputs(inputs, cfg)
+
+	savePath := textinput.New()
+	savePath.CharLimit = 255
+	savePath.Width = 50
+	savePath.SetValue("phyos-answers.json")
+	savePath.Prompt = ""
+
 	return textInputModel{
 		inputs:  inputs,
         zoneList: l,
         kbdList: lk,
+        localeList: ll,
+        extraLocales: extra,
 		focused: 0,
         renderList: 0,
 		err:     nil,
+        savePath: savePath,
 	}
 }
 
+// prefillInputs overrides the values probed from the live system with the
+// ones given in the answers file.
+func prefillInputs(inputs []textinput.Model, cfg *InstallConfig) {
+    set := func(i int, v string) {
+        if v != "" {
+            inputs[i].SetValue(v)
+        }
+    }
+    set(HOSTNAME, cfg.Hostname)
+    set(TIMEZONE, cfg.Timezone)
+    set(LOCALE, cfg.Locale)
+    set(KBD, cfg.Keymap)
+    if len(cfg.Users) > 0 {
+        set(USERNAME, cfg.Users[0].Name)
+        set(PASS, string(cfg.Users[0].Password))
+        set(PASSCONFIRM, string(cfg.Users[0].Password))
+    }
+}
+
 func (m textInputModel) View() string {
+    if m.saving {
+        note := ""
+        if m.encrypted {
+            note = "\n " + continueStyle.Render("The disk passphrase is not saved. Add it as disk.encryption.passphrase before installing from the file.") + "\n"
+        }
+        return fmt.Sprintf(
+            "\n\n%s\n %s\n%s\n%s\n",
+            inputStyle.Width(50).Render("Save answers file to (passwords are saved hashed):"),
+            m.savePath.View(),
+            note,
+            continueStyle.Render("enter: save and continue, esc: continue without saving"),
+        ) + m.errView() + "\n"
+    }
     if m.renderList == TIMEZONE {
         return m.zoneList.View()
     } else if m.renderList == KBD {
         return m.kbdList.View()
+    } else if m.renderList == LOCALE {
+        return m.localeList.View() + "\n" + continueStyle.Render("    space: generate as well, enter: use as default") + "\n"
     }
 	return fmt.Sprintf(
 		`
@@ -199,6 +291,9 @@ func (m textInputModel) View() string {
 %s
  %s
 
+%s
+ %s%s
+
 %s
  %s
 %s
@@ -209,18 +304,61 @@ func (m textInputModel) View() string {
 		m.inputs[USERNAME].View(),
         inputStyle.Width(50).Render("Password:"),
 		m.inputs[PASS].View(),
-        m.inputs[PASSCONFIRM].View(),
+        m.inputs[PASSCONFIRM].View() + m.passNote(),
         inputStyle.Width(50).Render("Timezone:"),
         m.inputs[TIMEZONE].View(),
+        inputStyle.Width(50).Render("Locale:"),
+        m.inputs[LOCALE].View(),
+        m.extraView(),
         inputStyle.Width(50).Render("Keymap:"),
         m.inputs[KBD].View(),
 		continueStyle.Render("Continue ->"),
-	) + "\n"
+	) + m.errView() + "\n"
+}
+
+// passNote tells that the password unlocks the encrypted disk too.
+func (m textInputModel) passNote() string {
+    if !m.unlocksDisk {
+        return ""
+    }
+    return "\n " + continueStyle.Render("also the passphrase of the encrypted disk, set disk.encryption.passphrase to use another")
+}
+
+func (m textInputModel) errView() string {
+    if m.err == nil {
+        return ""
+    }
+    return "\n" + inputStyle.Render(m.err.Error())
+}
+
+// extraView lists the extra locales below the default one.
+func (m textInputModel) extraView() string {
+    var extra []string
+    for _, l := range m.selectedExtras() {
+        if l != m.inputs[LOCALE].Value() {
+            extra = append(extra, l)
+        }
+    }
+    if len(extra) == 0 {
+        return ""
+    }
+    return "\n " + continueStyle.Render("also "+strings.Join(extra, ", "))
+}
+
+// selectedExtras returns the extra locales in the order of localeList.
+func (m textInputModel) selectedExtras() []string {
+    var out []string
+    for _, it := range m.localeList.Items() {
+        if l := string(it.(item)); m.extraLocales[l] {
+            out = append(out, l)
+        }
+    }
+    return out
 }
 
 // nextInput focuses the next input field
 func (m *textInputModel) nextInput() {
-	m.focused = (m.focused + 1) % len(m.inputs)
+	m.focused = (m.focused + 1) % (CONTINUE + 1)
 }
 
 // prevInput focuses the previous input field
@@ -228,6 +366,6 @@ func (m *textInputModel) prevInput() {
 	m.focused--
 	// Wrap around
 	if m.focused < 0 {
-		m.focused = len(m.inputs) - 1
+		m.focused = CONTINUE
 	}
 }
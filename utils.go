@@ -4,38 +4,21 @@ import (
 	//"errors"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
 	"encoding/json"
-	"os/exec"
+	"flag"
 
 	"github.com/charmbracelet/bubbles/table"
 )
 
-// type Partition struct {
-//     GBfree, GBused, MBfree, MBused float64
-//     Label, FStype, MountPoint string
-// }
-
-type Partition struct {
-     Path       string
-     Fssize     interface{}
-     Fsavail    interface{}
-     Fstype     string
-     Size       interface{}
-     Fsused     interface{}
-     Label      string
-     Mountpoint string
-     Type       string
-}
-
 var commands map[string]string
 var TablePartitionArr []table.Row
-var TableMaxStrLenArr [5]int
-var devArr            []int
+var TableMaxStrLenArr [6]int
+var devArr            []*BlockDevice
+var blockDevices      []*BlockDevice
 
 func IntMax(a, b int) int {
     if a > b {
@@ -51,8 +34,24 @@ func IntMin(a, b int) int {
     return b
 }
 
-func (p Partition) makeTableRow() table.Row {
-    return table.Row{p.Path, fmt.Sprint(p.Fssize), fmt.Sprint(p.Fsavail), fmt.Sprint(p.Fstype), fmt.Sprint(p.Size)}
+func formatGB(n lsblkNum) string {
+    return strconv.FormatFloat(bytesToGB(n), 'f', 2, 64)
+}
+
+// formatSpace renders a filesystem size column: "-" when there is no
+// filesystem and "unknown" when it could not be measured.
+func formatSpace(d *BlockDevice, sp SpaceInfo, n lsblkNum) string {
+    if unprobeable[d.FSType] {
+        return "-"
+    }
+    if !sp.Known {
+        return "unknown"
+    }
+    return formatGB(n)
+}
+
+func makeTableRow(d *BlockDevice, sp SpaceInfo) table.Row {
+    return table.Row{d.Path, formatSpace(d, sp, sp.Total), formatSpace(d, sp, sp.Free), d.FSType, formatGB(d.Size)}
 }
 
 func isRoot() bool {
@@ -63,8 +62,8 @@ func isRoot() bool {
     return currentUser.Username == "root"
 }
 
-func isMounted(dev string) bool {
-    _, err := RunCmdOutput(fmt.Sprintf(commands["checkMount"], dev))
+func isMounted(r Runner, dev string) bool {
+    _, err := r.Output(shellCommand("checkMount", dev))
 
     if err != nil {
         return false
@@ -75,34 +74,97 @@ func isMounted(dev string) bool {
 func makeCmdMap() {
     commands = map[string]string {
         "checkMount" : "findmnt %s",
-        "getFree" : `tune2fs -l %s | grep -E 'Free blocks|Reserved block count|Block size' | awk '{print $NF}'`,
-        "getTotal" : `tune2fs -l %s | grep -E 'Block count|Reserved block count|Block size' | awk '{print $NF}'`,
-        "lsblkTable" : `lsblk --bytes --json --noheadings --paths -o PATH,SIZE,FSSIZE,FSAVAIL,FSTYPE,FSUSED,LABEL,TYPE,MOUNTPOINT | sed 's/\"blockdevices\"\://g;1d;$d'`,
+        "findMountpoint" : "findmnt -n -f -o TARGET --source %s",
+        "mountProbe" : "mount -o %s %s %s",
+        "umountProbe" : "umount %s",
+        "extStats" : "tune2fs -l %s",
+        "xfsSuper" : "xfs_db -r -c 'sb 0' -c 'print dblocks blocksize' %s",
+        "btrfsSuper" : "btrfs inspect-internal dump-super %s",
+        "lsblkTree" : "lsblk --bytes --json --paths -o NAME,PATH,TYPE,SIZE,START,FSSIZE,FSAVAIL,FSUSED,FSTYPE,LABEL,UUID,PARTLABEL,PARTUUID,PARTTYPE,PTTYPE,MODEL,SERIAL,TRAN,ROTA,RM,RO,LOG-SEC,MOUNTPOINT",
+        "lvmPvs" : "pvs --reportformat json --units b --nosuffix -o pv_name,vg_name,pv_size,pv_free",
+        "lvmVgs" : "vgs --reportformat json --units b --nosuffix -o vg_name,vg_size,vg_free,vg_extent_size,vg_extent_count,vg_free_count",
+        "lvmLvs" : "lvs --reportformat json --units b --nosuffix -o lv_name,vg_name,lv_path,lv_size,lv_attr,pool_lv",
         "lvmCreateVg" : "vgcreate -f %s %s",
+        "lvmExtendVg" : "vgextend %s %s",
+        "lvmRenameVg" : "vgrename %s %s",
+        "lvmRemoveVg" : "vgremove -f %s",
+        "lvmRemovePv" : "pvremove %s",
+        "lvmCreateThinPool" : "lvcreate --type thin-pool -L %s -n %s %s",
+        "lvmCreateThinPoolRest" : "lvcreate --type thin-pool -l 100%%FREE -n %s %s",
+        "lvmCreateThinLv" : "lvcreate --type thin -V %s -n %s --thinpool %s",
+        "lvmSnapshot" : "lvcreate --snapshot -L %s -n %s %s",
+        "lvmSnapshotThin" : "lvcreate --snapshot -n %s %s",
+        "lvmResizeLv" : "lvresize --resizefs -L %s %s",
+        "lvmRenameLv" : "lvrename %s %s %s",
+        "lvmRemoveLv" : "lvremove -f %s",
         "lvmCreatePv" : "pvcreate -f %s",
         "lvmCreateLv" : "lvcreate -L %s -n %s %s",
-        "lvmGetInfo0"  : `lvdisplay | grep -P -o '(?<=LV Path).*|(?<=LV Size).*' | tr -d ' '`,
-        "lvmGetInfo" : `lvdisplay --units G -C -o "lv_dm_path,lv_size" --noheadings --separator ',' | tr -d ' '`,
-        "fsFormatExt4" : "mkfs.ext4 %s",
-        "luksFormat" : "printf %s | sudo cryptsetup -q luksFormat phyos",
-        "luksAddPass" : "printf %s | sudo cryptsetup -q luksOpen phyos %s",
+        "lvmCreateLvRest" : "lvcreate -l 100%%FREE -n %s %s",
+        "fsFormatExt4" : "mkfs.ext4 -F%s %s",
+        "fsFormatXfs" : "mkfs.xfs -f%s %s",
+        "fsFormatBtrfs" : "mkfs.btrfs -f%s %s",
+        "fsFormatF2fs" : "mkfs.f2fs -f%s %s",
+        "fsFormatVfat" : "mkfs.fat -F 32%s %s",
+        "fsFormatSwap" : "mkswap -f%s %s",
+        "fsGrowExt4" : "{ e2fsck -f -p %[1]s || [ $? -le 1 ]; } && resize2fs %[1]s",
+        "fsGrowXfs" : "xfs_growfs %s",
+        "fsGrowBtrfs" : "btrfs filesystem resize max %s",
+        "fsGrowF2fs" : "resize.f2fs %s",
+        "fsShrinkExt4" : "{ e2fsck -f -p %[1]s || [ $? -le 1 ]; } && resize2fs %[1]s %[2]dK",
+        "fsShrinkBtrfs" : "btrfs filesystem resize %[2]dK %[1]s",
+        "btrfsSubvolCreate" : "btrfs subvolume create %s",
+        "mkdirTarget" : "mkdir -p %s",
+        "mountDev" : "mount %s %s",
+        "mountDevOpts" : "mount -o %s %s %s",
+        "umountDev" : "umount %s",
+        "swapOn" : "swapon %s",
+        "blkidTag" : "blkid -s %s -o value %s",
+        "writeFile" : "printf '%%s' %s > %s",
+        "appendFile" : "printf '%%s' %s >> %s",
+        "copyFile" : "cp %s %s",
+        "symlinkFile" : "ln -sfn %s %s",
+        "chmodFile" : "chmod %s %s",
+        "userAdd" : "arch-chroot %s useradd -m -s /bin/bash%s %s",
+        "chpasswdHashed" : "arch-chroot %s chpasswd -e",
+        "localeGen" : "arch-chroot %s locale-gen",
+        "mkinitcpio" : "arch-chroot %s mkinitcpio -P",
+        "bootctlInstall" : "arch-chroot %s bootctl install --esp-path=/boot",
+        "grubInstallEfi" : "arch-chroot %s grub-install --target=x86_64-efi --efi-directory=%s --bootloader-id=phyOS",
+        "grubInstallBios" : "arch-chroot %s grub-install --target=i386-pc %s",
+        "grubMkconfig" : "arch-chroot %s grub-mkconfig -o /boot/grub/grub.cfg",
+        "sfdiskWrite" : "echo %s | sfdisk --wipe always --wipe-partitions always %s",
+        "partprobe" : "partprobe %s",
+        "udevSettle" : "udevadm settle",
+        "sfdiskAppend" : "echo %s | sfdisk --append %s",
+        "sfdiskDelete" : "sfdisk --delete %s %d",
+        "sfdiskResize" : "echo %s | sfdisk -N %d %s",
+        "sfdiskType" : "sfdisk --part-type %s %d %s",
+        "sfdiskLabel" : "sfdisk --part-label %s %d %s",
+        "luksFormat" : "cryptsetup -q luksFormat --type %s --cipher %s --key-size %d --pbkdf %s --iter-time %d --key-file - %s",
+        "luksOpen" : "cryptsetup -q open --type luks --key-file - %s %s",
     }
 
 }
 
-func GetPartFreeSpace(dev string) float64 {
-    tmp, err := RunCmdOutput(fmt.Sprintf(commands["getFree"], dev)); if err != nil {
-        return -1
+// shellQuote makes s a single bash word, for the command templates that
+// take free text.
+func shellQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellWord is s as a single bash word, quoted only when it holds anything
+// but the characters bash gives no meaning to, so plans stay readable.
+func shellWord(s string) string {
+    if s == "" {
+        return shellQuote(s)
     }
-    calcArr := strings.Split(string(tmp), "\n")
-    if len(calcArr) >= 3 {
-        var rbc, fb, bs float64
-        rbc, _ = strconv.ParseFloat(calcArr[0], 64)
-        fb, _  = strconv.ParseFloat(calcArr[1], 64)
-        bs, _  = strconv.ParseFloat(calcArr[2], 64)
-        return (math.Abs(fb - rbc) * bs / math.Pow(2, 30))
+    for _, c := range s {
+        ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("@%+=:,./_-", c)
+        if !ok {
+            return shellQuote(s)
+        }
     }
-    return -1
+    return s
 }
 
 func PrettyPrint(data interface{}) {
@@ -116,81 +178,136 @@ func PrettyPrint(data interface{}) {
     fmt.Printf("%s \n", p)
 }
 
-func RunCmd(cmd string) {
-    exec.Command("/bin/bash", "-c", cmd).Start()
-}
-
-func RunCmdOutput(cmd string) ([]byte, error) {
-    return exec.Command("/bin/bash", "-c", cmd).Output()
-}
-
-func MakePartitionTable() {
-    tableStr, _ := RunCmdOutput(commands["lsblkTable"])
-
-    var partitions []Partition
-    json.Unmarshal(tableStr, &partitions)
-    lvmStr, err := RunCmdOutput(commands["lvmGetInfo"]); if err != nil {
-        fmt.Fprintf(os.Stderr, err.Error())
+func MakePartitionTable(r Runner, src DeviceSource) {
+    var err error
+    blockDevices, err = src.Devices()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
     }
-    lvMap := make(map[string]float64)
-    tmp := strings.Split(string(lvmStr), "\n")
 
-    for _, i := range tmp {
-        tmpLv := strings.Split(i, ",")
-        if len(tmpLv) > 1 {
-            lvMap[tmpLv[0]], _ = strconv.ParseFloat(tmpLv[1][0:len(tmpLv[1])-1], 64)
+    WalkDevices(blockDevices, func(part *BlockDevice) {
+        if part.Type == "disk" {
+            devArr = append(devArr, part)
+            return
         }
-    }
+        sp := ProbeSpace(r, part)
+        if sp.Known {
+            part.FSSize, part.FSAvail, part.FSUsed = sp.Total, sp.Free, sp.Used
+        }
+        part.FSExtent = lsblkNum(FilesystemExtent(r, part))
 
-    for i, part := range partitions {
-        _, ok := lvMap[part.Path]; if ok && !isMounted(part.Path) {
-            part.Fssize = lvMap[part.Path]
-            part.Fsavail = GetPartFreeSpace(part.Path)
-        } else {
-            if !isMounted(part.Path) {
-                tmp  := commands["getFree"]
-                part.Fsavail = GetPartFreeSpace(part.Path)
-                commands["getFree"] = commands["getTotal"]
-                part.Fssize = GetPartFreeSpace(part.Path)
-                commands["getFree"] = tmp
-                part.Fsused = part.Fssize.(float64) - part.Fsavail.(float64)
-            } else {
-                    f, ok := part.Fssize.(float64); if ok {
-                        part.Fssize = float64(float64(f) / math.Pow(2, 30))
-                    }
-
-                    f, ok = part.Fsavail.(float64); if ok {
-                        part.Fsavail = float64(float64(f) / math.Pow(2, 30))
-                    }
-
-                    f, ok = part.Fsused.(float64); if ok {
-                        part.Fsused = float64(float64(f) / math.Pow(2, 30))
-                    }
-                }
-            }
+        row := makeTableRow(part, sp)
+        TablePartitionArr = append(TablePartitionArr, row)
+        for i, cell := range row {
+            TableMaxStrLenArr[i] = IntMax(TableMaxStrLenArr[i], len(cell))
+        }
+    })
+}
 
-            f, ok := part.Size.(float64); if ok {
-                part.Size = float64(float64(f) / math.Pow(2, 30))
-            }
+func main() {
+    dryRun := flag.Bool("dry-run", false, "collect the commands that would modify the machine and print them instead of running them")
+    configPath := flag.String("config", "", "answers file (JSON or YAML) describing the installation")
+    unattended := flag.Bool("unattended", false, "install straight from --config without starting the TUI")
+    discovery := flag.String("discovery", "lsblk", "how to find block devices: lsblk or sysfs")
+    sysfsRoot := flag.String("sysfs-root", "/sys", "sysfs mount point read for the firmware type and by --discovery sysfs; udev data and mounts are read from run/ and proc/ beside it")
+    flag.Parse()
 
-        if part.Type != "disk" {
-            TablePartitionArr = append(TablePartitionArr, part.makeTableRow())
-            TableMaxStrLenArr[0] = IntMax(TableMaxStrLenArr[0], len(part.Path))
-            TableMaxStrLenArr[1] = IntMax(TableMaxStrLenArr[1], len(fmt.Sprint(part.Fssize)))
-            TableMaxStrLenArr[2] = IntMax(TableMaxStrLenArr[2], len(fmt.Sprint(part.Fsavail)))
-            TableMaxStrLenArr[3] = IntMax(TableMaxStrLenArr[3], len(fmt.Sprint(part.Fstype)))
-            TableMaxStrLenArr[4] = IntMax(TableMaxStrLenArr[4], len(fmt.Sprint(part.Size)))
-        } else {
-            devArr = append(devArr, i)
+    cfg := defaultConfig()
+    if *configPath != "" {
+        var err error
+        if cfg, err = LoadConfig(*configPath); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
         }
+    } else if *unattended {
+        fmt.Fprintln(os.Stderr, "--unattended needs an answers file given with --config")
+        os.Exit(2)
     }
-}
 
-func main() {
-    if !isRoot() {
+    var r Runner = ExecRunner{}
+    var dry *DryRunner
+    if *dryRun {
+        dry = &DryRunner{Inner: r}
+        r = dry
+    } else if !isRoot() {
         panic("This program must be runned as superuser.")
     }
     makeCmdMap()
-    MakePartitionTable()
-    CreatePartitionTable()
+    bootDefaults.Firmware = DetectFirmware(*sysfsRoot)
+    var src DeviceSource
+    switch *discovery {
+    case "lsblk":
+        src = lsblkSource{r}
+    case "sysfs":
+        src = NewSysfsSource(*sysfsRoot)
+    default:
+        fmt.Fprintf(os.Stderr, "Unknown --discovery %q, expected lsblk or sysfs\n", *discovery)
+        os.Exit(2)
+    }
+    q := &OpQueue{}
+    apply := *unattended
+    if *unattended {
+        var err error
+        if blockDevices, err = src.Devices(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    } else {
+        MakePartitionTable(r, src)
+    }
+    if cfg.Disk.Guided != nil {
+        op, err := applyGuided(cfg, blockDevices)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        // The layout lives in the queued operation from now on.
+        q.Add(op)
+        cfg.Disk.Guided = nil
+    }
+    if *unattended {
+        cfg = withLayouts(cfg, q)
+        if err := cfg.Validate(); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    } else {
+        m := CreatePartitionTable(r, cfg, q, *dryRun)
+        cfg, q, apply = m.config(), m.q, m.apply
+    }
+    if apply {
+        progress := printProgress
+        if dry != nil {
+            progress = nil
+        }
+        if cfg.Disk.Target != "" {
+            if err := checkTarget(blockDevices, cfg, q); err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(1)
+            }
+        }
+        warnings, err := checkFirmware(blockDevices, cfg, q)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        for _, w := range warnings {
+            fmt.Fprintln(os.Stderr, "warning:", w)
+        }
+        if err := Install(r, cfg, q, progress); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    if dry != nil {
+        if !apply {
+            // Quitting the TUI applied nothing; print the plan it showed.
+            var err error
+            if dry.Steps, err = previewInstall(cfg, q); err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(1)
+            }
+        }
+        fmt.Print(dry)
+    }
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+
+    "github.com/charmbracelet/bubbles/table"
+)
+
+const lsblkOutput = `{"blockdevices": [
+  {"name": "/dev/sda", "path": "/dev/sda", "type": "disk", "size": 64424509440, "pttype": "gpt", "children": [
+    {"name": "/dev/sda1", "path": "/dev/sda1", "type": "part", "size": 1073741824, "fstype": "vfat", "mountpoint": "/boot", "fssize": 1071644672, "fsavail": 536870912, "fsused": 534773760},
+    {"name": "/dev/sda2", "path": "/dev/sda2", "type": "part", "size": 4294967296, "fstype": "swap"},
+    {"name": "/dev/sda3", "path": "/dev/sda3", "type": "part", "size": 10737418240, "fstype": "ext4"}
+  ]}
+]}`
+
+// resetTable clears what MakePartitionTable fills in.
+func resetTable() {
+    blockDevices, devArr, TablePartitionArr, TableMaxStrLenArr = nil, nil, nil, [6]int{}
+}
+
+func TestMakePartitionTable(t *testing.T) {
+    makeCmdMap()
+    resetTable()
+    f := NewFakeRunner()
+    f.Outputs["lsblk "] = lsblkOutput
+    f.Errors["findmnt "] = errFake
+    f.Errors["mount "] = errFake
+    f.Outputs["tune2fs -l /dev/sda3"] = tune2fsOutput
+    MakePartitionTable(f, lsblkSource{f})
+
+    checkCalls(t, f, commands["lsblkTree"], "findmnt /dev/sda3", "mount -o ro,noload /dev/sda3 /", "tune2fs -l /dev/sda3", "tune2fs -l /dev/sda3")
+    if len(devArr) != 1 || devArr[0].Path != "/dev/sda" {
+        t.Errorf("disks are %v, want /dev/sda", devArr)
+    }
+    want := []table.Row{
+        {"/dev/sda1", "1.00", "0.50", "vfat", "1.00"},
+        {"/dev/sda2", "-", "-", "swap", "4.00"},
+        {"/dev/sda3", "0.00", "0.00", "ext4", "10.00"},
+    }
+    if !reflect.DeepEqual(TablePartitionArr, want) {
+        t.Errorf("rows are %v, want %v", TablePartitionArr, want)
+    }
+    if d := FindDevice(blockDevices, "/dev/sda3"); d.FSSize != 1000*4096 || d.FSAvail != 550*4096 || d.FSUsed != 400*4096 {
+        t.Errorf("/dev/sda3 has %d/%d/%d, want what tune2fs reported", d.FSSize, d.FSAvail, d.FSUsed)
+    }
+    if d := FindDevice(blockDevices, "/dev/sda3"); d.FSExtent != 1000*4096 {
+        t.Errorf("/dev/sda3 spans %d bytes, want the block count of tune2fs", d.FSExtent)
+    }
+    if TableMaxStrLenArr[0] != len("/dev/sda1") || TableMaxStrLenArr[4] != len("10.00") {
+        t.Errorf("column widths are %v", TableMaxStrLenArr)
+    }
+}
+
+func TestMakePartitionTableUnknownSpace(t *testing.T) {
+    makeCmdMap()
+    resetTable()
+    f := NewFakeRunner()
+    f.Outputs["lsblk "] = lsblkOutput
+    f.Errors["findmnt "] = errFake
+    f.Errors["mount "] = errFake
+    f.Errors["tune2fs "] = errFake
+    MakePartitionTable(f, lsblkSource{f})
+
+    if got := TablePartitionArr[2]; got[1] != "unknown" || got[2] != "unknown" {
+        t.Errorf("row of the unmeasured /dev/sda3 is %v", got)
+    }
+}
+
+func TestMakePartitionTableLsblkFails(t *testing.T) {
+    makeCmdMap()
+    resetTable()
+    f := NewFakeRunner()
+    f.Errors["lsblk "] = errFake
+    MakePartitionTable(f, lsblkSource{f})
+
+    checkCalls(t, f, commands["lsblkTree"])
+    if blockDevices != nil || devArr != nil || TablePartitionArr != nil {
+        t.Errorf("found %v %v %v without lsblk", blockDevices, devArr, TablePartitionArr)
+    }
+}